@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// RangeAllocator 在本地消费租用的号段, 用完后自动租用新的号段, 可以并发使用。
+// 按周期重置的biztag需要直接使用LeaseRange, 以便获取ID所在的周期
+type RangeAllocator struct {
+	c      *Client
+	biztag string
+	size   int
+	mu     sync.Mutex
+	cur    Range
+}
+
+// NewRangeAllocator 每次租用size个ID
+func (c *Client) NewRangeAllocator(biztag string, size int) *RangeAllocator {
+	return &RangeAllocator{c: c, biztag: biztag, size: size}
+}
+
+// Next 返回下一个ID
+func (a *RangeAllocator) Next(ctx context.Context) (int64, error) {
+	r, err := a.Take(ctx, 1)
+	if err != nil {
+		return 0, err
+	}
+	return r.Start, nil
+}
+
+// Take 从当前号段中取出最多n个连续的ID, 当前号段用完时租用新的号段
+func (a *RangeAllocator) Take(ctx context.Context, n int64) (Range, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cur.Len() <= 0 {
+		r, err := a.c.LeaseRange(ctx, a.biztag, a.size)
+		if err != nil {
+			return Range{}, err
+		}
+		a.cur = *r
+	}
+	if n > a.cur.Len() {
+		n = a.cur.Len()
+	}
+	r := Range{Start: a.cur.Start, End: a.cur.Start + n, Period: a.cur.Period}
+	a.cur.Start += n
+	return r, nil
+}
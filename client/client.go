@@ -0,0 +1,118 @@
+// Package client gleafd的Go客户端
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const clientIDHeader = "X-Client-Id"
+
+// Error 服务端返回的错误
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("gleafd: code = %d, msg = %s", e.Code, e.Msg)
+}
+
+// Range 连续的ID范围[Start, End), 不包含End
+type Range struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// 按周期重置的biztag为ID所在的周期, ID只在周期内唯一
+	Period string `json:"period,omitempty"`
+}
+
+// Len 范围内ID的数量
+func (r Range) Len() int64 {
+	return r.End - r.Start
+}
+
+type Client struct {
+	addr       string
+	httpClient *http.Client
+	clientID   string
+}
+
+type Option func(c *Client)
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithClientID 租用号段时服务端记录的client标识
+func WithClientID(id string) Option {
+	return func(c *Client) {
+		c.clientID = id
+	}
+}
+
+// New addr为服务地址, 例如http://127.0.0.1:9060
+func New(addr string, opts ...Option) *Client {
+	c := &Client{
+		addr:       strings.TrimRight(addr, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, data interface{}) error {
+	req, err := http.NewRequest("GET", c.addr+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.clientID != "" {
+		req.Header.Set(clientIDHeader, c.clientID)
+	}
+	httpRsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpRsp.Body.Close()
+	rsp := struct {
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err = json.NewDecoder(httpRsp.Body).Decode(&rsp); err != nil {
+		return fmt.Errorf("gleafd: decode response: %v", err)
+	}
+	if rsp.Code != 0 {
+		return &Error{Code: rsp.Code, Msg: rsp.Msg}
+	}
+	if httpRsp.StatusCode != http.StatusOK {
+		return &Error{Code: httpRsp.StatusCode, Msg: http.StatusText(httpRsp.StatusCode)}
+	}
+	return json.Unmarshal(rsp.Data, data)
+}
+
+// GetSegments 获取count个segment ID
+func (c *Client) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	query := url.Values{"count": {strconv.Itoa(count)}}
+	err = c.get(ctx, "/api/v1/segments/"+url.PathEscape(biztag), query, &ids)
+	return ids, err
+}
+
+// LeaseRange 租用size个连续的segment ID
+func (c *Client) LeaseRange(ctx context.Context, biztag string, size int) (*Range, error) {
+	var r Range
+	query := url.Values{"size": {strconv.Itoa(size)}}
+	if err := c.get(ctx, "/api/v1/segments/"+url.PathEscape(biztag)+"/ranges", query, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// 模拟gleafd的ranges接口
+func newTestServer(t *testing.T) (*httptest.Server, *[]string) {
+	var (
+		mu      sync.Mutex
+		next    int64 = 1
+		clients []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.ParseInt(r.FormValue("size"), 10, 64)
+		if r.URL.Path != "/api/v1/segments/orders/ranges" || size <= 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"code": 400, "msg": "invalid lease size"})
+			return
+		}
+		mu.Lock()
+		rng := Range{Start: next, End: next + size}
+		next += size
+		clients = append(clients, r.Header.Get(clientIDHeader))
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"code": 0, "msg": "Ok", "data": rng})
+	}))
+	return srv, &clients
+}
+
+func TestLeaseRange(t *testing.T) {
+	srv, clients := newTestServer(t)
+	defer srv.Close()
+	c := New(srv.URL, WithClientID("importer"))
+
+	r, err := c.LeaseRange(context.Background(), "orders", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Start != 1 || r.End != 101 || r.Len() != 100 {
+		t.Errorf("range = %+v, want = [1, 101)", r)
+	}
+	if (*clients)[0] != "importer" {
+		t.Errorf("client id = %q, want = importer", (*clients)[0])
+	}
+	_, err = c.LeaseRange(context.Background(), "orders", 0)
+	if e, ok := err.(*Error); !ok || e.Code != 400 {
+		t.Errorf("err = %v, want code 400", err)
+	}
+}
+
+func TestRangeAllocator(t *testing.T) {
+	srv, _ := newTestServer(t)
+	defer srv.Close()
+	a := New(srv.URL).NewRangeAllocator("orders", 10)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 7; j++ {
+				id, err := a.Next(context.Background())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("duplicated id %d", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	// 35个ID需要租用4个号段, 都在[1, 41)内
+	for id := range seen {
+		if id < 1 || id > 40 {
+			t.Errorf("id %d out of leased ranges", id)
+		}
+	}
+	r, err := a.Take(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(r.Start, r.End) != "36 41" {
+		t.Errorf("take = %+v, want = [36, 41)", r)
+	}
+}
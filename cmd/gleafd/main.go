@@ -1,29 +1,37 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/derry6/gleafd/pkg/idempotency"
 	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/pkg/ratelimit"
+	"github.com/derry6/gleafd/pkg/redispool"
 
 	"github.com/derry6/gleafd/config"
 	"github.com/derry6/gleafd/server"
+	"github.com/derry6/gleafd/server/code"
+	"github.com/derry6/gleafd/server/obfuscate"
 	"github.com/derry6/gleafd/server/segment"
 	"github.com/derry6/gleafd/server/snowflake"
+	"github.com/derry6/gleafd/server/uuid"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-
-	"github.com/gomodule/redigo/redis"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
+// redis cluster中所有key使用的hash tag
+const redisHashTag = "{gleafd}"
+
 func parseZapLevel(lvl string) zapcore.Level {
 	switch strings.ToUpper(lvl) {
 	case "DEBUG":
@@ -48,9 +56,65 @@ func newLogger(lvl string) *zap.SugaredLogger {
 	return zap.New(core).Sugar()
 }
 
+func newRateLimit(rule config.RateLimitRule) server.RateLimit {
+	return server.RateLimit{
+		Requests: ratelimit.Limit{Rate: rule.Requests, Burst: rule.RequestsBurst},
+		IDs:      ratelimit.Limit{Rate: rule.IDs, Burst: rule.IDsBurst},
+	}
+}
+
+func newSegmentRegion(c config.SegmentRegionConfig) (*segment.Region, error) {
+	switch c.Mode {
+	case "":
+		return nil, nil
+	case segment.RegionInterleave:
+		return segment.NewInterleavedRegion(c.Offset, c.Stride, c.Block)
+	case segment.RegionPrefix:
+		return segment.NewPrefixRegion(c.Prefix, c.PrefixBits)
+	}
+	return nil, fmt.Errorf("unknown segment region mode: %s", c.Mode)
+}
+
+// interleave模式下号段的最大step和租用的号段必须能够放在一个block中
+func checkSegmentRegions(region *segment.Region, regions map[string]*segment.Region, limits *server.Limits) error {
+	for biztag, r := range regions {
+		if r == nil {
+			continue
+		}
+		if err := r.CheckSize(segment.MaxStep); err != nil {
+			return fmt.Errorf("biztag %s max step: %w", biztag, err)
+		}
+		if err := r.CheckSize(int64(limits.MaxLeaseSize(biztag))); err != nil {
+			return fmt.Errorf("biztag %s lease size: %w", biztag, err)
+		}
+	}
+	if region == nil {
+		return nil
+	}
+	if err := region.CheckSize(segment.MaxStep); err != nil {
+		return fmt.Errorf("max step: %w", err)
+	}
+	if err := region.CheckSize(int64(limits.MaxLeaseSize(""))); err != nil {
+		return fmt.Errorf("lease size: %w", err)
+	}
+	for biztag := range limits.BizTags {
+		if _, ok := regions[biztag]; ok {
+			continue
+		}
+		if err := region.CheckSize(int64(limits.MaxLeaseSize(biztag))); err != nil {
+			return fmt.Errorf("biztag %s lease size: %w", biztag, err)
+		}
+	}
+	return nil
+}
+
 func main() {
 	var wg sync.WaitGroup
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
 	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
 		fmt.Printf("Can not load config: %v", err)
@@ -62,32 +126,273 @@ func main() {
 
 	var logger log.Logger = lg
 
-	dbUrl := cfg.Segment.DBUrl()
-	db, err := sql.Open("mysql", dbUrl)
-	if err != nil {
-		logger.Fatalw("Open database", "err", err)
+	logger.Debugw("Config loaded", "config", cfg.String())
+
+	if cfg.Tracing.Enable {
+		tp, err := newTracerProvider(cfg.Tracing, cfg.Name)
+		if err != nil {
+			logger.Fatalw("Create tracer provider", "err", err)
+		}
+		defer tp.Shutdown(context.Background())
 	}
+
+	connector := newMySQLConnector(cfg.Segment)
+	db := sql.OpenDB(connector)
 	defer db.Close()
+	if cfg.Segment.DBPassFile != "" {
+		w := config.WatchSecretFile(cfg.Segment.DBPassFile, cfg.Segment.DBPass, 10*time.Second,
+			func(pass string, err error) {
+				if err != nil {
+					logger.Errorw("Reload segment db password", "file", cfg.Segment.DBPassFile, "err", err)
+					return
+				}
+				logger.Infow("Segment db password reloaded", "file", cfg.Segment.DBPassFile)
+				connector.SetPassword(pass)
+			})
+		defer w.Close()
+	}
 
 	svcOpts := make([]server.Option, 0)
 	svcOpts = append(svcOpts, server.WithLogger(logger))
 	svcOpts = append(svcOpts, server.WithName(cfg.Name))
 	svcOpts = append(svcOpts, server.WithAddr("127.0.0.1:9060"))
+	limits := server.Limits{
+		MaxCount:  cfg.Limits.MaxCount,
+		Endpoints: cfg.Limits.Endpoints,
+		BizTags:   cfg.Limits.BizTags,
+	}
 
-	repo, err := segment.NewDefaultRepository(db)
+	// DBA不允许启动时执行DDL, 默认只检查版本
+	migrator := segment.NewMigrator(db)
+	if cfg.Segment.AutoMigrate {
+		done, err := migrator.Up(context.Background())
+		if err != nil {
+			logger.Fatalw("Migrate segment schema", "err", err)
+		}
+		for _, mig := range done {
+			logger.Infow("Segment schema migrated", "version", mig.Version, "name", mig.Name)
+		}
+	} else if err = migrator.Check(context.Background()); err != nil {
+		// 旧版本自动创建的表可以继续使用, 执行migrate up之后记录版本
+		var schemaErr *segment.SchemaError
+		if cfg.Segment.SchemaCheck && !(errors.As(err, &schemaErr) && schemaErr.Unversioned) {
+			logger.Fatalw("Check segment schema", "err", err)
+		}
+		logger.Warnw("Check segment schema", "err", err)
+	}
+	var repoOpts []segment.RepositoryOption
+	if cfg.Segment.FloorFile != "" {
+		if cfg.Segment.FloorPolicy != "skip" && cfg.Segment.FloorPolicy != "reject" {
+			logger.Fatalw("Unknown segment floor policy", "policy", cfg.Segment.FloorPolicy)
+		}
+		repoOpts = append(repoOpts, segment.WithFloor(segment.NewFileFloorStore(cfg.Segment.FloorFile),
+			cfg.Segment.FloorPolicy == "skip", logger))
+	}
+	repo, err := segment.NewDefaultRepository(db, repoOpts...)
 	if err != nil {
 		logger.Fatalw("Create segment repository", "err", err)
 	}
+	region, err := newSegmentRegion(cfg.Segment.Region)
+	if err != nil {
+		logger.Fatalw("Create segment region", "err", err)
+	}
+	regions := make(map[string]*segment.Region)
+	for biztag, c := range cfg.Segment.Regions {
+		if regions[biztag], err = newSegmentRegion(c); err != nil {
+			logger.Fatalw("Create segment region", "biztag", biztag, "err", err)
+		}
+	}
+	if err = checkSegmentRegions(region, regions, &limits); err != nil {
+		logger.Fatalw("Check segment region", "err", err)
+	}
+	repo = segment.NewRegionRepository(repo, region, regions)
+	if cfg.Tracing.Enable {
+		repo = segment.NewTracingRepository(repo)
+	}
+	repo = segment.NewCircuitBreaker(repo, cfg.Segment.BreakerFailures, cfg.Segment.BreakerCooldown, logger)
 	svcOpts = append(svcOpts, server.WithSegmentRepository(repo))
+	periods := make(map[string]*segment.Period)
+	for biztag, c := range cfg.Segment.Periods {
+		p, err := segment.NewPeriod(c.Reset, c.Timezone)
+		if err != nil {
+			logger.Fatalw("Create segment period", "biztag", biztag, "err", err)
+		}
+		periods[biztag] = p
+	}
+	svcOpts = append(svcOpts, server.WithSegmentOptions(
+		segment.WithPeriods(periods),
+		segment.WithCallTimeout(cfg.Segment.CallTimeout),
+		segment.WithRetries(cfg.Segment.Retries, cfg.Segment.RetryBackoff),
+		segment.WithLowWater(cfg.Segment.LowWater),
+		segment.WithEmergencyRange(cfg.Segment.EmergencySize),
+		segment.WithPollInterval(cfg.Segment.PollInterval),
+	))
+	templates := make(map[string]*code.Template)
+	for biztag, c := range cfg.Codes {
+		t, err := code.Parse(c.Format, c.Reset, c.Timezone)
+		if err != nil {
+			logger.Fatalw("Parse code template", "biztag", biztag, "err", err)
+		}
+		// 编码和segment共用biztag在周期内的序列号, 周期不同时会互相重置
+		if p, ok := periods[biztag]; ok && t.ResetPeriod() != nil && !p.Equal(t.ResetPeriod()) {
+			logger.Fatalw("Code reset conflicts with segment period", "biztag", biztag,
+				"code", t.ResetPeriod(), "segment", p)
+		}
+		templates[biztag] = t
+	}
+	svcOpts = append(svcOpts, server.WithCodeTemplates(templates))
+	encoders := make(map[string]*obfuscate.Encoder)
+	for biztag, c := range cfg.Obfuscate {
+		// 按周期重置的ID在每个周期重复, 映射之后的ID也会重复
+		if _, ok := periods[biztag]; ok {
+			logger.Fatalw("Can not obfuscate a periodic segment biztag", "biztag", biztag)
+		}
+		keys := make(map[int][]byte)
+		for v, key := range c.Keys {
+			keys[v] = []byte(key)
+		}
+		e, err := obfuscate.NewEncoder(c.Format, c.Alphabet, c.Version, keys)
+		if err != nil {
+			logger.Fatalw("Create obfuscate encoder", "biztag", biztag, "err", err)
+		}
+		encoders[biztag] = e
+	}
+	svcOpts = append(svcOpts, server.WithObfuscators(encoders))
 
-	rp := getRedisPool(cfg.Snowflake.RedisAddresss)
-	stor := snowflake.NewRedisStorage(rp, logger)
+	var redisPass atomic.Value
+	redisPass.Store(cfg.Snowflake.RedisPass)
+	if cfg.Snowflake.RedisPassFile != "" {
+		w := config.WatchSecretFile(cfg.Snowflake.RedisPassFile, cfg.Snowflake.RedisPass, 10*time.Second,
+			func(pass string, err error) {
+				if err != nil {
+					logger.Errorw("Reload snowflake redis password", "file", cfg.Snowflake.RedisPassFile, "err", err)
+					return
+				}
+				logger.Infow("Snowflake redis password reloaded", "file", cfg.Snowflake.RedisPassFile)
+				redisPass.Store(pass)
+			})
+		defer w.Close()
+	}
+	// cluster模式下所有key使用相同的hash tag, 连接池只连接这个slot所在的master
+	namespace := "gleafd"
+	if cfg.Snowflake.RedisMode == redispool.ModeCluster {
+		namespace = redisHashTag
+	}
+	rp, err := redispool.New(redispool.Options{
+		Mode:       cfg.Snowflake.RedisMode,
+		Addrs:      cfg.Snowflake.RedisAddrs(),
+		MasterName: cfg.Snowflake.RedisMaster,
+		HashTag:    redisHashTag,
+		Password:   func() string { return redisPass.Load().(string) },
+	})
+	if err != nil {
+		logger.Fatalw("Create redis pool", "err", err)
+	}
+	defer rp.Close()
+	switch cfg.Segment.Notifier {
+	case "":
+	case "redis":
+		svcOpts = append(svcOpts, server.WithSegmentOptions(
+			segment.WithNotifier(segment.NewRedisNotifier(rp, "gleafd/segment/biztags"))))
+	default:
+		logger.Fatalw("Unknown segment notifier", "notifier", cfg.Segment.Notifier)
+	}
+	layout, err := snowflake.LayoutByName(cfg.Snowflake.Layout)
+	if err != nil {
+		logger.Fatalw("Snowflake layout", "err", err)
+	}
+	stor := snowflake.NewRedisStorage(rp, logger,
+		snowflake.WithHashTag(namespace),
+		snowflake.WithMachineIDMax(layout.MachineIDMax()))
+	if cfg.Tracing.Enable {
+		stor = snowflake.NewTracingStorage(stor)
+	}
 	svcOpts = append(svcOpts, server.WithSnowflakeStorage(stor))
+	policy, err := snowflake.ParseClockRollbackPolicy(cfg.Snowflake.ClockRollback, cfg.Snowflake.ClockRollbackMax)
+	if err != nil {
+		logger.Fatalw("Create clock rollback policy", "err", err)
+	}
+	snowOpts := []snowflake.Option{
+		snowflake.WithLayout(layout),
+		snowflake.WithClockRollbackPolicy(policy),
+		snowflake.WithShards(cfg.Snowflake.Shards),
+		snowflake.WithMaxStartupWait(cfg.Snowflake.MaxStartupWait),
+		snowflake.WithClockSkewCheck(cfg.Snowflake.ClockSkewThreshold, cfg.Snowflake.ClockSkewInterval),
+	}
+	if cfg.Snowflake.PerBizTag {
+		snowOpts = append(snowOpts,
+			snowflake.WithPerBizTag(cfg.Snowflake.BizTagIdle, uint8(cfg.Snowflake.BizTagBits)))
+	}
+	if cfg.Snowflake.CheckpointFile != "" {
+		snowOpts = append(snowOpts, snowflake.WithCheckpoint(snowflake.NewFileCheckpoint(cfg.Snowflake.CheckpointFile)))
+	}
+	svcOpts = append(svcOpts, server.WithSnowflakeOptions(snowOpts...))
+	if cfg.UUID.Enable {
+		svcOpts = append(svcOpts, server.WithUUID(uuid.WithClockRollbackPolicy(policy)))
+	}
+
+	svcOpts = append(svcOpts, server.WithLimits(limits))
+
+	var mdws []server.Midware
+	if cfg.Idempotency.Enable {
+		var store idempotency.Store
+		switch cfg.Idempotency.Store {
+		case "", "memory":
+			store = idempotency.NewMemoryStore(cfg.Idempotency.MaxEntries)
+		case "redis":
+			store = idempotency.NewRedisStore(rp, namespace+"/idempotency/")
+		default:
+			logger.Fatalw("Unknown idempotency store", "store", cfg.Idempotency.Store)
+		}
+		mdws = append(mdws, server.Idempotency(store, cfg.Idempotency.TTL, logger))
+	}
+	if cfg.RateLimit.Enable {
+		var limiter ratelimit.Limiter
+		switch cfg.RateLimit.Store {
+		case "", "memory":
+			limiter = ratelimit.NewMemoryLimiter(cfg.RateLimit.MaxKeys)
+		case "redis":
+			limiter = ratelimit.NewRedisLimiter(rp, namespace+"/ratelimit/")
+		default:
+			logger.Fatalw("Unknown rate limit store", "store", cfg.RateLimit.Store)
+		}
+		limits := server.RateLimits{
+			Client:  newRateLimit(cfg.RateLimit.Client),
+			BizTag:  newRateLimit(cfg.RateLimit.BizTag),
+			BizTags: make(map[string]server.RateLimit),
+		}
+		for biztag, rule := range cfg.RateLimit.BizTags {
+			limits.BizTags[biztag] = newRateLimit(rule)
+		}
+		// 在幂等之前限流
+		mdws = append(mdws, server.RateLimiting(limiter, limits, logger))
+	}
+	svcOpts = append(svcOpts, server.WithMidwares(mdws))
 
 	logger.Infow("Server starting", "name", cfg.Name, "addr", cfg.Addr)
 	svc := server.NewService(svcOpts...)
 
-	srv, err := server.New(svc, logger)
+	var adminToken atomic.Value
+	adminToken.Store(cfg.Admin.Token)
+	if cfg.Admin.TokenFile != "" {
+		w := config.WatchSecretFile(cfg.Admin.TokenFile, cfg.Admin.Token, 10*time.Second,
+			func(token string, err error) {
+				if err != nil {
+					logger.Errorw("Reload admin token", "file", cfg.Admin.TokenFile, "err", err)
+					return
+				}
+				logger.Infow("Admin token reloaded", "file", cfg.Admin.TokenFile)
+				adminToken.Store(token)
+			})
+		defer w.Close()
+	}
+	proxies, err := server.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatalw("Parse trusted proxies", "err", err)
+	}
+	srv, err := server.New(svc, logger,
+		server.WithAdminToken(func() string { return adminToken.Load().(string) }),
+		server.WithTrustedProxies(proxies))
 	if err != nil {
 		logger.Fatalw("Can not create server instance", "err", err)
 	}
@@ -101,7 +406,7 @@ func main() {
 		}
 	}()
 	// catch signals
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 	for signo := range signals {
 		logger.Errorw("Got signal", "signo", signo)
@@ -110,11 +415,3 @@ func main() {
 	}
 	wg.Wait()
 }
-
-func getRedisPool(addr string) *redis.Pool {
-	return &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
-	}
-}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/derry6/gleafd/config"
+	"github.com/derry6/gleafd/server/segment"
+)
+
+const (
+	migrateUsage = "Usage: gleafd migrate up|down|status [--force-data-loss] [flags]"
+	// down删除有数据的表
+	forceDataLossFlag = "--force-data-loss"
+)
+
+// gleafd migrate up|down|status, flags与启动服务时相同
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	var (
+		force bool
+		flags []string
+	)
+	for _, arg := range args[1:] {
+		if arg == forceDataLossFlag {
+			force = true
+			continue
+		}
+		flags = append(flags, arg)
+	}
+	cfg, err := config.Load(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can not load config: %v\n", err)
+		return 1
+	}
+	db := sql.OpenDB(newMySQLConnector(cfg.Segment))
+	defer db.Close()
+
+	ctx := context.Background()
+	m := segment.NewMigrator(db)
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx)
+		for _, mig := range done {
+			fmt.Printf("Applied %d %s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migrate up: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Schema version %d\n", m.Latest())
+	case "down":
+		mig, err := m.Down(ctx, force)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migrate down: %v\n", err)
+			return 1
+		}
+		if mig == nil {
+			fmt.Println("No migration to revert")
+			break
+		}
+		fmt.Printf("Reverted %d %s\n", mig.Version, mig.Name)
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Migrate status: %v\n", err)
+			return 1
+		}
+		for _, s := range status {
+			applied := "pending"
+			if !s.Applied.IsZero() {
+				applied = s.Applied.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-32s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync/atomic"
+
+	"github.com/derry6/gleafd/config"
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlConnector 每次建立连接时使用最新的密码, 密钥文件更新后新连接会自动生效
+type mysqlConnector struct {
+	cfg  config.SegmentConfig
+	pass atomic.Value
+}
+
+func newMySQLConnector(cfg config.SegmentConfig) *mysqlConnector {
+	c := &mysqlConnector{cfg: cfg}
+	c.pass.Store(cfg.DBPass)
+	return c
+}
+
+func (c *mysqlConnector) SetPassword(pass string) {
+	c.pass.Store(pass)
+}
+
+func (c *mysqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	cfg := c.cfg
+	cfg.DBPass = c.pass.Load().(string)
+	return c.Driver().Open(cfg.DBUrl())
+}
+
+func (c *mysqlConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
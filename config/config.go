@@ -2,6 +2,11 @@ package config
 
 import (
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const (
@@ -14,25 +19,270 @@ type SegmentConfig struct {
 	DBName string `yaml:"db_name"`
 	DBUser string `yaml:"db_user"`
 	DBPass string `yaml:"db_pass"`
+	// 从文件中读取db_pass, 避免在配置文件或者命令行中出现明文密码
+	DBPassFile string `yaml:"db_pass_file"`
+	// 按周期重置序列号的biztags, key为biztag
+	Periods map[string]SegmentPeriodConfig `yaml:"periods"`
+	// 每次访问数据库的超时时间, 连接断开, 超时和死锁时最多重试retries次, 重试间隔从retry_backoff开始加倍
+	CallTimeout  time.Duration `yaml:"call_timeout"`
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// 连续breaker_failures次连接断开或者超时之后, breaker_cooldown内不再访问数据库, 0表示不使用
+	BreakerFailures int           `yaml:"breaker_failures"`
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+	// 下一个号段还没有获取到并且剩余的ID少于step*low_water时告警
+	LowWater float64 `yaml:"low_water"`
+	// 降级模式为每个biztag预留的ID数量, 数据库不可用时使用, 0表示不预留
+	EmergencySize int32 `yaml:"emergency_size"`
+	// 多个数据中心各自使用独立的segments表时划分ID空间, regions中的biztag优先于region
+	Region  SegmentRegionConfig            `yaml:"region"`
+	Regions map[string]SegmentRegionConfig `yaml:"regions"`
+	// 本地保存每个biztag已经发放的最大max_id, 为空则不保存。主从切换丢失已经提交的更新时,
+	// 数据库返回的号段低于本地记录, floor_policy为skip时将max_id推进到本地记录之后, reject时返回错误
+	FloorFile   string `yaml:"floor_file"`
+	FloorPolicy string `yaml:"floor_policy"`
+	// 启动时表结构版本不一致则退出, auto_migrate为true时先执行gleafd migrate up
+	SchemaCheck bool `yaml:"schema_check"`
+	AutoMigrate bool `yaml:"auto_migrate"`
+	// biztag变更的通知方式, redis使用snowflake的redis配置, 为空时只每隔poll_interval全量更新
+	Notifier     string        `yaml:"notifier"`
+	PollInterval time.Duration `yaml:"poll_interval"`
 }
 
+// DBUrl 密码等字段可以包含@/?等字符, 由FormatDSN转义
 func (c *SegmentConfig) DBUrl() string {
-	return fmt.Sprintf(
-		"%s:%s@tcp(%s)/%s?charset=utf8&parseTime=true",
-		c.DBUser, c.DBPass, c.DBHost, c.DBName)
+	cfg := mysql.NewConfig()
+	cfg.User = c.DBUser
+	cfg.Passwd = c.DBPass
+	cfg.Net = "tcp"
+	cfg.Addr = c.DBHost
+	cfg.DBName = c.DBName
+	cfg.ParseTime = true
+	cfg.Params = map[string]string{"charset": "utf8"}
+	return cfg.FormatDSN()
+}
+
+// 加载*_file中的密钥
+func (c *SegmentConfig) loadSecrets() error {
+	if c.DBPassFile == "" {
+		return nil
+	}
+	pass, err := ReadSecretFile(c.DBPassFile)
+	if err != nil {
+		return fmt.Errorf("read segment db_pass_file: %v", err)
+	}
+	c.DBPass = pass
+	return nil
 }
 
 type SnowflakeConfig struct {
-	Enable        bool   `yaml:"enable"`
+	Enable bool `yaml:"enable"`
+	// ID的位分布 default|sonyflake, 修改之后已有的节点拒绝启动
+	Layout string `yaml:"layout"`
+	// standalone|sentinel|cluster
+	RedisMode string `yaml:"redis_mode"`
+	// 多个地址使用逗号分隔, sentinel模式下为sentinel的地址, cluster模式下为种子节点
 	RedisAddresss string `yaml:"redis_addr"`
+	// sentinel中master的名称
+	RedisMaster   string `yaml:"redis_master"`
+	RedisPass     string `yaml:"redis_pass"`
+	RedisPassFile string `yaml:"redis_pass_file"`
+	// 本地保存发放ID的时间戳租约, 为空则不保存
+	CheckpointFile string `yaml:"checkpoint_file"`
+	// 启动时系统时间落后于最后发放ID的时间戳时, 最多等待的时间
+	MaxStartupWait time.Duration `yaml:"max_startup_wait"`
+	// 与其它节点平均时间的最大偏差, 超过时拒绝服务, 0表示不检查
+	ClockSkewThreshold time.Duration `yaml:"clock_skew_threshold"`
+	ClockSkewInterval  time.Duration `yaml:"clock_skew_interval"`
+	// 时钟回拨的处理策略 fail|wait|borrow, 回拨超过clock_rollback_max时返回错误, borrow需要checkpoint_file
+	ClockRollback    string        `yaml:"clock_rollback"`
+	ClockRollbackMax time.Duration `yaml:"clock_rollback_max"`
+	// 序列号分片数量(2的幂), 大于1时多个请求可以并发生成ID
+	Shards int `yaml:"shards"`
+	// 每个biztag使用单独的序列号, 超过biztag_idle没有使用时回收。
+	// 序列号的高biztag_bits位为biztag的hash, per_biztag为true时必须大于0
+	PerBizTag  bool          `yaml:"per_biztag"`
+	BizTagIdle time.Duration `yaml:"biztag_idle"`
+	BizTagBits uint          `yaml:"biztag_bits"`
+}
+
+func (c *SnowflakeConfig) RedisAddrs() (addrs []string) {
+	for _, addr := range strings.Split(c.RedisAddresss, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (c *SnowflakeConfig) loadSecrets() error {
+	if c.RedisPassFile == "" {
+		return nil
+	}
+	pass, err := ReadSecretFile(c.RedisPassFile)
+	if err != nil {
+		return fmt.Errorf("read snowflake redis_pass_file: %v", err)
+	}
+	c.RedisPass = pass
+	return nil
+}
+
+// AdminConfig 管理接口需要请求头Authorization: Bearer <token>, 没有token时管理接口返回403
+type AdminConfig struct {
+	// 从文件中读取token, 文件变化时自动重新加载
+	TokenFile string `yaml:"token_file"`
+	Token     string `yaml:"-"`
+}
+
+func (c *AdminConfig) loadSecrets() error {
+	if c.TokenFile == "" {
+		return nil
+	}
+	token, err := ReadSecretFile(c.TokenFile)
+	if err != nil {
+		return fmt.Errorf("read admin token_file: %v", err)
+	}
+	c.Token = token
+	return nil
+}
+
+// UUIDConfig UUIDv7和ULID不依赖外部存储, 时钟回拨的处理与snowflake相同
+type UUIDConfig struct {
+	Enable bool `yaml:"enable"`
+}
+
+// IdempotencyConfig 带有Idempotency-Key的segment和snowflake请求在ttl内重试时返回相同的ID
+type IdempotencyConfig struct {
+	Enable bool          `yaml:"enable"`
+	TTL    time.Duration `yaml:"ttl"`
+	// memory|redis, redis使用snowflake的redis配置, 在多个节点之间共享
+	Store string `yaml:"store"`
+	// memory最多保存的结果数量
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// LimitsConfig 每次请求最多获取的ID数量, 优先使用biztags的配置, 其次是endpoints, 都没有时使用max_count
+type LimitsConfig struct {
+	MaxCount int `yaml:"max_count"`
+	// segments|ranges|obfuscated|snowflakes|uuids|ulids|codes, ranges为租用号段的size
+	Endpoints map[string]int `yaml:"endpoints"`
+	BizTags   map[string]int `yaml:"biztags"`
+}
+
+// RateLimitRule 每秒的请求数和ID数量, 0表示不限制, burst为0时等于每秒的数量
+type RateLimitRule struct {
+	Requests      float64 `yaml:"requests"`
+	RequestsBurst int     `yaml:"requests_burst"`
+	IDs           float64 `yaml:"ids"`
+	IDsBurst      int     `yaml:"ids_burst"`
+}
+
+// RateLimitConfig 按客户端(可信代理的X-Client-Id或者请求地址)和biztag限流
+type RateLimitConfig struct {
+	Enable bool `yaml:"enable"`
+	// memory|redis, redis使用snowflake的redis配置, 在多个节点之间共享限制
+	Store string `yaml:"store"`
+	// memory最多保存的令牌桶数量, 超过时删除最久没有使用的令牌桶
+	MaxKeys int           `yaml:"max_keys"`
+	Client  RateLimitRule `yaml:"client"`
+	BizTag  RateLimitRule `yaml:"biztag"`
+	// 单独设置的biztag, 优先于biztag
+	BizTags map[string]RateLimitRule `yaml:"biztags"`
+}
+
+// TracingConfig 通过OTLP/HTTP导出trace, 请求头中的W3C traceparent会作为父span
+type TracingConfig struct {
+	Enable bool `yaml:"enable"`
+	// OTLP/HTTP collector的地址host:port
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+	// 没有父span时的采样比例0-1
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// SegmentPeriodConfig biztag的序列号在每个周期开始时从1重新开始
+type SegmentPeriodConfig struct {
+	// daily|monthly|yearly
+	Reset string `yaml:"reset"`
+	// IANA时区, 例如Asia/Shanghai, 为空时使用本地时区
+	Timezone string `yaml:"timezone"`
+}
+
+// SegmentRegionConfig 每个数据中心分配的ID互不重叠, mode为空时不划分。
+// interleave: 序列号按block分块, 第k块映射到(k*stride+offset)*block, 每个数据中心使用不同的offset,
+// block不能小于号段的最大step(1000000)和租用号段的最大size;
+// prefix: ID的高位为prefix, 低prefix_bits位为序列号
+type SegmentRegionConfig struct {
+	Mode       string `yaml:"mode"`
+	Offset     int64  `yaml:"offset"`
+	Stride     int64  `yaml:"stride"`
+	Block      int64  `yaml:"block"`
+	Prefix     int64  `yaml:"prefix"`
+	PrefixBits uint   `yaml:"prefix_bits"`
+}
+
+// CodeConfig 业务编码模板, 序列号来自相同biztag的segment
+type CodeConfig struct {
+	// 例如"ORD-{yyyy}{MM}{dd}-{seq:6}"
+	Format string `yaml:"format"`
+	// 序列号的重置周期: none|daily|monthly|yearly, format中必须包含周期的日期
+	Reset string `yaml:"reset"`
+	// 日期和重置周期使用的时区, 为空时使用本地时区
+	Timezone string `yaml:"timezone"`
+}
+
+// ObfuscateConfig 使用带密钥的Feistel网络将segment ID映射为不可猜测的ID
+type ObfuscateConfig struct {
+	// int|base62
+	Format string `yaml:"format"`
+	// base62使用的字符表, 为空时使用0-9A-Za-z
+	Alphabet string `yaml:"alphabet"`
+	// 生成新ID使用的密钥版本(0-7)
+	Version int `yaml:"version"`
+	// 所有版本的密钥, 轮换后需要保留旧的密钥用于解码
+	Keys     map[int]string `yaml:"keys"`
+	KeyFiles map[int]string `yaml:"key_files"`
+}
+
+// 加载key_files中的密钥
+func (c *ObfuscateConfig) loadSecrets() error {
+	if len(c.KeyFiles) == 0 {
+		return nil
+	}
+	keys := make(map[int]string)
+	for v, key := range c.Keys {
+		keys[v] = key
+	}
+	for v, fileName := range c.KeyFiles {
+		key, err := ReadSecretFile(fileName)
+		if err != nil {
+			return fmt.Errorf("read obfuscate key_files[%d]: %v", v, err)
+		}
+		keys[v] = key
+	}
+	c.Keys = keys
+	return nil
 }
 
 type Config struct {
 	Name      string          `yaml:"name"`
 	Addr      string          `yaml:"addr"`
 	Log       string          `yaml:"log"`
+	Admin     AdminConfig     `yaml:"admin"`
 	Segment   SegmentConfig   `yaml:"segment"`
 	Snowflake SnowflakeConfig `yaml:"snowflake"`
+	UUID      UUIDConfig      `yaml:"uuid"`
+	// 幂等请求
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	RateLimit   RateLimitConfig   `yaml:"ratelimit"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	// key为biztag
+	Codes     map[string]CodeConfig      `yaml:"codes"`
+	Obfuscate map[string]ObfuscateConfig `yaml:"obfuscate"`
+
+	// 只有来自这些地址(IP或者CIDR)的请求才使用X-Client-Id请求头作为客户端标识, 否则使用请求地址
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 func newConfig() *Config {
@@ -46,10 +296,96 @@ func newConfig() *Config {
 			DBName: "gleafd",
 			DBUser: "gleafd",
 			DBPass: "123456",
+
+			CallTimeout:  3 * time.Second,
+			Retries:      3,
+			RetryBackoff: 100 * time.Millisecond,
+
+			BreakerFailures: 5,
+			BreakerCooldown: 5 * time.Second,
+			LowWater:        0.1,
+			FloorPolicy:     "skip",
+			SchemaCheck:     true,
+			PollInterval:    time.Minute,
 		},
 		Snowflake: SnowflakeConfig{
-			Enable:        true,
-			RedisAddresss: "127.0.0.1:8379",
+			Enable:             true,
+			Layout:             "default",
+			RedisMode:          "standalone",
+			RedisAddresss:      "127.0.0.1:8379",
+			MaxStartupWait:     5 * time.Second,
+			ClockSkewThreshold: 5 * time.Second,
+			ClockSkewInterval:  time.Minute,
+			ClockRollback:      "wait",
+			ClockRollbackMax:   5 * time.Millisecond,
+			Shards:             1,
+			BizTagIdle:         10 * time.Minute,
+			BizTagBits:         2,
+		},
+		UUID: UUIDConfig{
+			Enable: true,
 		},
+		Idempotency: IdempotencyConfig{
+			Enable:     true,
+			TTL:        10 * time.Minute,
+			Store:      "memory",
+			MaxEntries: 100000,
+		},
+		Limits: LimitsConfig{
+			MaxCount:  10000,
+			Endpoints: map[string]int{"ranges": 10000000},
+		},
+		RateLimit: RateLimitConfig{
+			Store:   "memory",
+			MaxKeys: 100000,
+		},
+		Tracing: TracingConfig{
+			Endpoint:    "localhost:4318",
+			Insecure:    true,
+			SampleRatio: 1,
+		},
+	}
+}
+
+func (c *Config) loadSecrets() error {
+	if err := c.Admin.loadSecrets(); err != nil {
+		return err
+	}
+	if err := c.Segment.loadSecrets(); err != nil {
+		return err
+	}
+	for biztag, obf := range c.Obfuscate {
+		if err := obf.loadSecrets(); err != nil {
+			return fmt.Errorf("%s: %v", biztag, err)
+		}
+		c.Obfuscate[biztag] = obf
+	}
+	return c.Snowflake.loadSecrets()
+}
+
+// Redacted 返回隐藏了密钥的配置副本, 用于日志或者配置输出
+func (c *Config) Redacted() *Config {
+	cfg := *c
+	cfg.Segment.DBPass = redact(cfg.Segment.DBPass)
+	cfg.Snowflake.RedisPass = redact(cfg.Snowflake.RedisPass)
+	if c.Obfuscate != nil {
+		cfg.Obfuscate = make(map[string]ObfuscateConfig)
+		for biztag, obf := range c.Obfuscate {
+			keys := make(map[int]string)
+			for v, key := range obf.Keys {
+				keys[v] = redact(key)
+			}
+			obf.Keys = keys
+			cfg.Obfuscate[biztag] = obf
+		}
+	}
+	return &cfg
+}
+
+func (c *Config) String() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
 	}
+	return string(data)
 }
@@ -1,8 +1,13 @@
 package config
 
 import (
+	"io/ioutil"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/go-sql-driver/mysql"
 )
 
 func b2s(v bool) string {
@@ -43,7 +48,7 @@ func TestParseArgs(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if *cfg != *wantCfg {
+	if !reflect.DeepEqual(cfg, wantCfg) {
 		t.Fatalf("cfg = %v, want = %v", cfg, wantCfg)
 	}
 }
@@ -106,3 +111,99 @@ func TestParseFromFile(t *testing.T) {
 		t.Fatalf("name = %v, want = gleafd", opts.Name)
 	}
 }
+
+func TestParseSecretFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "gleafd_db_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString("s3cret\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cfg, err := Load([]string{
+		"--segment-db-pass=ignored",
+		"--segment-db-pass-file=" + f.Name(),
+		"--admin-token-file=" + f.Name(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 密钥文件优先于明文密码
+	if cfg.Segment.DBPass != "s3cret" {
+		t.Fatalf("db pass = %v, want = s3cret", cfg.Segment.DBPass)
+	}
+	if cfg.Admin.Token != "s3cret" {
+		t.Fatalf("admin token = %v, want = s3cret", cfg.Admin.Token)
+	}
+	if strings.Contains(cfg.String(), "s3cret") {
+		t.Fatalf("config dump contains secret: %v", cfg.String())
+	}
+	if cfg.Segment.DBPass != "s3cret" {
+		t.Fatalf("Redacted() modified the config")
+	}
+}
+
+func TestRedactObfuscateKeys(t *testing.T) {
+	f, err := ioutil.TempFile("", "gleafd_obfuscate_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString("key-from-file-v2\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cfg := newConfig()
+	cfg.Obfuscate = map[string]ObfuscateConfig{
+		"orders": {
+			Version:  2,
+			Keys:     map[int]string{1: "key-inline-v1"},
+			KeyFiles: map[int]string{2: f.Name()},
+		},
+	}
+	if err = cfg.loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	keys := cfg.Obfuscate["orders"].Keys
+	if keys[1] != "key-inline-v1" || keys[2] != "key-from-file-v2" {
+		t.Fatalf("keys = %v", keys)
+	}
+	dump := cfg.String()
+	if strings.Contains(dump, "key-inline-v1") || strings.Contains(dump, "key-from-file-v2") {
+		t.Fatalf("config dump contains secret: %v", dump)
+	}
+	if cfg.Obfuscate["orders"].Keys[1] != "key-inline-v1" {
+		t.Fatalf("Redacted() modified the config")
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"gleafd", "--segment-db-pass=abc", "-segment-db-pass", "def",
+		"--segment-db-pass-file=/run/secrets/pass", "--name=gleafd"}
+	want := []string{"gleafd", "--segment-db-pass=******", "-segment-db-pass", "******",
+		"--segment-db-pass-file=/run/secrets/pass", "--name=gleafd"}
+	got := RedactArgs(args)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("args[%d] = %v, want = %v", i, got[i], want[i])
+		}
+	}
+	if args[1] != "--segment-db-pass=abc" {
+		t.Fatalf("RedactArgs modified the input")
+	}
+}
+
+func TestSegmentDBUrl(t *testing.T) {
+	c := SegmentConfig{DBHost: "127.0.0.1:3306", DBName: "gleafd", DBUser: "gleafd", DBPass: "p@ss/w?rd:1"}
+	cfg, err := mysql.ParseDSN(c.DBUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Passwd != c.DBPass || cfg.Addr != c.DBHost || cfg.DBName != c.DBName || !cfg.ParseTime {
+		t.Fatalf("dsn = %s, parsed = %+v", c.DBUrl(), cfg)
+	}
+}
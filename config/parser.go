@@ -70,9 +70,14 @@ func (p *parser) parse(args []string) error {
 		os.Exit(0)
 	}
 	if p.fileName != "" {
-		return p.parseFromFile(p.fileName)
+		err = p.parseFromFile(p.fileName)
+	} else {
+		err = p.parseFromEnv()
 	}
-	return p.parseFromEnv()
+	if err != nil {
+		return err
+	}
+	return p.Cfg.loadSecrets()
 }
 
 func Load(args []string) (*Config, error) {
@@ -89,6 +94,7 @@ func Load(args []string) (*Config, error) {
 	flagSet.StringVar(&p.Cfg.Name, "name", p.Cfg.Name, "Assign a name to the server")
 	flagSet.StringVar(&p.Cfg.Addr, "addr", p.Cfg.Addr, "Listen address")
 	flagSet.StringVar(&p.Cfg.Log, "log", p.Cfg.Log, "Log level [debug|info|warn|error|fatal]")
+	flagSet.StringVar(&p.Cfg.Admin.TokenFile, "admin-token-file", p.Cfg.Admin.TokenFile, "Read the admin api token from file")
 
 	// Segment
 	seg := &p.Cfg.Segment
@@ -96,12 +102,58 @@ func Load(args []string) (*Config, error) {
 	flagSet.StringVar(&seg.DBHost, "segment-db-host", seg.DBHost, "")
 	flagSet.StringVar(&seg.DBName, "segment-db-name", seg.DBName, "")
 	flagSet.StringVar(&seg.DBUser, "segment-db-user", seg.DBUser, "")
-	flagSet.StringVar(&seg.DBPass, "segment-db-pass", seg.DBPass, "")
+	flagSet.StringVar(&seg.DBPass, "segment-db-pass", seg.DBPass, "Deprecated: visible in ps, use --segment-db-pass-file")
+	flagSet.StringVar(&seg.DBPassFile, "segment-db-pass-file", seg.DBPassFile, "Read db password from file")
+	flagSet.DurationVar(&seg.CallTimeout, "segment-call-timeout", seg.CallTimeout, "Timeout of each db call")
+	flagSet.IntVar(&seg.Retries, "segment-retries", seg.Retries, "Max retries of transient db errors")
+	flagSet.StringVar(&seg.Notifier, "segment-notifier", seg.Notifier, "Biztag change notifier [redis], empty for polling only")
+	flagSet.BoolVar(&seg.SchemaCheck, "segment-schema-check", seg.SchemaCheck, "Exit on segment schema version mismatch")
+	flagSet.BoolVar(&seg.AutoMigrate, "segment-auto-migrate", seg.AutoMigrate, "Run segment schema migrations on startup")
+	flagSet.StringVar(&seg.FloorFile, "segment-floor-file", seg.FloorFile, "Local file to persist the highest issued max_id")
 
 	// Snowflake
 	sf := &p.Cfg.Snowflake
 	flagSet.BoolVar(&sf.Enable, "snowflake-enable", sf.Enable, "")
-	flagSet.StringVar(&sf.RedisAddresss, "snowflake-redis-addr", sf.RedisAddresss, "")
+	flagSet.StringVar(&sf.Layout, "snowflake-layout", sf.Layout, "ID layout [default|sonyflake]")
+	flagSet.StringVar(&sf.RedisMode, "snowflake-redis-mode", sf.RedisMode, "Redis mode [standalone|sentinel|cluster]")
+	flagSet.StringVar(&sf.RedisAddresss, "snowflake-redis-addr", sf.RedisAddresss, "Comma separated redis addresses")
+	flagSet.StringVar(&sf.RedisMaster, "snowflake-redis-master", sf.RedisMaster, "Sentinel master name")
+	flagSet.StringVar(&sf.RedisPass, "snowflake-redis-pass", sf.RedisPass, "Deprecated: visible in ps, use --snowflake-redis-pass-file")
+	flagSet.StringVar(&sf.RedisPassFile, "snowflake-redis-pass-file", sf.RedisPassFile, "Read redis password from file")
+	flagSet.StringVar(&sf.CheckpointFile, "snowflake-checkpoint-file", sf.CheckpointFile, "Local file to persist the last issued timestamp")
+	flagSet.DurationVar(&sf.MaxStartupWait, "snowflake-max-startup-wait", sf.MaxStartupWait, "Max wait for the clock to pass the last issued timestamp")
+	flagSet.DurationVar(&sf.ClockSkewThreshold, "snowflake-clock-skew-threshold", sf.ClockSkewThreshold, "Max clock skew against other nodes, 0 to disable")
+	flagSet.DurationVar(&sf.ClockSkewInterval, "snowflake-clock-skew-interval", sf.ClockSkewInterval, "Interval of clock skew checks")
+	flagSet.StringVar(&sf.ClockRollback, "snowflake-clock-rollback", sf.ClockRollback, "Clock rollback policy [fail|wait|borrow]")
+	flagSet.DurationVar(&sf.ClockRollbackMax, "snowflake-clock-rollback-max", sf.ClockRollbackMax, "Max clock rollback handled by the policy")
+	flagSet.IntVar(&sf.Shards, "snowflake-shards", sf.Shards, "Number of sequence shards, must be a power of 2")
+	flagSet.BoolVar(&sf.PerBizTag, "snowflake-per-biztag", sf.PerBizTag, "Use a separate sequence for each biztag")
+	flagSet.DurationVar(&sf.BizTagIdle, "snowflake-biztag-idle", sf.BizTagIdle, "Evict the sequence of a biztag after being idle")
+	flagSet.UintVar(&sf.BizTagBits, "snowflake-biztag-bits", sf.BizTagBits, "Bits of the biztag hash embedded in the sequence")
+
+	// UUID
+	flagSet.BoolVar(&p.Cfg.UUID.Enable, "uuid-enable", p.Cfg.UUID.Enable, "Enable UUIDv7 and ULID")
+
+	// Idempotency
+	idem := &p.Cfg.Idempotency
+	flagSet.BoolVar(&idem.Enable, "idempotency-enable", idem.Enable, "Return the same ids for requests with the same Idempotency-Key")
+	flagSet.DurationVar(&idem.TTL, "idempotency-ttl", idem.TTL, "How long idempotent results are kept")
+	flagSet.StringVar(&idem.Store, "idempotency-store", idem.Store, "Idempotent result store [memory|redis]")
+	flagSet.IntVar(&idem.MaxEntries, "idempotency-max-entries", idem.MaxEntries, "Max results kept in memory")
+
+	// Limits
+	flagSet.IntVar(&p.Cfg.Limits.MaxCount, "max-count", p.Cfg.Limits.MaxCount, "Max ids per request")
+
+	// Rate limit
+	rl := &p.Cfg.RateLimit
+	flagSet.BoolVar(&rl.Enable, "ratelimit-enable", rl.Enable, "Rate limit requests and ids per client and biztag")
+	flagSet.StringVar(&rl.Store, "ratelimit-store", rl.Store, "Token bucket store [memory|redis]")
+
+	// Tracing
+	tr := &p.Cfg.Tracing
+	flagSet.BoolVar(&tr.Enable, "tracing-enable", tr.Enable, "Export traces with OTLP/HTTP")
+	flagSet.StringVar(&tr.Endpoint, "tracing-endpoint", tr.Endpoint, "OTLP/HTTP collector address")
+	flagSet.Float64Var(&tr.SampleRatio, "tracing-sample-ratio", tr.SampleRatio, "Sample ratio of root spans")
 
 	if err := p.parse(args); err != nil {
 		return nil, err
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redactedSecret = "******"
+
+// 包含密钥的命令行参数
+var secretFlags = []string{
+	"segment-db-pass",
+	"snowflake-redis-pass",
+}
+
+// ReadSecretFile 读取密钥文件(例如kubernetes secret), 去掉首尾的空白字符
+func ReadSecretFile(fileName string) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SecretWatcher 定期读取密钥文件, 内容变化时回调
+type SecretWatcher struct {
+	fileName string
+	secret   string
+	onChange func(secret string, err error)
+	closeC   chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+func (w *SecretWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.closeC:
+			return
+		case <-ticker.C:
+			secret, err := ReadSecretFile(w.fileName)
+			if err != nil {
+				w.onChange("", err)
+				continue
+			}
+			if secret != w.secret {
+				w.secret = secret
+				w.onChange(secret, nil)
+			}
+		}
+	}
+}
+
+func (w *SecretWatcher) Close() error {
+	w.once.Do(func() {
+		close(w.closeC)
+		w.wg.Wait()
+	})
+	return nil
+}
+
+// WatchSecretFile 监听密钥文件的变化, secret为当前已加载的内容。
+// kubernetes更新secret时会替换软链接, 所以这里直接比较文件内容。
+func WatchSecretFile(fileName, secret string, interval time.Duration,
+	onChange func(secret string, err error)) *SecretWatcher {
+	w := &SecretWatcher{
+		fileName: fileName,
+		secret:   secret,
+		onChange: onChange,
+		closeC:   make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run(interval)
+	}()
+	return w
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+// RedactArgs 隐藏命令行参数中的密钥, 用于/debug/pprof/cmdline等输出
+func RedactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted); i++ {
+		name := strings.TrimLeft(redacted[i], "-")
+		if name == redacted[i] {
+			continue
+		}
+		for _, f := range secretFlags {
+			if strings.HasPrefix(name, f+"=") {
+				redacted[i] = strings.TrimSuffix(redacted[i], name) + f + "=" + redactedSecret
+				break
+			}
+			if name == f && i+1 < len(redacted) {
+				i++
+				redacted[i] = redactedSecret
+				break
+			}
+		}
+	}
+	return redacted
+}
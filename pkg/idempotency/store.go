@@ -0,0 +1,131 @@
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Store 保存幂等请求的结果
+type Store interface {
+	// Get 返回key对应的结果, 不存在或者已经过期时返回nil
+	Get(ctx context.Context, key string) ([]byte, error)
+	// SetNX key不存在时保存value并返回value, 否则返回已经保存的结果
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error)
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// MemoryStore 本地内存中的LRU, 最多保存maxEntries个结果
+type MemoryStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// 调用者需要持有锁
+func (s *MemoryStore) lookup(key string) *entry {
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		s.ll.Remove(el)
+		delete(s.items, key)
+		return nil
+	}
+	s.ll.MoveToFront(el)
+	return e
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.lookup(key); e != nil {
+		return e.value, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.lookup(key); e != nil {
+		return e.value, nil
+	}
+	s.items[key] = s.ll.PushFront(&entry{key: key, value: value, expires: time.Now().Add(ttl)})
+	for s.maxEntries > 0 && s.ll.Len() > s.maxEntries {
+		el := s.ll.Back()
+		s.ll.Remove(el)
+		delete(s.items, el.Value.(*entry).key)
+	}
+	return value, nil
+}
+
+// Len 返回当前保存的结果数量(包括已经过期但是还没有清理的)
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+// RedisStore 多个节点共享的结果, 第一个保存的结果生效
+type RedisStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisStore prefix为key的前缀, cluster模式下需要包含连接池使用的hash tag
+func NewRedisStore(pool *redis.Pool, prefix string) *RedisStore {
+	return &RedisStore{pool: pool, prefix: prefix}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	value, err := redis.Bytes(conn.Do("GET", s.prefix+key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *RedisStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		ms = 1
+	}
+	_, err := redis.String(conn.Do("SET", s.prefix+key, value, "PX", ms, "NX"))
+	if err == nil {
+		return value, nil
+	}
+	if err != redis.ErrNil {
+		return nil, err
+	}
+	// 其它节点已经保存了结果
+	actual, err := redis.Bytes(conn.Do("GET", s.prefix+key))
+	if err == redis.ErrNil {
+		// 刚好过期
+		return value, nil
+	}
+	return actual, err
+}
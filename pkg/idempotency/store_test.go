@@ -0,0 +1,44 @@
+package idempotency
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore(2)
+
+	if v, err := s.Get(ctx, "a"); err != nil || v != nil {
+		t.Fatalf("get = %s, %v, want = nil", v, err)
+	}
+	if v, _ := s.SetNX(ctx, "a", []byte("1"), time.Minute); string(v) != "1" {
+		t.Errorf("setnx = %s, want = 1", v)
+	}
+	// 已经存在时返回第一次保存的结果
+	if v, _ := s.SetNX(ctx, "a", []byte("2"), time.Minute); string(v) != "1" {
+		t.Errorf("setnx = %s, want = 1", v)
+	}
+	s.SetNX(ctx, "b", []byte("b"), time.Minute)
+	s.Get(ctx, "a") // a最近使用过, 淘汰b
+	s.SetNX(ctx, "c", []byte("c"), time.Minute)
+	if s.Len() != 2 {
+		t.Errorf("len = %d, want = 2", s.Len())
+	}
+	if v, _ := s.Get(ctx, "b"); v != nil {
+		t.Errorf("b must be evicted")
+	}
+	if v, _ := s.Get(ctx, "a"); string(v) != "1" {
+		t.Errorf("get a = %s, want = 1", v)
+	}
+
+	s.SetNX(ctx, "d", []byte("d"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if v, _ := s.Get(ctx, "d"); v != nil {
+		t.Errorf("d must be expired")
+	}
+	if v, _ := s.SetNX(ctx, "d", []byte("d2"), time.Minute); string(v) != "d2" {
+		t.Errorf("setnx = %s, want = d2", v)
+	}
+}
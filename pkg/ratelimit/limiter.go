@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Limit 令牌桶的配置, 每秒补充Rate个令牌, 最多保存Burst个令牌。
+// Rate为0时不限制, Burst为0时等于Rate
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Max(1, math.Ceil(l.Rate)))
+}
+
+// ErrExceedsBurst n大于Burst, 等待多久都无法取出
+var ErrExceedsBurst = errors.New("ratelimit: n exceeds burst")
+
+// Limiter 令牌桶限流
+type Limiter interface {
+	// Take 从key对应的令牌桶中取出n个令牌。
+	// 令牌不足时不取出任何令牌, 返回需要等待的时间。n大于Burst时返回ErrExceedsBurst
+	Take(ctx context.Context, key string, limit Limit, n int) (retryAfter time.Duration, err error)
+}
+
+func waitFor(tokens, n, rate float64) time.Duration {
+	return time.Duration(math.Ceil((n - tokens) / rate * float64(time.Second)))
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// MemoryLimiter 令牌桶保存在本地内存中, 只限制单个节点
+type MemoryLimiter struct {
+	mu sync.Mutex
+	// 超过maxKeys时删除最久没有使用的令牌桶
+	maxKeys int
+	ll      *list.List
+	buckets map[string]*list.Element
+}
+
+func NewMemoryLimiter(maxKeys int) *MemoryLimiter {
+	return &MemoryLimiter{maxKeys: maxKeys, ll: list.New(), buckets: make(map[string]*list.Element)}
+}
+
+func (l *MemoryLimiter) Take(ctx context.Context, key string, limit Limit, n int) (time.Duration, error) {
+	if limit.Rate <= 0 {
+		return 0, nil
+	}
+	if n > limit.burst() {
+		return 0, ErrExceedsBurst
+	}
+	now := time.Now()
+	need := float64(n)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b *bucket
+	if el, ok := l.buckets[key]; ok {
+		l.ll.MoveToFront(el)
+		b = el.Value.(*bucket)
+	} else {
+		b = &bucket{key: key, tokens: float64(limit.burst()), last: now}
+		l.buckets[key] = l.ll.PushFront(b)
+		for l.maxKeys > 0 && l.ll.Len() > l.maxKeys {
+			el := l.ll.Back()
+			l.ll.Remove(el)
+			delete(l.buckets, el.Value.(*bucket).key)
+		}
+	}
+	b.tokens = math.Min(float64(limit.burst()), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < need {
+		return waitFor(b.tokens, need, limit.Rate), nil
+	}
+	b.tokens -= need
+	return 0, nil
+}
+
+// Len 返回当前令牌桶的数量
+func (l *MemoryLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ll.Len()
+}
+
+// KEYS[1]: 令牌桶, ARGV: rate, burst, n, now(毫秒)
+// 返回需要等待的毫秒数, 0表示已经取出令牌
+var takeScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local b = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+if now > last then
+	tokens = math.min(burst, tokens + (now - last) * rate / 1000)
+	last = now
+end
+local wait = 0
+if tokens < n then
+	wait = math.ceil((n - tokens) * 1000 / rate)
+else
+	tokens = tokens - n
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(last))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return wait
+`)
+
+// RedisLimiter 令牌桶保存在redis中, 多个节点共享限制。
+// 使用各节点的本地时间计算补充的令牌, 节点之间的时钟偏差会影响精度
+type RedisLimiter struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+func NewRedisLimiter(pool *redis.Pool, prefix string) *RedisLimiter {
+	return &RedisLimiter{pool: pool, prefix: prefix}
+}
+
+func (l *RedisLimiter) Take(ctx context.Context, key string, limit Limit, n int) (time.Duration, error) {
+	if limit.Rate <= 0 {
+		return 0, nil
+	}
+	if n > limit.burst() {
+		return 0, ErrExceedsBurst
+	}
+	conn := l.pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	wait, err := redis.Int64(takeScript.Do(conn, l.prefix+key, limit.Rate, limit.burst(), n, now))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
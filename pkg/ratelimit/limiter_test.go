@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	l := NewMemoryLimiter(100)
+	ctx := context.Background()
+	limit := Limit{Rate: 10, Burst: 5}
+
+	for i := 0; i < 5; i++ {
+		if wait, _ := l.Take(ctx, "a", limit, 1); wait != 0 {
+			t.Fatalf("take %d: wait = %v, want = 0", i, wait)
+		}
+	}
+	wait, _ := l.Take(ctx, "a", limit, 1)
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("wait = %v, want (0, 100ms]", wait)
+	}
+	// 不同的key使用不同的令牌桶
+	if wait, _ := l.Take(ctx, "b", limit, 5); wait != 0 {
+		t.Fatalf("wait = %v, want = 0", wait)
+	}
+	time.Sleep(wait)
+	if wait, _ := l.Take(ctx, "a", limit, 1); wait != 0 {
+		t.Fatalf("wait = %v after refill, want = 0", wait)
+	}
+	// 超过burst时无法取出
+	if _, err := l.Take(ctx, "c", limit, 6); err != ErrExceedsBurst {
+		t.Fatalf("err = %v, want = %v", err, ErrExceedsBurst)
+	}
+	// 取出全部n个令牌
+	if wait, _ := l.Take(ctx, "c", limit, 5); wait != 0 {
+		t.Fatalf("wait = %v, want = 0", wait)
+	}
+	if wait, _ := l.Take(ctx, "c", limit, 5); wait < 400*time.Millisecond {
+		t.Fatalf("wait = %v, want >= 400ms", wait)
+	}
+	// 不限制
+	if wait, _ := l.Take(ctx, "d", Limit{}, 1000000); wait != 0 {
+		t.Fatalf("wait = %v, want = 0", wait)
+	}
+}
+
+func TestMemoryLimiterEvict(t *testing.T) {
+	l := NewMemoryLimiter(10)
+	ctx := context.Background()
+	// 令牌桶没有补满时也不能超过maxKeys
+	limit := Limit{Rate: 0.001, Burst: 1}
+	for i := 0; i < 100; i++ {
+		l.Take(ctx, fmt.Sprintf("key%d", i), limit, 1)
+		// key0一直在使用, 不会被删除
+		if wait, _ := l.Take(ctx, "key0", limit, 1); i > 0 && wait == 0 {
+			t.Fatalf("key0 evicted at %d", i)
+		}
+	}
+	if n := l.Len(); n != 10 {
+		t.Fatalf("len = %d, want = 10", n)
+	}
+}
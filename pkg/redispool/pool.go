@@ -0,0 +1,242 @@
+package redispool
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	ModeStandalone = "standalone"
+	ModeSentinel   = "sentinel"
+	ModeCluster    = "cluster"
+)
+
+var (
+	ErrNoAddrs        = errors.New("redis: no address")
+	ErrNoMasterName   = errors.New("redis: sentinel master name required")
+	ErrMasterNotFound = errors.New("redis: master not found")
+	ErrSlotNotServed  = errors.New("redis: slot not served by any node")
+)
+
+type Options struct {
+	Mode  string   // standalone|sentinel|cluster
+	Addrs []string // standalone的地址, sentinel地址列表或者cluster种子节点列表
+	// sentinel中master的名称
+	MasterName string
+	// cluster模式下所有key都使用相同的hash tag, 连接只需要指向这个slot所在的master
+	HashTag string
+	// 每次建立连接时调用, 支持密码文件更新后重新加载
+	Password    func() string
+	MaxIdle     int
+	IdleTimeout time.Duration
+	DialTimeout time.Duration
+}
+
+// New 根据模式创建连接池。
+// sentinel和cluster模式下每次建立连接都重新查找master, 当连接收到
+// READONLY/MOVED等错误时会被连接池丢弃, 从而在主从切换后自动连接到新的master。
+func New(opts Options) (*redis.Pool, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, ErrNoAddrs
+	}
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = 3
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 240 * time.Second
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 3 * time.Second
+	}
+	var dial func() (redis.Conn, error)
+	switch opts.Mode {
+	case "", ModeStandalone:
+		dial = func() (redis.Conn, error) { return dialAddr(opts, opts.Addrs[0]) }
+	case ModeSentinel:
+		if opts.MasterName == "" {
+			return nil, ErrNoMasterName
+		}
+		dial = func() (redis.Conn, error) {
+			addr, err := sentinelMaster(opts)
+			if err != nil {
+				return nil, err
+			}
+			return dialMaster(opts, addr)
+		}
+	case ModeCluster:
+		slot := KeySlot(opts.HashTag)
+		dial = func() (redis.Conn, error) {
+			addr, err := clusterSlotMaster(opts, slot)
+			if err != nil {
+				return nil, err
+			}
+			return dialMaster(opts, addr)
+		}
+	default:
+		return nil, fmt.Errorf("redis: unknown mode %q", opts.Mode)
+	}
+	return &redis.Pool{
+		MaxIdle:     opts.MaxIdle,
+		IdleTimeout: opts.IdleTimeout,
+		Dial:        dial,
+	}, nil
+}
+
+func dialAddr(opts Options, addr string) (redis.Conn, error) {
+	dialOpts := []redis.DialOption{
+		redis.DialConnectTimeout(opts.DialTimeout),
+	}
+	if opts.Password != nil {
+		if pass := opts.Password(); pass != "" {
+			dialOpts = append(dialOpts, redis.DialPassword(pass))
+		}
+	}
+	return redis.Dial("tcp", addr, dialOpts...)
+}
+
+func dialMaster(opts Options, addr string) (redis.Conn, error) {
+	c, err := dialAddr(opts, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &masterConn{Conn: c}, nil
+}
+
+// 通过sentinel查找master的地址
+func sentinelMaster(opts Options) (addr string, err error) {
+	for _, sentinel := range opts.Addrs {
+		var c redis.Conn
+		c, err = redis.Dial("tcp", sentinel, redis.DialConnectTimeout(opts.DialTimeout))
+		if err != nil {
+			continue
+		}
+		var parts []string
+		parts, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", opts.MasterName))
+		c.Close()
+		if err != nil {
+			continue
+		}
+		if len(parts) != 2 {
+			err = ErrMasterNotFound
+			continue
+		}
+		return parts[0] + ":" + parts[1], nil
+	}
+	if err == nil || err == redis.ErrNil {
+		err = ErrMasterNotFound
+	}
+	return "", err
+}
+
+// 通过CLUSTER SLOTS查找slot所在的master
+func clusterSlotMaster(opts Options, slot int) (addr string, err error) {
+	for _, node := range opts.Addrs {
+		var c redis.Conn
+		c, err = dialAddr(opts, node)
+		if err != nil {
+			continue
+		}
+		var ranges []interface{}
+		ranges, err = redis.Values(c.Do("CLUSTER", "SLOTS"))
+		c.Close()
+		if err != nil {
+			continue
+		}
+		for _, r := range ranges {
+			// [start, end, [ip, port, id], replicas...]
+			vals, e := redis.Values(r, nil)
+			if e != nil || len(vals) < 3 {
+				continue
+			}
+			start, _ := redis.Int(vals[0], nil)
+			end, _ := redis.Int(vals[1], nil)
+			if slot < start || slot > end {
+				continue
+			}
+			master, e := redis.Values(vals[2], nil)
+			if e != nil || len(master) < 2 {
+				continue
+			}
+			ip, _ := redis.String(master[0], nil)
+			port, _ := redis.Int(master[1], nil)
+			if ip == "" {
+				// 节点使用发送请求时的地址
+				ip = strings.Split(node, ":")[0]
+			}
+			return fmt.Sprintf("%s:%d", ip, port), nil
+		}
+		err = ErrSlotNotServed
+	}
+	return "", err
+}
+
+// masterConn 遇到主从切换或者slot迁移的错误时标记连接不可用,
+// 连接池会丢弃该连接, 下次建立连接时重新查找master
+type masterConn struct {
+	redis.Conn
+	err error
+}
+
+func (c *masterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.Conn.Err()
+}
+
+func (c *masterConn) check(err error) {
+	if err == nil {
+		return
+	}
+	if rerr, ok := err.(redis.Error); ok {
+		msg := string(rerr)
+		for _, prefix := range []string{"READONLY", "MOVED", "ASK", "CLUSTERDOWN", "MASTERDOWN"} {
+			if strings.HasPrefix(msg, prefix) {
+				c.err = err
+				return
+			}
+		}
+	}
+}
+
+func (c *masterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	c.check(err)
+	return reply, err
+}
+
+func (c *masterConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+	return reply, err
+}
+
+// KeySlot 计算key所在的cluster slot, 支持{hash tag}
+func KeySlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key) % 16384)
+}
+
+// CRC16-CCITT (XMODEM)
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,30 @@
+package redispool
+
+import "testing"
+
+func TestKeySlot(t *testing.T) {
+	tests := map[string]int{
+		"123456789":               12739,
+		"{user1000}.following":    KeySlot("user1000"),
+		"{gleafd}/snowflakes/a/b": KeySlot("gleafd"),
+		"{gleafd}_machineid_gen":  KeySlot("gleafd"),
+		"foo{}bar":                KeySlot("foo{}bar"),
+	}
+	for key, want := range tests {
+		if got := KeySlot(key); got != want {
+			t.Errorf("KeySlot(%q) = %d, want = %d", key, got, want)
+		}
+	}
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	if _, err := New(Options{}); err != ErrNoAddrs {
+		t.Errorf("err = %v, want = %v", err, ErrNoAddrs)
+	}
+	if _, err := New(Options{Mode: ModeSentinel, Addrs: []string{"127.0.0.1:26379"}}); err != ErrNoMasterName {
+		t.Errorf("err = %v, want = %v", err, ErrNoMasterName)
+	}
+	if _, err := New(Options{Mode: "unknown", Addrs: []string{"127.0.0.1:6379"}}); err == nil {
+		t.Errorf("unknown mode must be rejected")
+	}
+}
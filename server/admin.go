@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/derry6/gleafd/pkg/ratelimit"
+	"github.com/julienschmidt/httprouter"
+)
+
+// 管理接口按请求地址限流, 同时限制猜测token的速度
+var adminRateLimit = ratelimit.Limit{Rate: 5, Burst: 10}
+
+type handlerOptions struct {
+	adminToken     func() string
+	trustedProxies []*net.IPNet
+}
+
+// HandlerOption NewHttpHandler的选项
+type HandlerOption func(opts *handlerOptions)
+
+// WithAdminToken 管理接口需要请求头Authorization: Bearer <token>, 每次请求时读取, 为空时拒绝所有请求
+func WithAdminToken(token func() string) HandlerOption {
+	return func(opts *handlerOptions) {
+		opts.adminToken = token
+	}
+}
+
+// adminAuth 检查管理接口的token
+type adminAuth struct {
+	token   func() string
+	limiter ratelimit.Limiter
+}
+
+func newAdminAuth(token func() string) *adminAuth {
+	return &adminAuth{token: token, limiter: ratelimit.NewMemoryLimiter(1024)}
+}
+
+func (a *adminAuth) check(r *http.Request) error {
+	token := ""
+	if a.token != nil {
+		token = a.token()
+	}
+	if token == "" {
+		return ErrAdminDisabled
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (a *adminAuth) handle(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		host := remoteHost(r)
+		if wait, err := a.limiter.Take(r.Context(), host, adminRateLimit, 1); err == nil && wait > 0 {
+			encodeHttpError(w, &RateLimitError{Scope: "admin", Key: host, RetryAfter: wait})
+			return
+		}
+		if err := a.check(r); err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		h(w, r, params)
+	}
+}
@@ -0,0 +1,36 @@
+package code
+
+// 计算s中所有数字的Luhn校验位, 忽略非数字字符
+func luhn(s string) byte {
+	sum := 0
+	double := true // 校验位追加在最后, 从右边第一位开始加倍
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return byte((10 - sum%10) % 10)
+}
+
+// 计算s中所有数字的ISO 7064 MOD 97-10校验码(与IBAN相同), 忽略非数字字符
+func mod97(s string) int {
+	r := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		r = (r*10 + int(c-'0')) % 97
+	}
+	return 98 - r*100%97
+}
@@ -0,0 +1,145 @@
+package code
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/segment"
+)
+
+func TestTemplateFormat(t *testing.T) {
+	now := time.Date(2026, 10, 17, 8, 30, 5, 0, time.UTC)
+	tests := []struct {
+		format string
+		seq    int64
+		want   string
+	}{
+		{"ORD-{yyyy}{MM}{dd}-{seq:6}", 123, "ORD-20261017-000123"},
+		{"INV{yy}{MM}{seq}", 42, "INV261042"},
+		{"{HH}{mm}{ss}-{seq:3}", 7, "083005-007"},
+		{"{seq:10}{luhn}", 7992739871, "79927398713"},
+		{"C{seq:4}{mod97}", 1234, "C123482"},
+	}
+	for _, tt := range tests {
+		tmpl, err := Parse(tt.format, "", "UTC")
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.format, err)
+		}
+		got, err := tmpl.Format(now, tt.seq)
+		if err != nil {
+			t.Fatalf("format %q: %v", tt.format, err)
+		}
+		if got != tt.want {
+			t.Errorf("format %q = %s, want = %s", tt.format, got, tt.want)
+		}
+	}
+	tmpl, _ := Parse("{seq:3}", "", "")
+	if _, err := tmpl.Format(now, 1000); err != ErrSeqOverflow {
+		t.Errorf("err = %v, want = %v", err, ErrSeqOverflow)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for _, s := range []string{"0", "18", "4111-1111-1111-111", "20261017000123"} {
+		// 包含校验位后从右边第二位开始加倍, 总和是10的倍数
+		full := s + string('0'+luhn(s))
+		sum, double := 0, false
+		for i := len(full) - 1; i >= 0; i-- {
+			if full[i] < '0' || full[i] > '9' {
+				continue
+			}
+			d := int(full[i] - '0')
+			if double {
+				if d *= 2; d > 9 {
+					d -= 9
+				}
+			}
+			sum += d
+			double = !double
+		}
+		if sum%10 != 0 {
+			t.Errorf("luhn(%s) = %d, sum = %d", s, luhn(s), sum)
+		}
+		// 包含校验码后整体对97取余为1
+		check := mod97(s)
+		r := 0
+		for _, c := range s + strconv.Itoa(check/10) + strconv.Itoa(check%10) {
+			if c >= '0' && c <= '9' {
+				r = (r*10 + int(c-'0')) % 97
+			}
+		}
+		if r != 1 {
+			t.Errorf("mod97(%s) = %d, remainder = %d, want = 1", s, check, r)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct{ format, reset, timezone string }{
+		{"ORD-{yyyy}", "", ""},
+		{"{seq}{seq}", "", ""},
+		{"{seq", "", ""},
+		{"{seq:0}", "", ""},
+		{"{foo}{seq}", "", ""},
+		{"{seq}", "weekly", ""},
+		{"{yyyy}{MM}{dd}{seq}", "daily", "Mars/Olympus"},
+		// 编码中缺少重置周期的日期, 下一个周期会生成重复的编码
+		{"ORD-{yyyy}{MM}-{seq:6}", "daily", ""},
+		{"ORD-{MM}{dd}-{seq:6}", "daily", ""},
+		{"ORD-{yyyy}-{seq:6}", "monthly", ""},
+		{"ORD-{MM}-{seq:6}", "yearly", ""},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.format, tt.reset, tt.timezone); err == nil {
+			t.Errorf("Parse(%q, %q, %q) must fail", tt.format, tt.reset, tt.timezone)
+		}
+	}
+	for _, tt := range []struct{ format, reset string }{
+		{"ORD-{yy}{MM}{dd}-{seq:6}", "daily"},
+		{"ORD-{yyyy}{MM}-{seq:6}", "monthly"},
+		{"INV{yy}{seq}", "yearly"},
+	} {
+		if _, err := Parse(tt.format, tt.reset, ""); err != nil {
+			t.Errorf("Parse(%q, %q): %v", tt.format, tt.reset, err)
+		}
+	}
+}
+
+type testCounter struct {
+	periods map[string]int64
+}
+
+func (c *testCounter) GetPeriod(ctx context.Context, biztag, period string, count int) (ids []int64, err error) {
+	for i := 0; i < count; i++ {
+		c.periods[period]++
+		ids = append(ids, c.periods[period])
+	}
+	return ids, nil
+}
+
+func TestServiceGet(t *testing.T) {
+	daily, err := Parse("ORD-{yyyy}{MM}{dd}-{seq:6}", segment.PeriodDaily, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &testCounter{periods: make(map[string]int64)}
+	svc := NewService(counter, map[string]*Template{"order": daily}, log.DefaultLogger)
+
+	codes, err := svc.Get(context.Background(), "order", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "ORD-" + time.Now().Format("20060102") + "-"
+	if codes[0] != prefix+"000001" || codes[1] != prefix+"000002" {
+		t.Errorf("codes = %v", codes)
+	}
+	if _, ok := counter.periods[time.Now().Format("20060102")]; !ok {
+		t.Errorf("periods = %v, want daily period", counter.periods)
+	}
+	if _, err = svc.Get(context.Background(), "unknown", 1); err != ErrTemplateNotFound {
+		t.Errorf("err = %v, want = %v", err, ErrTemplateNotFound)
+	}
+}
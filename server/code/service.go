@@ -0,0 +1,69 @@
+package code
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/segment"
+)
+
+var (
+	ErrTemplateNotFound = errors.New("code template not found")
+)
+
+// Counter 分配序列号, period为空时不重置, period已经过期时返回segment.ErrPeriodExpired。
+// segment.Service实现了该接口
+type Counter interface {
+	GetPeriod(ctx context.Context, biztag, period string, count int) ([]int64, error)
+}
+
+// Service 按照biztag的模板将segment序列号格式化为业务编码
+type Service struct {
+	counter   Counter
+	templates map[string]*Template
+	logger    log.Logger
+}
+
+func (s *Service) Get(ctx context.Context, biztag string, count int) ([]string, error) {
+	t, ok := s.templates[biztag]
+	if !ok {
+		return nil, ErrTemplateNotFound
+	}
+	var (
+		now  time.Time
+		seqs []int64
+		err  error
+	)
+	// 周期和日期使用同一个时间, 保证编码中的日期与序列号的周期一致。
+	// 请求跨越周期边界时使用新的时间重试
+	for i := 0; i < 3; i++ {
+		now = time.Now()
+		if seqs, err = s.counter.GetPeriod(ctx, biztag, t.Period(now), count); err != segment.ErrPeriodExpired {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, len(seqs))
+	for _, seq := range seqs {
+		code, err := t.Format(now, seq)
+		if err != nil {
+			s.logger.Errorw("Format code", "biztag", biztag, "template", t, "seq", seq, "err", err)
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// NewService templates的key为biztag, 序列号来自相同biztag的segment
+func NewService(counter Counter, templates map[string]*Template, logger log.Logger) *Service {
+	return &Service{
+		counter:   counter,
+		templates: templates,
+		logger:    logger,
+	}
+}
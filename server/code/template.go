@@ -0,0 +1,214 @@
+package code
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derry6/gleafd/server/segment"
+)
+
+const (
+	ResetNone = "none"
+)
+
+var (
+	ErrSeqOverflow = errors.New("sequence exceeds the template width")
+)
+
+// 重置周期的编码中必须包含的日期, 否则下一个周期会生成重复的编码。
+// 每一项中的layout至少出现一个
+var periodParts = map[string][][]string{
+	segment.PeriodDaily:   {{"02"}, {"01"}, {"2006", "06"}},
+	segment.PeriodMonthly: {{"01"}, {"2006", "06"}},
+	segment.PeriodYearly:  {{"2006", "06"}},
+}
+
+// 周期对应的占位符, 用于错误信息
+var periodNames = map[string]string{
+	segment.PeriodDaily:   "{dd}{MM}{yy|yyyy}",
+	segment.PeriodMonthly: "{MM}{yy|yyyy}",
+	segment.PeriodYearly:  "{yy|yyyy}",
+}
+
+// 日期时间占位符对应的time layout
+var timeParts = map[string]string{
+	"yyyy": "2006",
+	"yy":   "06",
+	"MM":   "01",
+	"dd":   "02",
+	"HH":   "15",
+	"mm":   "04",
+	"ss":   "05",
+}
+
+const (
+	partLiteral = iota
+	partTime
+	partSeq
+	partLuhn
+	partMod97
+)
+
+type part struct {
+	kind  int
+	text  string // 字面量或者time layout
+	width int    // 序列号补零后的宽度
+}
+
+// Template 业务编码模板, 例如"ORD-{yyyy}{MM}{dd}-{seq:6}"。
+//
+// 支持的占位符:
+//
+//	{yyyy} {yy} {MM} {dd} {HH} {mm} {ss}  生成编码时的日期时间
+//	{seq} {seq:N}                         segment序列号, N为补零后的宽度
+//	{luhn}                                前面所有数字的Luhn校验位
+//	{mod97}                               前面所有数字的ISO 7064 MOD 97-10校验码(2位)
+type Template struct {
+	format string
+	period *segment.Period // 为空表示不重置
+	loc    *time.Location
+	parts  []part
+}
+
+// Parse 解析模板, reset为序列号的重置周期: none|daily|monthly|yearly,
+// 日期和重置周期都使用timezone时区, 为空时使用本地时区
+func Parse(format, reset, timezone string) (*Template, error) {
+	t := &Template{format: format, loc: time.Local}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		t.loc = loc
+	}
+	if reset != "" && reset != ResetNone {
+		period, err := segment.NewPeriod(reset, timezone)
+		if err != nil {
+			return nil, err
+		}
+		t.period = period
+	}
+	seqs := 0
+	for s := format; len(s) > 0; {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			t.parts = append(t.parts, part{kind: partLiteral, text: s})
+			break
+		}
+		if i > 0 {
+			t.parts = append(t.parts, part{kind: partLiteral, text: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in code template: %s", format)
+		}
+		p, err := parsePlaceholder(s[i+1 : i+j])
+		if err != nil {
+			return nil, err
+		}
+		if p.kind == partSeq {
+			seqs++
+		}
+		t.parts = append(t.parts, p)
+		s = s[i+j+1:]
+	}
+	if seqs != 1 {
+		return nil, fmt.Errorf("code template must contain exactly one {seq}: %s", format)
+	}
+	if t.period != nil && !t.hasPeriodParts() {
+		return nil, fmt.Errorf("code template with %s reset must contain %s: %s",
+			t.period.Unit(), periodNames[t.period.Unit()], format)
+	}
+	return t, nil
+}
+
+// 编码中是否包含重置周期的日期
+func (t *Template) hasPeriodParts() bool {
+	layouts := make(map[string]bool)
+	for _, p := range t.parts {
+		if p.kind == partTime {
+			layouts[p.text] = true
+		}
+	}
+	for _, alts := range periodParts[t.period.Unit()] {
+		found := false
+		for _, layout := range alts {
+			found = found || layouts[layout]
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePlaceholder(name string) (part, error) {
+	if layout, ok := timeParts[name]; ok {
+		return part{kind: partTime, text: layout}, nil
+	}
+	switch name {
+	case "seq":
+		return part{kind: partSeq}, nil
+	case "luhn":
+		return part{kind: partLuhn}, nil
+	case "mod97":
+		return part{kind: partMod97}, nil
+	}
+	if strings.HasPrefix(name, "seq:") {
+		width, err := strconv.Atoi(name[len("seq:"):])
+		if err != nil || width <= 0 || width > 19 {
+			return part{}, fmt.Errorf("invalid sequence width: {%s}", name)
+		}
+		return part{kind: partSeq, width: width}, nil
+	}
+	return part{}, fmt.Errorf("unknown code placeholder: {%s}", name)
+}
+
+func (t *Template) String() string {
+	return t.format
+}
+
+// Period 返回now所在的重置周期, 不重置时为空
+func (t *Template) Period(now time.Time) string {
+	if t.period == nil {
+		return ""
+	}
+	return t.period.Key(now)
+}
+
+// ResetPeriod 返回序列号的重置周期, 不重置时为nil
+func (t *Template) ResetPeriod() *segment.Period {
+	return t.period
+}
+
+// Format 使用序列号seq生成now时刻的编码
+func (t *Template) Format(now time.Time, seq int64) (string, error) {
+	now = now.In(t.loc)
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.kind {
+		case partLiteral:
+			b.WriteString(p.text)
+		case partTime:
+			b.WriteString(now.Format(p.text))
+		case partSeq:
+			s := strconv.FormatInt(seq, 10)
+			if p.width > 0 {
+				// 超过宽度时编码不再定长, 直接返回错误
+				if len(s) > p.width {
+					return "", ErrSeqOverflow
+				}
+				b.WriteString(strings.Repeat("0", p.width-len(s)))
+			}
+			b.WriteString(s)
+		case partLuhn:
+			b.WriteByte('0' + luhn(b.String()))
+		case partMod97:
+			fmt.Fprintf(&b, "%02d", mod97(b.String()))
+		}
+	}
+	return b.String(), nil
+}
@@ -4,4 +4,8 @@ import "errors"
 
 var (
 	ErrServiceDisabled = errors.New("service disabled")
+	// 管理接口的token错误
+	ErrUnauthorized = errors.New("unauthorized")
+	// 没有配置管理接口的token
+	ErrAdminDisabled = errors.New("admin api disabled, no admin token configured")
 )
@@ -1,26 +1,61 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/derry6/gleafd/config"
 	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/segment"
+	"github.com/derry6/gleafd/server/snowflake"
 	"github.com/julienschmidt/httprouter"
 )
 
+// 租用号段的client标识, 与请求地址一起记录
+const ClientIDHeader = "X-Client-Id"
+
 type HttpResponse struct {
 	Code int         `json:"code"`
 	Msg  string      `json:"msg"`
 	Data interface{} `json:"data"`
+	// 按周期重置的segment biztag返回ID所在的周期
+	Period string `json:"period,omitempty"`
 }
 
-func NewHttpHandler(svc Service, logger log.Logger) http.Handler {
+func NewHttpHandler(svc Service, logger log.Logger, opts ...HandlerOption) http.Handler {
+	hopts := &handlerOptions{}
+	for _, o := range opts {
+		o(hopts)
+	}
+	admin := newAdminAuth(hopts.adminToken)
 	r := httprouter.New()
 
-	r.Handle("GET", "/api/v1/segments/:biztag", makeGetSegmentsHandle(svc, logger))
-	r.Handle("GET", "/api/v1/snowflakes/:biztag", makeGetSnowflakesHandle(svc, logger))
+	handle := func(route string, h httprouter.Handle) {
+		r.Handle("GET", route, traceHandle(route, h))
+	}
+	handle("/api/v1/segments/:biztag", makeGetSegmentsHandle(svc, logger))
+	handle("/api/v1/segments/:biztag/ranges", makeLeaseSegmentsHandle(svc, logger))
+	handle("/api/v1/segments/:biztag/obfuscated", makeGetStringIDsHandle("GetObfuscatedSegments", svc.GetObfuscatedSegments, logger))
+	// 仅供内部使用, 需要管理接口的token
+	handle("/api/v1/segments/:biztag/deobfuscate", admin.handle(makeDecodeObfuscatedSegmentHandle(svc, logger)))
+	handle("/api/v1/snowflakes/:biztag", makeGetSnowflakesHandle(svc, logger))
+	handle("/api/v1/snowflakes/:biztag/decode", makeDecodeSnowflakeHandle(svc, logger))
+	handle("/api/v1/uuids/:biztag", makeGetStringIDsHandle("GetUUIDs", svc.GetUUIDs, logger))
+	handle("/api/v1/ulids/:biztag", makeGetStringIDsHandle("GetULIDs", svc.GetULIDs, logger))
+	handle("/api/v1/codes/:biztag", makeGetStringIDsHandle("GetCodes", svc.GetCodes, logger))
+	// 仅供内部使用, 修改segments表之后通知所有节点, 需要管理接口的token
+	route := "/api/v1/admin/segments/:biztag/events"
+	r.Handle("POST", route, traceHandle(route, admin.handle(makeNotifyBizTagHandle(svc, logger))))
 
 	r.HandlerFunc("GET", "/api/v1/health",
 		func(w http.ResponseWriter, r *http.Request) {
@@ -37,8 +72,10 @@ func NewHttpHandler(svc Service, logger log.Logger) http.Handler {
 			}
 		})
 
+	r.Handler("GET", "/debug/vars", expvar.Handler())
+
 	r.HandlerFunc("GET", "/debug/pprof/", pprof.Index)
-	r.HandlerFunc("GET", "/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandlerFunc("GET", "/debug/pprof/cmdline", redactedCmdline)
 	r.HandlerFunc("GET", "/debug/pprof/profile", pprof.Profile)
 	r.HandlerFunc("GET", "/debug/pprof/symbol", pprof.Symbol)
 	r.HandlerFunc("GET", "/debug/pprof/trace", pprof.Trace)
@@ -49,7 +86,7 @@ func NewHttpHandler(svc Service, logger log.Logger) http.Handler {
 	r.Handler("GET", "/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
 	r.Handler("GET", "/debug/pprof/block", pprof.Handler("block"))
 
-	return r
+	return withClientIDHeader(withIdempotencyKeyHeader(r), hopts.trustedProxies)
 }
 
 func makeGetSegmentsHandle(svc Service, logger log.Logger) httprouter.Handle {
@@ -63,14 +100,30 @@ func makeGetSegmentsHandle(svc Service, logger log.Logger) httprouter.Handle {
 			encodeHttpError(w, err)
 			return
 		}
-		ids, err := svc.GetSegments(r.Context(), biztag, count)
+		if r.FormValue("format") == "ranges" {
+			ranges, err := svc.GetSegmentRanges(r.Context(), biztag, count)
+			if err != nil {
+				encodeHttpError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			httpRsp := &HttpResponse{Code: 0, Msg: "Ok", Data: ranges}
+			if len(ranges) > 0 {
+				httpRsp.Period = ranges[0].Period
+			}
+			if err = json.NewEncoder(w).Encode(httpRsp); err != nil {
+				logger.Errorw("GetSegmentRanges", "biztag", biztag, "count", count, "err", err)
+			}
+			return
+		}
+		ids, period, err := svc.GetSegments(r.Context(), biztag, count)
 		if err != nil {
 			//logger.Errorw("GetSegment", "biztag", biztag, "count", count, "err", err)
 			encodeHttpError(w, err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		httpRsp := &HttpResponse{Code: 0, Msg: "Ok", Data: ids}
+		httpRsp := &HttpResponse{Code: 0, Msg: "Ok", Data: ids, Period: period}
 		if err = json.NewEncoder(w).Encode(httpRsp); err != nil {
 			logger.Errorw("GetSegment", "biztag", biztag, "count", count, "err", err)
 		}
@@ -102,12 +155,176 @@ func makeGetSnowflakesHandle(svc Service, logger log.Logger) httprouter.Handle {
 	}
 }
 
+func makeDecodeSnowflakeHandle(svc Service, logger log.Logger) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		// Decode Request
+		biztag := params.ByName("biztag")
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			encodeHttpError(w, &ValidationError{Field: "id", Value: r.FormValue("id"), Reason: "must be an integer"})
+			return
+		}
+		info, err := svc.DecodeSnowflake(r.Context(), biztag, id)
+		if err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		httpRsp := &HttpResponse{Code: 0, Msg: "Ok", Data: info}
+		if err = json.NewEncoder(w).Encode(httpRsp); err != nil {
+			logger.Errorw("DecodeSnowflake", "biztag", biztag, "id", id, "err", err)
+		}
+	}
+}
+
+func makeLeaseSegmentsHandle(svc Service, logger log.Logger) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		// Decode Request
+		biztag := params.ByName("biztag")
+		size, err := getFormValueInt(r, "size", 0)
+		if err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		rng, err := svc.LeaseSegments(r.Context(), biztag, size, leaseClient(r))
+		if err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		httpRsp := &HttpResponse{Code: 0, Msg: "Ok", Data: rng}
+		if err = json.NewEncoder(w).Encode(httpRsp); err != nil {
+			logger.Errorw("LeaseSegments", "biztag", biztag, "size", size, "err", err)
+		}
+	}
+}
+
+func makeNotifyBizTagHandle(svc Service, logger log.Logger) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		// Decode Request
+		biztag := params.ByName("biztag")
+		event := r.FormValue("type")
+		if err := svc.NotifyBizTag(r.Context(), biztag, event); err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		httpRsp := &HttpResponse{Code: 0, Msg: "Ok"}
+		if err := json.NewEncoder(w).Encode(httpRsp); err != nil {
+			logger.Errorw("NotifyBizTag", "biztag", biztag, "event", event, "err", err)
+		}
+	}
+}
+
+// 请求地址, 不包含端口
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// client标识@请求地址
+func leaseClient(r *http.Request) string {
+	host := remoteHost(r)
+	if id := r.Header.Get(ClientIDHeader); id != "" {
+		return id + "@" + host
+	}
+	return host
+}
+
+func makeDecodeObfuscatedSegmentHandle(svc Service, logger log.Logger) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		// Decode Request
+		biztag := params.ByName("biztag")
+		id := r.FormValue("id")
+		decoded, err := svc.DecodeObfuscatedSegment(r.Context(), biztag, id)
+		if err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		httpRsp := &HttpResponse{Code: 0, Msg: "Ok", Data: decoded}
+		if err = json.NewEncoder(w).Encode(httpRsp); err != nil {
+			logger.Errorw("DecodeObfuscatedSegment", "biztag", biztag, "id", id, "err", err)
+		}
+	}
+}
+
+// UUIDv7, ULID, 业务编码和不可猜测的segment ID等字符串类型的ID
+func makeGetStringIDsHandle(name string,
+	get func(ctx context.Context, biztag string, count int) ([]string, error), logger log.Logger) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		// Decode Request
+		biztag := params.ByName("biztag")
+		count, err := getFormValueInt(r, "count", 1)
+		if err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		ids, err := get(r.Context(), biztag, count)
+		if err != nil {
+			encodeHttpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		httpRsp := &HttpResponse{Code: 0, Msg: "Ok", Data: ids}
+		if err = json.NewEncoder(w).Encode(httpRsp); err != nil {
+			logger.Errorw(name, "biztag", biztag, "count", count, "err", err)
+		}
+	}
+}
+
+// 与pprof.Cmdline相同, 但是隐藏了命令行中的密钥
+func redactedCmdline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(config.RedactArgs(os.Args), "\x00"))
+}
+
 func encodeHttpError(w http.ResponseWriter, err error) error {
 	httpRsp := &HttpResponse{Code: 0, Msg: "Ok"}
 	if err != nil {
 		// TODO:
 		httpRsp.Code = 400
 		httpRsp.Msg = err.Error()
+		switch e := err.(type) {
+		case *ValidationError:
+			httpRsp.Data = e
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+		case *RateLimitError:
+			httpRsp.Code = http.StatusTooManyRequests
+			retryAfter := int64((e.RetryAfter + time.Second - 1) / time.Second)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		// 数据库不可用并且没有可用的预留号段, 或者号段低于本地floor,
+		// 时钟偏差超过阈值或者服务已经关闭时健康检查返回503, 负载均衡不再转发请求
+		var (
+			updateErr *segment.UpdateError
+			floorErr  *segment.FloorError
+			skewErr   *snowflake.ClockSkewError
+		)
+		if errors.As(err, &updateErr) || errors.As(err, &floorErr) || errors.Is(err, segment.ErrCircuitOpen) ||
+			errors.As(err, &skewErr) || errors.Is(err, snowflake.ErrClosed) {
+			httpRsp.Code = http.StatusServiceUnavailable
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		switch err {
+		case ErrUnauthorized:
+			httpRsp.Code = http.StatusUnauthorized
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+		case ErrAdminDisabled:
+			httpRsp.Code = http.StatusForbidden
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+		}
 	}
 	return json.NewEncoder(w).Encode(httpRsp)
 }
@@ -116,7 +333,7 @@ func getFormValueInt(r *http.Request, name string, defv int) (int, error) {
 	if s := r.FormValue(name); len(s) == 0 {
 		return defv, nil
 	} else if v, err := strconv.ParseInt(s, 10, 64); err != nil {
-		return 0, err
+		return 0, &ValidationError{Field: name, Value: s, Reason: "must be an integer"}
 	} else {
 		return int(v), nil
 	}
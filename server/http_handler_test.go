@@ -7,10 +7,14 @@ import (
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/obfuscate"
+	"github.com/derry6/gleafd/server/segment"
+	"github.com/derry6/gleafd/server/snowflake"
 )
 
 func TestGetFormValueInt(t *testing.T) {
@@ -44,7 +48,10 @@ func TestGetFormValueInt(t *testing.T) {
 type fakeSegmentService struct {
 }
 
-func (s *fakeSegmentService) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+func (s *fakeSegmentService) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	if biztag == "down" {
+		return nil, "", &segment.UpdateError{BizTag: biztag, Err: segment.ErrCircuitOpen}
+	}
 	if count == 0 {
 		count = 1
 	}
@@ -52,7 +59,17 @@ func (s *fakeSegmentService) GetSegments(ctx context.Context, biztag string, cou
 	for i := 0; i < count; i++ {
 		ids = append(ids, rand.Int63())
 	}
-	return ids, nil
+	if biztag == "invoices" {
+		period = "2026"
+	}
+	return ids, period, nil
+}
+func (s *fakeSegmentService) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
+	// 跨越号段边界
+	if count > 10 {
+		return []segment.Range{{Start: 91, End: 101}, {Start: 201, End: 201 + int64(count-10)}}, nil
+	}
+	return []segment.Range{{Start: 91, End: 91 + int64(count)}}, nil
 }
 func (s *fakeSegmentService) GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error) {
 	if count == 0 {
@@ -64,6 +81,43 @@ func (s *fakeSegmentService) GetSnowflakes(ctx context.Context, biztag string, c
 	}
 	return ids, nil
 }
+func (s *fakeSegmentService) DecodeSnowflake(ctx context.Context, biztag string, id int64) (info *snowflake.IDInfo, err error) {
+	decoded := snowflake.DefaultLayout.Decode(id, 0, 0)
+	return &decoded, nil
+}
+func (s *fakeSegmentService) GetUUIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	for i := 0; i < count; i++ {
+		ids = append(ids, fmt.Sprintf("0190a4c2-6e2b-7%03x-8000-000000000000", i))
+	}
+	return ids, nil
+}
+func (s *fakeSegmentService) GetULIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	for i := 0; i < count; i++ {
+		ids = append(ids, fmt.Sprintf("01J2JC4VHB00000000000000%02d", i))
+	}
+	return ids, nil
+}
+func (s *fakeSegmentService) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	return &segment.Range{Start: 1001, End: 1001 + int64(size)}, nil
+}
+func (s *fakeSegmentService) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	for i := 0; i < count; i++ {
+		ids = append(ids, fmt.Sprintf("3Xk9fQ%05d", i))
+	}
+	return ids, nil
+}
+func (s *fakeSegmentService) DecodeObfuscatedSegment(ctx context.Context, biztag string, id string) (decoded *obfuscate.Decoded, err error) {
+	return &obfuscate.Decoded{ID: 1001, Version: 2}, nil
+}
+func (s *fakeSegmentService) GetCodes(ctx context.Context, biztag string, count int) (codes []string, err error) {
+	for i := 0; i < count; i++ {
+		codes = append(codes, fmt.Sprintf("ORD-20261017-%06d", i+1))
+	}
+	return codes, nil
+}
+func (s *fakeSegmentService) NotifyBizTag(ctx context.Context, biztag, event string) error {
+	return nil
+}
 func (s *fakeSegmentService) HealthCheck(ctx context.Context, name string) (status int, err error) {
 	return 1, nil
 }
@@ -72,15 +126,23 @@ func (s *fakeSegmentService) Close() error {
 	return nil
 }
 
+const testAdminToken = "test-admin-token"
+
 func newFakeServer() *httptest.Server {
-	r := NewHttpHandler(&fakeSegmentService{}, log.DefaultLogger)
+	r := NewHttpHandler(&fakeSegmentService{}, log.DefaultLogger,
+		WithAdminToken(func() string { return testAdminToken }))
 	return httptest.NewServer(r)
 }
 
 func doTestHttpHandler(t *testing.T, uri string, rsp interface{}) {
 	httpServer := newFakeServer()
 	defer httpServer.Close()
-	httpRsp, err := http.Get(httpServer.URL + uri)
+	req, err := http.NewRequest("GET", httpServer.URL+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	httpRsp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,3 +192,315 @@ func TestSegmentHttpHandler(t *testing.T) {
 		t.Errorf("len of ids is %d, want 10", len(getRsp.Data))
 	}
 }
+
+func TestPeriodSegmentHttpHandler(t *testing.T) {
+	type GetSegmentsResponse struct {
+		Code   int     `json:"code"`
+		Msg    string  `json:"msg"`
+		Data   []int64 `json:"data"`
+		Period string  `json:"period"`
+	}
+	var getRsp GetSegmentsResponse
+	doTestHttpHandler(t, "/api/v1/segments/invoices?count=3", &getRsp)
+
+	if getRsp.Code != 0 {
+		t.Errorf("code = %d, want = 0", getRsp.Code)
+	}
+	if getRsp.Period != "2026" {
+		t.Errorf("period = %q, want = 2026", getRsp.Period)
+	}
+	if len(getRsp.Data) != 3 {
+		t.Errorf("len of ids is %d, want 3", len(getRsp.Data))
+	}
+}
+
+func TestSegmentRangesHttpHandler(t *testing.T) {
+	type GetRangesResponse struct {
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data []segment.Range `json:"data"`
+	}
+	var getRsp GetRangesResponse
+	doTestHttpHandler(t, "/api/v1/segments/orders?count=15&format=ranges", &getRsp)
+
+	if getRsp.Code != 0 {
+		t.Errorf("code = %d, want = 0", getRsp.Code)
+	}
+	if len(getRsp.Data) != 2 {
+		t.Fatalf("ranges = %+v, want 2 ranges", getRsp.Data)
+	}
+	if getRsp.Data[0].Start != 91 || getRsp.Data[0].End != 101 || getRsp.Data[1].End != 206 {
+		t.Errorf("ranges = %+v", getRsp.Data)
+	}
+}
+
+func TestSegmentUnavailableHttpHandler(t *testing.T) {
+	httpServer := newFakeServer()
+	defer httpServer.Close()
+	httpRsp, err := http.Get(httpServer.URL + "/api/v1/segments/down?count=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRsp.Body.Close()
+	var rsp HttpResponse
+	if err = json.NewDecoder(httpRsp.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if httpRsp.StatusCode != http.StatusServiceUnavailable || rsp.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, code = %d, want = 503", httpRsp.StatusCode, rsp.Code)
+	}
+}
+
+// 健康检查失败
+type unhealthyService struct {
+	fakeSegmentService
+	err error
+}
+
+func (s *unhealthyService) HealthCheck(ctx context.Context, name string) (status int, err error) {
+	return 0, s.err
+}
+
+func TestHealthCheckHttpHandler(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{&snowflake.ClockSkewError{Skew: 10 * time.Second, Peers: []string{"node1"}}, http.StatusServiceUnavailable},
+		{snowflake.ErrClosed, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		httpServer := httptest.NewServer(NewHttpHandler(&unhealthyService{err: tt.err}, log.DefaultLogger))
+		httpRsp, err := http.Get(httpServer.URL + "/api/v1/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpRsp.Body.Close()
+		httpServer.Close()
+		if httpRsp.StatusCode != tt.status {
+			t.Errorf("err = %v, status = %d, want = %d", tt.err, httpRsp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestDecodeObfuscatedSegmentHttpHandler(t *testing.T) {
+	type DecodeResponse struct {
+		Code int               `json:"code"`
+		Msg  string            `json:"msg"`
+		Data obfuscate.Decoded `json:"data"`
+	}
+	var decodeRsp DecodeResponse
+	doTestHttpHandler(t, "/api/v1/segments/orders/deobfuscate?id=3Xk9fQ00001", &decodeRsp)
+
+	if decodeRsp.Code != 0 {
+		t.Errorf("code = %d, want = 0", decodeRsp.Code)
+	}
+	if decodeRsp.Data.ID != 1001 || decodeRsp.Data.Version != 2 {
+		t.Errorf("decoded = %+v, want id = 1001, version = 2", decodeRsp.Data)
+	}
+}
+
+func TestAdminAuthHttpHandler(t *testing.T) {
+	uri := "/api/v1/segments/orders/deobfuscate?id=3Xk9fQ00001"
+	get := func(url, token string) int {
+		req, err := http.NewRequest("GET", url+uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		httpRsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpRsp.Body.Close()
+		return httpRsp.StatusCode
+	}
+	// 没有配置token时拒绝所有请求
+	disabled := httptest.NewServer(NewHttpHandler(&fakeSegmentService{}, log.DefaultLogger))
+	defer disabled.Close()
+	if status := get(disabled.URL, testAdminToken); status != http.StatusForbidden {
+		t.Errorf("status = %d, want = %d", status, http.StatusForbidden)
+	}
+
+	httpServer := newFakeServer()
+	defer httpServer.Close()
+	for _, token := range []string{"", "wrong"} {
+		if status := get(httpServer.URL, token); status != http.StatusUnauthorized {
+			t.Errorf("token = %q, status = %d, want = %d", token, status, http.StatusUnauthorized)
+		}
+	}
+	if status := get(httpServer.URL, testAdminToken); status != http.StatusOK {
+		t.Errorf("status = %d, want = %d", status, http.StatusOK)
+	}
+	// 超过限制之后返回429
+	status := http.StatusOK
+	for i := 0; i < adminRateLimit.Burst && status != http.StatusTooManyRequests; i++ {
+		status = get(httpServer.URL, "wrong")
+	}
+	if status != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want = %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestLeaseSegmentsHttpHandler(t *testing.T) {
+	type LeaseResponse struct {
+		Code int           `json:"code"`
+		Msg  string        `json:"msg"`
+		Data segment.Range `json:"data"`
+	}
+	var leaseRsp LeaseResponse
+	doTestHttpHandler(t, "/api/v1/segments/orders/ranges?size=1000000", &leaseRsp)
+
+	if leaseRsp.Code != 0 {
+		t.Errorf("code = %d, want = 0", leaseRsp.Code)
+	}
+	if leaseRsp.Data.Start != 1001 || leaseRsp.Data.End != 1001001 {
+		t.Errorf("range = %+v, want = [1001, 1001001)", leaseRsp.Data)
+	}
+}
+
+func TestDecodeSnowflakeHttpHandler(t *testing.T) {
+	type DecodeSnowflakeResponse struct {
+		Code int              `json:"code"`
+		Msg  string           `json:"msg"`
+		Data snowflake.IDInfo `json:"data"`
+	}
+	var decodeRsp DecodeSnowflakeResponse
+	id := int64(1000)<<snowflake.TimeShift | int64(12)<<snowflake.MachineIDShift | 3
+	doTestHttpHandler(t, fmt.Sprintf("/api/v1/snowflakes/msgs/decode?id=%d", id), &decodeRsp)
+
+	if decodeRsp.Code != 0 {
+		t.Errorf("code = %d, want = 0", decodeRsp.Code)
+	}
+	if decodeRsp.Data.MachineID != 12 || decodeRsp.Data.Sequence != 3 {
+		t.Errorf("decoded = %+v, want machine id = 12, sequence = 3", decodeRsp.Data)
+	}
+}
+
+func TestUUIDHttpHandler(t *testing.T) {
+	type GetUUIDsResponse struct {
+		Code int      `json:"code"`
+		Msg  string   `json:"msg"`
+		Data []string `json:"data"`
+	}
+	for _, uri := range []string{
+		"/api/v1/uuids/msgs?count=10",
+		"/api/v1/ulids/msgs?count=10",
+		"/api/v1/codes/orders?count=10",
+		"/api/v1/segments/orders/obfuscated?count=10",
+	} {
+		var getRsp GetUUIDsResponse
+		doTestHttpHandler(t, uri, &getRsp)
+
+		if getRsp.Code != 0 {
+			t.Errorf("uri = %s, code = %d, want = 0", uri, getRsp.Code)
+		}
+		if len(getRsp.Data) != 10 {
+			t.Errorf("uri = %s, len of ids is %d, want 10", uri, len(getRsp.Data))
+		}
+	}
+}
+
+func TestValidationHttpHandler(t *testing.T) {
+	limits := DefaultLimits()
+	limits.BizTags = map[string]int{"small": 5}
+	svc := Validation(limits)(&fakeSegmentService{})
+	httpServer := httptest.NewServer(NewHttpHandler(svc, log.DefaultLogger))
+	defer httpServer.Close()
+
+	tests := []struct {
+		uri   string
+		field string
+	}{
+		{"/api/v1/segments/orders?count=0", "count"},
+		{"/api/v1/segments/orders?count=-1", "count"},
+		{"/api/v1/segments/orders?count=abc", "count"},
+		{"/api/v1/segments/orders?count=100000000", "count"},
+		{"/api/v1/snowflakes/small?count=6", "count"},
+		{"/api/v1/segments/orders/ranges?size=0", "size"},
+		{"/api/v1/uuids/" + strings.Repeat("a", MaxBizTagLen+1), "biztag"},
+		{"/api/v1/codes/order%20s", "biztag"},
+		{"/api/v1/snowflakes/orders/decode?id=x", "id"},
+	}
+	for _, tt := range tests {
+		httpRsp, err := http.Get(httpServer.URL + tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rsp struct {
+			Code int             `json:"code"`
+			Msg  string          `json:"msg"`
+			Data ValidationError `json:"data"`
+		}
+		err = json.NewDecoder(httpRsp.Body).Decode(&rsp)
+		httpRsp.Body.Close()
+		if err != nil {
+			t.Fatalf("uri = %v, decode response: %v", tt.uri, err)
+		}
+		if httpRsp.StatusCode != http.StatusBadRequest || rsp.Code != http.StatusBadRequest {
+			t.Errorf("uri = %v, status = %d, code = %d, want = 400", tt.uri, httpRsp.StatusCode, rsp.Code)
+		}
+		if rsp.Data.Field != tt.field || rsp.Data.Reason == "" {
+			t.Errorf("uri = %v, error = %+v, want field = %v", tt.uri, rsp.Data, tt.field)
+		}
+	}
+
+	var getRsp struct {
+		Code int     `json:"code"`
+		Data []int64 `json:"data"`
+	}
+	httpRsp, err := http.Get(httpServer.URL + "/api/v1/snowflakes/small?count=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRsp.Body.Close()
+	if err = json.NewDecoder(httpRsp.Body).Decode(&getRsp); err != nil {
+		t.Fatal(err)
+	}
+	if httpRsp.StatusCode != http.StatusOK || getRsp.Code != 0 || len(getRsp.Data) != 5 {
+		t.Errorf("status = %d, rsp = %+v, want 5 ids", httpRsp.StatusCode, getRsp)
+	}
+}
+
+func TestNotifyBizTagHttpHandler(t *testing.T) {
+	svc := Validation(DefaultLimits())(&fakeSegmentService{})
+	httpServer := httptest.NewServer(NewHttpHandler(svc, log.DefaultLogger,
+		WithAdminToken(func() string { return testAdminToken })))
+	defer httpServer.Close()
+
+	tests := []struct {
+		uri    string
+		token  string
+		status int
+	}{
+		{"/api/v1/admin/segments/orders/events?type=created", testAdminToken, http.StatusOK},
+		{"/api/v1/admin/segments/orders/events?type=renamed", testAdminToken, http.StatusBadRequest},
+		{"/api/v1/admin/segments/order%20s/events?type=deleted", testAdminToken, http.StatusBadRequest},
+		{"/api/v1/admin/segments/orders/events?type=created", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", httpServer.URL+tt.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		httpRsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rsp HttpResponse
+		err = json.NewDecoder(httpRsp.Body).Decode(&rsp)
+		httpRsp.Body.Close()
+		if err != nil {
+			t.Fatalf("uri = %v, decode response: %v", tt.uri, err)
+		}
+		if httpRsp.StatusCode != tt.status {
+			t.Errorf("uri = %v, status = %d, want = %d", tt.uri, httpRsp.StatusCode, tt.status)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/idempotency"
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/segment"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// gRPC接入时从metadata读取该字段, 通过WithIdempotencyKey传递给Service
+	IdempotencyKeyMetadata = "idempotency-key"
+)
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey 在ctx中设置幂等键, 同一个客户端相同的键, biztag和count(租用时为size)在TTL内返回相同的ID
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKey 返回ctx中的幂等键, 不存在时为空
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// 从请求头中读取幂等键
+func withIdempotencyKeyHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+			r = r.WithContext(WithIdempotencyKey(r.Context(), key))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type idempotentCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// IdempotencyMidware 保存带有幂等键的请求结果, 超时重试时返回相同的ID
+type IdempotencyMidware struct {
+	Service
+	store    idempotency.Store
+	ttl      time.Duration
+	logger   log.Logger
+	mu       sync.Mutex
+	inflight map[string]*idempotentCall
+}
+
+type segmentsResult struct {
+	IDs    []int64 `json:"ids"`
+	Period string  `json:"period,omitempty"`
+}
+
+// 幂等键只在同一个客户端内有效, 不同客户端使用相同的Idempotency-Key时互不影响
+func idempotentKey(ctx context.Context, kind, biztag string, count int, key string) string {
+	return fmt.Sprintf("%s/%s/%d/%s/%s", kind, biztag, count, url.PathEscape(ClientID(ctx)), key)
+}
+
+// 相同的key只执行一次fn, 结果保存在store中
+func (m *IdempotencyMidware) do(ctx context.Context, key string, result interface{}, fn func() (interface{}, error)) error {
+	data, err := m.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data, err = m.call(ctx, key, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, result)
+}
+
+// 同一个节点上并发的重复请求等待第一个请求的结果
+func (m *IdempotencyMidware) call(ctx context.Context, key string, fn func() (interface{}, error)) ([]byte, error) {
+	m.mu.Lock()
+	if c, ok := m.inflight[key]; ok {
+		m.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.data, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &idempotentCall{done: make(chan struct{})}
+	m.inflight[key] = c
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.inflight, key)
+		m.mu.Unlock()
+		close(c.done)
+	}()
+	var v interface{}
+	if v, c.err = fn(); c.err != nil {
+		// 失败的请求不保存, 允许重试
+		return nil, c.err
+	}
+	if c.data, c.err = json.Marshal(v); c.err != nil {
+		return nil, c.err
+	}
+	// 其它节点已经处理过相同的请求时使用其结果, 本次分配的ID被丢弃
+	if c.data, c.err = m.store.SetNX(ctx, key, c.data, m.ttl); c.err != nil {
+		m.logger.Errorw("Save idempotent result", "key", key, "err", c.err)
+	}
+	return c.data, c.err
+}
+
+func (m *IdempotencyMidware) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	key := IdempotencyKey(ctx)
+	if key == "" {
+		return m.Service.GetSegments(ctx, biztag, count)
+	}
+	var result segmentsResult
+	err = m.do(ctx, idempotentKey(ctx, "segments", biztag, count, key), &result, func() (interface{}, error) {
+		ids, period, err := m.Service.GetSegments(ctx, biztag, count)
+		return &segmentsResult{IDs: ids, Period: period}, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return result.IDs, result.Period, nil
+}
+
+func (m *IdempotencyMidware) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
+	key := IdempotencyKey(ctx)
+	if key == "" {
+		return m.Service.GetSegmentRanges(ctx, biztag, count)
+	}
+	err = m.do(ctx, idempotentKey(ctx, "ranges", biztag, count, key), &ranges, func() (interface{}, error) {
+		return m.Service.GetSegmentRanges(ctx, biztag, count)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+func (m *IdempotencyMidware) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	key := IdempotencyKey(ctx)
+	if key == "" {
+		return m.Service.LeaseSegments(ctx, biztag, size, client)
+	}
+	err = m.do(ctx, idempotentKey(ctx, "leases", biztag, size, key), &r, func() (interface{}, error) {
+		return m.Service.LeaseSegments(ctx, biztag, size, client)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (m *IdempotencyMidware) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	key := IdempotencyKey(ctx)
+	if key == "" {
+		return m.Service.GetObfuscatedSegments(ctx, biztag, count)
+	}
+	err = m.do(ctx, idempotentKey(ctx, "obfuscated", biztag, count, key), &ids, func() (interface{}, error) {
+		return m.Service.GetObfuscatedSegments(ctx, biztag, count)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (m *IdempotencyMidware) GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	key := IdempotencyKey(ctx)
+	if key == "" {
+		return m.Service.GetSnowflakes(ctx, biztag, count)
+	}
+	err = m.do(ctx, idempotentKey(ctx, "snowflakes", biztag, count, key), &ids, func() (interface{}, error) {
+		return m.Service.GetSnowflakes(ctx, biztag, count)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Idempotency 返回幂等Midware, 结果在store中最多保存ttl
+func Idempotency(store idempotency.Store, ttl time.Duration, logger log.Logger) Midware {
+	return func(svc Service) Service {
+		return &IdempotencyMidware{
+			Service:  svc,
+			store:    store,
+			ttl:      ttl,
+			logger:   logger,
+			inflight: make(map[string]*idempotentCall),
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/idempotency"
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/segment"
+)
+
+// 每次调用都返回新的ID
+type countingService struct {
+	fakeSegmentService
+	next  int64
+	calls int32
+}
+
+func (s *countingService) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(time.Millisecond)
+	for i := 0; i < count; i++ {
+		ids = append(ids, atomic.AddInt64(&s.next, 1))
+	}
+	return ids, "2026", nil
+}
+
+func (s *countingService) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
+	ids, period, err := s.GetSegments(ctx, biztag, count)
+	return []segment.Range{{Start: ids[0], End: ids[0] + int64(count), Period: period}}, err
+}
+
+func (s *countingService) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	ranges, err := s.GetSegmentRanges(ctx, biztag, size)
+	return &ranges[0], err
+}
+
+func (s *countingService) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	raw, _, err := s.GetSegments(ctx, biztag, count)
+	for _, id := range raw {
+		ids = append(ids, fmt.Sprintf("x%d", id))
+	}
+	return ids, err
+}
+
+func (s *countingService) GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	ids, _, err = s.GetSegments(ctx, biztag, count)
+	return ids, err
+}
+
+func TestIdempotencyMidware(t *testing.T) {
+	fake := &countingService{}
+	svc := Idempotency(idempotency.NewMemoryStore(100), time.Minute, log.DefaultLogger)(fake)
+
+	ctx := WithIdempotencyKey(context.Background(), "req-1")
+	ids1, period, err := svc.GetSegments(ctx, "orders", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids2, _, _ := svc.GetSegments(ctx, "orders", 3)
+	if fmt.Sprint(ids1) != fmt.Sprint(ids2) || period != "2026" {
+		t.Errorf("retry returns %v, want = %v", ids2, ids1)
+	}
+	// 不同的count或者没有幂等键时重新分配
+	if ids3, _, _ := svc.GetSegments(ctx, "orders", 2); ids3[0] == ids1[0] {
+		t.Errorf("different count must allocate new ids")
+	}
+	if ids4, _, _ := svc.GetSegments(context.Background(), "orders", 3); ids4[0] == ids1[0] {
+		t.Errorf("request without key must allocate new ids")
+	}
+	sf1, _ := svc.GetSnowflakes(ctx, "orders", 3)
+	if sf1[0] == ids1[0] {
+		t.Errorf("snowflakes must not share results with segments")
+	}
+	if sf2, _ := svc.GetSnowflakes(ctx, "orders", 3); fmt.Sprint(sf1) != fmt.Sprint(sf2) {
+		t.Errorf("retry returns %v, want = %v", sf2, sf1)
+	}
+	// 不同客户端使用相同的幂等键时重新分配
+	if ids5, _, _ := svc.GetSegments(WithClientID(ctx, "client-2"), "orders", 3); ids5[0] == ids1[0] {
+		t.Errorf("different client must allocate new ids")
+	}
+
+	// 范围, 租用和不可猜测的ID
+	r1, _ := svc.GetSegmentRanges(ctx, "orders", 3)
+	if r2, _ := svc.GetSegmentRanges(ctx, "orders", 3); fmt.Sprint(r1) != fmt.Sprint(r2) || r1[0].Start == ids1[0] {
+		t.Errorf("retry returns ranges %v, want = %v", r2, r1)
+	}
+	l1, _ := svc.LeaseSegments(ctx, "orders", 3, "importer")
+	if l2, _ := svc.LeaseSegments(ctx, "orders", 3, "importer"); *l1 != *l2 || l1.Start == r1[0].Start {
+		t.Errorf("retry returns lease %v, want = %v", l2, l1)
+	}
+	if l3, _ := svc.LeaseSegments(ctx, "orders", 4, "importer"); l3.Start == l1.Start {
+		t.Errorf("different size must lease new ids")
+	}
+	o1, _ := svc.GetObfuscatedSegments(ctx, "orders", 3)
+	if o2, _ := svc.GetObfuscatedSegments(ctx, "orders", 3); fmt.Sprint(o1) != fmt.Sprint(o2) {
+		t.Errorf("retry returns %v, want = %v", o2, o1)
+	}
+
+	// 并发的重复请求只分配一次
+	calls := atomic.LoadInt32(&fake.calls)
+	ctx = WithIdempotencyKey(context.Background(), "req-2")
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids, _, _ := svc.GetSegments(ctx, "orders", 2)
+			results[i] = fmt.Sprint(ids)
+		}(i)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r != results[0] {
+			t.Errorf("results = %v, want all equal", results)
+			break
+		}
+	}
+	if n := atomic.LoadInt32(&fake.calls) - calls; n != 1 {
+		t.Errorf("calls = %d, want = 1", n)
+	}
+}
+
+// 请求一直阻塞到release关闭
+type blockingService struct {
+	fakeSegmentService
+	release chan struct{}
+}
+
+func (s *blockingService) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	<-s.release
+	return []int64{1}, "", nil
+}
+
+func TestIdempotencyWaitCanceled(t *testing.T) {
+	fake := &blockingService{release: make(chan struct{})}
+	defer close(fake.release)
+	svc := Idempotency(idempotency.NewMemoryStore(100), time.Minute, log.DefaultLogger)(fake)
+	ctx := WithIdempotencyKey(context.Background(), "req-1")
+	go svc.GetSegments(ctx, "orders", 1)
+	m := svc.(*IdempotencyMidware)
+	for inflight := 0; inflight == 0; {
+		time.Sleep(time.Millisecond)
+		m.mu.Lock()
+		inflight = len(m.inflight)
+		m.mu.Unlock()
+	}
+
+	// 等待第一个请求的结果时可以取消
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := svc.GetSegments(ctx, "orders", 1); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want = %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestIdempotencyKeyHeader(t *testing.T) {
+	svc := Idempotency(idempotency.NewMemoryStore(100), time.Minute, log.DefaultLogger)(&countingService{})
+	httpServer := httptest.NewServer(NewHttpHandler(svc, log.DefaultLogger))
+	defer httpServer.Close()
+
+	get := func(uri string) string {
+		req, _ := http.NewRequest("GET", httpServer.URL+uri, nil)
+		req.Header.Set(IdempotencyKeyHeader, "abc")
+		httpRsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer httpRsp.Body.Close()
+		var rsp struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err = json.NewDecoder(httpRsp.Body).Decode(&rsp); err != nil {
+			t.Fatal(err)
+		}
+		return string(rsp.Data)
+	}
+	for _, uri := range []string{"/api/v1/segments/orders?count=2", "/api/v1/segments/orders?count=2&format=ranges"} {
+		if data1, data2 := get(uri), get(uri); data1 != data2 {
+			t.Errorf("%s retry returns %s, want = %s", uri, data2, data1)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/segment"
 )
 
 type Midware func(svc Service) Service
@@ -14,17 +15,32 @@ type LoggingMidware struct {
 	Service
 }
 
-func (m *LoggingMidware) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+func (m *LoggingMidware) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
 	defer func(begin time.Time) {
 		m.logger.Infow("GetSegments",
 			"biztag", biztag,
 			"count", count,
 			"results", ids,
+			"period", period,
 			"err", err,
 			"elapsed", time.Now().Sub(begin),
 		)
 	}(time.Now())
-	ids, err = m.Service.GetSegments(ctx, biztag, count)
+	ids, period, err = m.Service.GetSegments(ctx, biztag, count)
+	return
+}
+
+func (m *LoggingMidware) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
+	defer func(begin time.Time) {
+		m.logger.Infow("GetSegmentRanges",
+			"biztag", biztag,
+			"count", count,
+			"results", ranges,
+			"err", err,
+			"elapsed", time.Now().Sub(begin),
+		)
+	}(time.Now())
+	ranges, err = m.Service.GetSegmentRanges(ctx, biztag, count)
 	return
 }
 
@@ -42,6 +58,90 @@ func (m *LoggingMidware) GetSnowflakes(ctx context.Context, biztag string, count
 	return
 }
 
+func (m *LoggingMidware) GetUUIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	defer func(begin time.Time) {
+		m.logger.Infow("GetUUIDs",
+			"biztag", biztag,
+			"count", count,
+			"results", ids,
+			"err", err,
+			"elapsed", time.Now().Sub(begin),
+		)
+	}(time.Now())
+	ids, err = m.Service.GetUUIDs(ctx, biztag, count)
+	return
+}
+
+func (m *LoggingMidware) GetULIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	defer func(begin time.Time) {
+		m.logger.Infow("GetULIDs",
+			"biztag", biztag,
+			"count", count,
+			"results", ids,
+			"err", err,
+			"elapsed", time.Now().Sub(begin),
+		)
+	}(time.Now())
+	ids, err = m.Service.GetULIDs(ctx, biztag, count)
+	return
+}
+
+func (m *LoggingMidware) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	defer func(begin time.Time) {
+		m.logger.Infow("LeaseSegments",
+			"biztag", biztag,
+			"size", size,
+			"client", client,
+			"result", r,
+			"err", err,
+			"elapsed", time.Now().Sub(begin),
+		)
+	}(time.Now())
+	r, err = m.Service.LeaseSegments(ctx, biztag, size, client)
+	return
+}
+
+func (m *LoggingMidware) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	defer func(begin time.Time) {
+		m.logger.Infow("GetObfuscatedSegments",
+			"biztag", biztag,
+			"count", count,
+			"results", ids,
+			"err", err,
+			"elapsed", time.Now().Sub(begin),
+		)
+	}(time.Now())
+	ids, err = m.Service.GetObfuscatedSegments(ctx, biztag, count)
+	return
+}
+
+func (m *LoggingMidware) GetCodes(ctx context.Context, biztag string, count int) (codes []string, err error) {
+	defer func(begin time.Time) {
+		m.logger.Infow("GetCodes",
+			"biztag", biztag,
+			"count", count,
+			"results", codes,
+			"err", err,
+			"elapsed", time.Now().Sub(begin),
+		)
+	}(time.Now())
+	codes, err = m.Service.GetCodes(ctx, biztag, count)
+	return
+}
+
+func (m *LoggingMidware) NotifyBizTag(ctx context.Context, biztag, event string) (err error) {
+	defer func(begin time.Time) {
+		m.logger.Infow("NotifyBizTag",
+			"biztag", biztag,
+			"event", event,
+			"err", err,
+			"elapsed", time.Now().Sub(begin),
+		)
+	}(time.Now())
+	err = m.Service.NotifyBizTag(ctx, biztag, event)
+	return
+}
+
 func (m *LoggingMidware) HealthCheck(ctx context.Context, name string) (status int, err error) {
 	defer func(begin time.Time) {
 		m.logger.Infow("HealthCheck",
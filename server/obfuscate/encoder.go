@@ -0,0 +1,151 @@
+package obfuscate
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatInt    = "int"
+	FormatBase62 = "base62"
+
+	DefaultAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// 最高位为0, 之后3位为密钥版本, 剩余60位为置换后的ID
+	VersionBits = 3
+	MaxVersion  = 1<<VersionBits - 1
+	valueBits   = 60
+	MaxID       = 1<<valueBits - 1
+)
+
+var (
+	ErrIDOutOfRange   = errors.New("id out of range")
+	ErrInvalidID      = errors.New("invalid obfuscated id")
+	ErrUnknownVersion = errors.New("unknown key version")
+)
+
+// Encoder 使用带版本的密钥将ID可逆地映射为不可猜测的ID。
+// 新的ID使用当前版本的密钥, 旧版本的密钥保留用于解码, 从而支持密钥轮换。
+type Encoder struct {
+	format   string
+	alphabet string
+	version  int
+	keys     map[int]*feistel
+}
+
+// NewEncoder format为int或者base62, alphabet为base62使用的字符表(为空时使用DefaultAlphabet),
+// version为当前使用的密钥版本, keys为所有版本的密钥
+func NewEncoder(format, alphabet string, version int, keys map[int][]byte) (*Encoder, error) {
+	switch format {
+	case "":
+		format = FormatInt
+	case FormatInt, FormatBase62:
+	default:
+		return nil, fmt.Errorf("unknown obfuscate format: %s", format)
+	}
+	if alphabet == "" {
+		alphabet = DefaultAlphabet
+	}
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
+	e := &Encoder{
+		format:   format,
+		alphabet: alphabet,
+		version:  version,
+		keys:     make(map[int]*feistel),
+	}
+	for v, key := range keys {
+		if v < 0 || v > MaxVersion {
+			return nil, fmt.Errorf("obfuscate key version must be in [0, %d]: %d", MaxVersion, v)
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("obfuscate key of version %d is too short", v)
+		}
+		e.keys[v] = &feistel{secret: key}
+	}
+	if _, ok := e.keys[version]; !ok {
+		return nil, fmt.Errorf("obfuscate key of version %d not found", version)
+	}
+	return e, nil
+}
+
+func validateAlphabet(alphabet string) error {
+	if len(alphabet) < 16 {
+		return errors.New("obfuscate alphabet must contain at least 16 characters")
+	}
+	for i := 0; i < len(alphabet); i++ {
+		if alphabet[i] > 127 || strings.IndexByte(alphabet[i+1:], alphabet[i]) >= 0 {
+			return fmt.Errorf("invalid obfuscate alphabet: %s", alphabet)
+		}
+	}
+	return nil
+}
+
+// Encode 使用当前版本的密钥编码id, id必须在[0, MaxID]之间
+func (e *Encoder) Encode(id int64) (string, error) {
+	if id < 0 || id > MaxID {
+		return "", ErrIDOutOfRange
+	}
+	n := uint64(e.version)<<valueBits | e.keys[e.version].encrypt(uint64(id))
+	if e.format == FormatInt {
+		return strconv.FormatUint(n, 10), nil
+	}
+	return e.encodeBase(n), nil
+}
+
+// Decode 还原Encode的结果, 同时返回使用的密钥版本。
+// 只接受Encode输出的形式, 带有前导0等形式的字符串返回ErrInvalidID, 避免同一个ID有多种写法
+func (e *Encoder) Decode(s string) (id int64, version int, err error) {
+	var n uint64
+	if e.format == FormatInt {
+		if n, err = strconv.ParseUint(s, 10, 63); err != nil || strconv.FormatUint(n, 10) != s {
+			return 0, 0, ErrInvalidID
+		}
+	} else if n, err = e.decodeBase(s); err != nil {
+		return 0, 0, err
+	}
+	version = int(n >> valueBits)
+	f, ok := e.keys[version]
+	if !ok {
+		return 0, version, ErrUnknownVersion
+	}
+	return int64(f.decrypt(n & MaxID)), version, nil
+}
+
+func (e *Encoder) encodeBase(n uint64) string {
+	base := uint64(len(e.alphabet))
+	var b [64]byte
+	i := len(b)
+	for {
+		i--
+		b[i] = e.alphabet[n%base]
+		if n /= base; n == 0 {
+			break
+		}
+	}
+	return string(b[i:])
+}
+
+func (e *Encoder) decodeBase(s string) (uint64, error) {
+	// 除了0本身, 不能以alphabet[0]开头
+	if len(s) == 0 || len(s) > 1 && s[0] == e.alphabet[0] {
+		return 0, ErrInvalidID
+	}
+	base := uint64(len(e.alphabet))
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(e.alphabet, s[i])
+		if d < 0 {
+			return 0, ErrInvalidID
+		}
+		// 结果必须小于2^63
+		if n > (1<<63-1-uint64(d))/base {
+			return 0, ErrInvalidID
+		}
+		n = n*base + uint64(d)
+	}
+	return n, nil
+}
@@ -0,0 +1,44 @@
+package obfuscate
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	halfBits = 30
+	halfMask = 1<<halfBits - 1
+	rounds   = 6
+)
+
+// feistel 60位的平衡Feistel网络, 轮函数为HMAC-SHA256。
+// 对于同一个密钥是[0, 2^60)上的置换, 可以逆向还原。
+type feistel struct {
+	secret []byte
+}
+
+func (f *feistel) round(i int, r uint64) uint64 {
+	var b [5]byte
+	b[0] = byte(i)
+	binary.BigEndian.PutUint32(b[1:], uint32(r))
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(b[:])
+	return uint64(binary.BigEndian.Uint32(mac.Sum(nil))) & halfMask
+}
+
+func (f *feistel) encrypt(x uint64) uint64 {
+	l, r := x>>halfBits, x&halfMask
+	for i := 0; i < rounds; i++ {
+		l, r = r, l^f.round(i, r)
+	}
+	return l<<halfBits | r
+}
+
+func (f *feistel) decrypt(x uint64) uint64 {
+	l, r := x>>halfBits, x&halfMask
+	for i := rounds - 1; i >= 0; i-- {
+		l, r = r^f.round(i, l), l
+	}
+	return l<<halfBits | r
+}
@@ -0,0 +1,142 @@
+package obfuscate
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+var (
+	key1 = []byte("0123456789abcdef-v1")
+	key2 = []byte("0123456789abcdef-v2")
+)
+
+func TestFeistelPermutation(t *testing.T) {
+	f := &feistel{secret: key1}
+	seen := make(map[uint64]bool)
+	for x := uint64(0); x < 10000; x++ {
+		y := f.encrypt(x)
+		if y > MaxID {
+			t.Fatalf("encrypt(%d) = %d out of range", x, y)
+		}
+		if seen[y] {
+			t.Fatalf("encrypt(%d) = %d collides", x, y)
+		}
+		seen[y] = true
+		if got := f.decrypt(y); got != x {
+			t.Fatalf("decrypt(encrypt(%d)) = %d", x, got)
+		}
+	}
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatInt, FormatBase62} {
+		e, err := NewEncoder(format, "", 1, map[int][]byte{1: key1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []int64{0, 1, 2, 1000, MaxID, rand.Int63n(MaxID)} {
+			s, err := e.Encode(id)
+			if err != nil {
+				t.Fatalf("encode %d: %v", id, err)
+			}
+			got, version, err := e.Decode(s)
+			if err != nil {
+				t.Fatalf("decode %s: %v", s, err)
+			}
+			if got != id || version != 1 {
+				t.Errorf("decode(%s) = %d, %d, want = %d, 1", s, got, version, id)
+			}
+		}
+		if _, err = e.Encode(MaxID + 1); err != ErrIDOutOfRange {
+			t.Errorf("err = %v, want = %v", err, ErrIDOutOfRange)
+		}
+		// 带有前导0的形式不能解码
+		s, _ := e.Encode(1000)
+		for _, invalid := range []string{"0" + s, "00" + s, "+" + s, ""} {
+			if _, _, err = e.Decode(invalid); err != ErrInvalidID {
+				t.Errorf("decode(%q) err = %v, want = %v", invalid, err, ErrInvalidID)
+			}
+		}
+	}
+}
+
+func TestEncoderKeyRotation(t *testing.T) {
+	old, _ := NewEncoder(FormatBase62, "", 1, map[int][]byte{1: key1})
+	rotated, err := NewEncoder(FormatBase62, "", 2, map[int][]byte{1: key1, 2: key2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, _ := old.Encode(12345)
+	s2, _ := rotated.Encode(12345)
+	if s1 == s2 {
+		t.Errorf("different keys produce the same id %s", s1)
+	}
+	// 轮换后仍然可以解码旧版本的ID
+	if id, version, err := rotated.Decode(s1); err != nil || id != 12345 || version != 1 {
+		t.Errorf("decode(%s) = %d, %d, %v", s1, id, version, err)
+	}
+	if _, _, err := old.Decode(s2); err != ErrUnknownVersion {
+		t.Errorf("err = %v, want = %v", err, ErrUnknownVersion)
+	}
+	// 相同的密钥在不同节点上生成相同的结果
+	other, _ := NewEncoder(FormatBase62, "", 1, map[int][]byte{1: key1})
+	if s, _ := other.Encode(12345); s != s1 {
+		t.Errorf("encode = %s, want = %s", s, s1)
+	}
+}
+
+func TestNewEncoderInvalid(t *testing.T) {
+	tests := []struct {
+		format, alphabet string
+		version          int
+		keys             map[int][]byte
+	}{
+		{"hex", "", 0, map[int][]byte{0: key1}},
+		{FormatBase62, "0123456789", 0, map[int][]byte{0: key1}},
+		{FormatBase62, "00123456789abcdef", 0, map[int][]byte{0: key1}},
+		{FormatInt, "", 1, map[int][]byte{0: key1}},
+		{FormatInt, "", 8, map[int][]byte{8: key1}},
+		{FormatInt, "", 0, map[int][]byte{0: []byte("short")}},
+	}
+	for i, tt := range tests {
+		if _, err := NewEncoder(tt.format, tt.alphabet, tt.version, tt.keys); err == nil {
+			t.Errorf("case %d must fail", i)
+		}
+	}
+}
+
+type testCounter struct {
+	next int64
+}
+
+func (c *testCounter) Get(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	for i := 0; i < count; i++ {
+		c.next++
+		ids = append(ids, c.next)
+	}
+	return ids, nil
+}
+
+func TestServiceGet(t *testing.T) {
+	e, _ := NewEncoder(FormatBase62, "", 0, map[int][]byte{0: key1})
+	svc := NewService(&testCounter{}, map[string]*Encoder{"orders": e}, log.DefaultLogger)
+	ids, err := svc.Get(context.Background(), "orders", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		decoded, err := svc.Decode(context.Background(), "orders", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.ID != int64(i+1) {
+			t.Errorf("decode(%s) = %d, want = %d", id, decoded.ID, i+1)
+		}
+	}
+	if _, err = svc.Get(context.Background(), "unknown", 1); err != ErrEncoderNotFound {
+		t.Errorf("err = %v, want = %v", err, ErrEncoderNotFound)
+	}
+}
@@ -0,0 +1,71 @@
+package obfuscate
+
+import (
+	"context"
+	"errors"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+var (
+	ErrEncoderNotFound = errors.New("obfuscate encoder not found")
+)
+
+// Counter 分配ID, segment.Service实现了该接口
+type Counter interface {
+	Get(ctx context.Context, biztag string, count int) ([]int64, error)
+}
+
+// Decoded 解码后的ID, 仅供内部使用
+type Decoded struct {
+	ID      int64 `json:"id"`
+	Version int   `json:"version"`
+}
+
+// Service 将segment ID映射为不可猜测的ID, 避免暴露业务量
+type Service struct {
+	counter  Counter
+	encoders map[string]*Encoder
+	logger   log.Logger
+}
+
+func (s *Service) Get(ctx context.Context, biztag string, count int) ([]string, error) {
+	e, ok := s.encoders[biztag]
+	if !ok {
+		return nil, ErrEncoderNotFound
+	}
+	ids, err := s.counter.Get(ctx, biztag, count)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]string, 0, len(ids))
+	for _, id := range ids {
+		encoded, err := e.Encode(id)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, encoded)
+	}
+	return results, nil
+}
+
+func (s *Service) Decode(ctx context.Context, biztag string, id string) (*Decoded, error) {
+	e, ok := s.encoders[biztag]
+	if !ok {
+		return nil, ErrEncoderNotFound
+	}
+	n, version, err := e.Decode(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Decoded{ID: n, Version: version}, nil
+}
+
+// NewService encoders的key为biztag, ID来自相同biztag的segment
+func NewService(counter Counter, encoders map[string]*Encoder, logger log.Logger) *Service {
+	return &Service{
+		counter:  counter,
+		encoders: encoders,
+		logger:   logger,
+	}
+}
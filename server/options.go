@@ -2,27 +2,42 @@ package server
 
 import (
 	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/code"
+	"github.com/derry6/gleafd/server/obfuscate"
 	"github.com/derry6/gleafd/server/segment"
 	"github.com/derry6/gleafd/server/snowflake"
+	"github.com/derry6/gleafd/server/uuid"
 )
 
 type Options struct {
 	name string
 	addr string
 	mdws []Midware
+	// 请求参数的限制
+	limits Limits
 
 	logger log.Logger
 	// Segment
-	repo segment.Repository
+	repo    segment.Repository
+	segOpts []segment.Option
+	// 业务编码模板, 序列号来自segment
+	codeTemplates map[string]*code.Template
+	// 不可猜测的segment ID
+	obfuscators map[string]*obfuscate.Encoder
 	// Snowflake
-	stor snowflake.Storage
+	stor     snowflake.Storage
+	snowOpts []snowflake.Option
+	// UUIDv7 & ULID
+	uuidEnabled bool
+	uuidOpts    []uuid.Option
 }
 
 func newDefaultOptions() *Options {
 	return &Options{
-		name: "gleafd",
-		addr: "127.0.0.1:8090",
-		mdws: make([]Midware, 0),
+		name:   "gleafd",
+		addr:   "127.0.0.1:8090",
+		mdws:   make([]Midware, 0),
+		limits: DefaultLimits(),
 	}
 }
 
@@ -55,14 +70,55 @@ func WithMidwares(mdws []Midware) Option {
 	}
 }
 
+// WithLimits 设置每次请求最多获取的ID数量
+func WithLimits(limits Limits) Option {
+	return func(opts *Options) {
+		opts.limits = limits
+	}
+}
+
 func WithSegmentRepository(repo segment.Repository) Option {
 	return func(opts *Options) {
 		opts.repo = repo
 	}
 }
 
+func WithSegmentOptions(segOpts ...segment.Option) Option {
+	return func(opts *Options) {
+		opts.segOpts = append(opts.segOpts, segOpts...)
+	}
+}
+
+// WithCodeTemplates 设置业务编码模板, key为biztag
+func WithCodeTemplates(templates map[string]*code.Template) Option {
+	return func(opts *Options) {
+		opts.codeTemplates = templates
+	}
+}
+
+// WithObfuscators 设置segment ID的编码器, key为biztag
+func WithObfuscators(encoders map[string]*obfuscate.Encoder) Option {
+	return func(opts *Options) {
+		opts.obfuscators = encoders
+	}
+}
+
 func WithSnowflakeStorage(stor snowflake.Storage) Option {
 	return func(opts *Options) {
 		opts.stor = stor
 	}
 }
+
+// WithUUID 启用UUIDv7和ULID
+func WithUUID(uuidOpts ...uuid.Option) Option {
+	return func(opts *Options) {
+		opts.uuidEnabled = true
+		opts.uuidOpts = append(opts.uuidOpts, uuidOpts...)
+	}
+}
+
+func WithSnowflakeOptions(snowOpts ...snowflake.Option) Option {
+	return func(opts *Options) {
+		opts.snowOpts = append(opts.snowOpts, snowOpts...)
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/pkg/ratelimit"
+	"github.com/derry6/gleafd/server/obfuscate"
+	"github.com/derry6/gleafd/server/segment"
+	"github.com/derry6/gleafd/server/snowflake"
+)
+
+type clientIDKey struct{}
+
+// WithClientID 在ctx中设置客户端标识, 用于限流
+func WithClientID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientIDKey{}, id)
+}
+
+// ClientID 返回ctx中的客户端标识, 不存在时为空
+func ClientID(ctx context.Context) string {
+	id, _ := ctx.Value(clientIDKey{}).(string)
+	return id
+}
+
+// WithTrustedProxies 只有来自proxies的请求才使用X-Client-Id请求头作为客户端标识
+func WithTrustedProxies(proxies []*net.IPNet) HandlerOption {
+	return func(opts *handlerOptions) {
+		opts.trustedProxies = proxies
+	}
+}
+
+// ParseTrustedProxies 解析IP或者CIDR, IP等同于只包含这个地址的CIDR
+func ParseTrustedProxies(addrs []string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", addr)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(host string, proxies []*net.IPNet) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, p := range proxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 客户端标识为请求地址, 来自可信代理的请求使用X-Client-Id请求头。
+// 不信任其它请求的X-Client-Id, 否则客户端可以通过修改请求头绕过限流
+func withClientIDHeader(next http.Handler, proxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := remoteHost(r)
+		if h := r.Header.Get(ClientIDHeader); h != "" && isTrustedProxy(id, proxies) {
+			id = h
+		}
+		next.ServeHTTP(w, r.WithContext(WithClientID(r.Context(), id)))
+	})
+}
+
+// RateLimit 同时限制请求数和ID的数量
+type RateLimit struct {
+	Requests ratelimit.Limit
+	IDs      ratelimit.Limit
+}
+
+// RateLimits 每个客户端和每个biztag分别使用单独的令牌桶
+type RateLimits struct {
+	Client RateLimit
+	BizTag RateLimit
+	// 单独设置的biztag, 优先于BizTag
+	BizTags map[string]RateLimit
+}
+
+// RateLimitError 超过限制时返回, HTTP接口返回429和Retry-After
+type RateLimitError struct {
+	Scope      string
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s %s, retry after %v", e.Scope, e.Key, e.RetryAfter)
+}
+
+// RateLimitMidware 按客户端和biztag限制请求数和ID的数量
+type RateLimitMidware struct {
+	Service
+	limiter ratelimit.Limiter
+	limits  RateLimits
+	logger  log.Logger
+}
+
+func (m *RateLimitMidware) take(ctx context.Context, scope, key string, limit RateLimit, n int) error {
+	checks := []struct {
+		name  string
+		limit ratelimit.Limit
+		n     int
+	}{
+		{"requests", limit.Requests, 1},
+		{"ids", limit.IDs, n},
+	}
+	for _, c := range checks {
+		if c.n <= 0 || c.limit.Rate <= 0 {
+			continue
+		}
+		wait, err := m.limiter.Take(ctx, scope+"/"+key+"/"+c.name, c.limit, c.n)
+		if errors.Is(err, ratelimit.ErrExceedsBurst) {
+			// 等待多久都无法满足
+			return &ValidationError{Field: "count", Value: strconv.Itoa(c.n),
+				Reason: fmt.Sprintf("exceeds the burst of the %s rate limit", scope)}
+		}
+		if err != nil {
+			// 限流不可用时不影响发放ID
+			m.logger.Errorw("Rate limiter", "scope", scope, "key", key, "err", err)
+			return nil
+		}
+		if wait > 0 {
+			return &RateLimitError{Scope: scope, Key: key, RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// 依次检查客户端和biztag的限制, n为请求的ID数量
+func (m *RateLimitMidware) limit(ctx context.Context, biztag string, n int) error {
+	if id := ClientID(ctx); id != "" {
+		if err := m.take(ctx, "client", id, m.limits.Client, n); err != nil {
+			return err
+		}
+	}
+	limit, ok := m.limits.BizTags[biztag]
+	if !ok {
+		limit = m.limits.BizTag
+	}
+	return m.take(ctx, "biztag", biztag, limit, n)
+}
+
+func (m *RateLimitMidware) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	if err = m.limit(ctx, biztag, count); err != nil {
+		return nil, "", err
+	}
+	return m.Service.GetSegments(ctx, biztag, count)
+}
+
+func (m *RateLimitMidware) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
+	if err = m.limit(ctx, biztag, count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetSegmentRanges(ctx, biztag, count)
+}
+
+func (m *RateLimitMidware) GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	if err = m.limit(ctx, biztag, count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetSnowflakes(ctx, biztag, count)
+}
+
+func (m *RateLimitMidware) DecodeSnowflake(ctx context.Context, biztag string, id int64) (info *snowflake.IDInfo, err error) {
+	if err = m.limit(ctx, biztag, 0); err != nil {
+		return nil, err
+	}
+	return m.Service.DecodeSnowflake(ctx, biztag, id)
+}
+
+func (m *RateLimitMidware) GetUUIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if err = m.limit(ctx, biztag, count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetUUIDs(ctx, biztag, count)
+}
+
+func (m *RateLimitMidware) GetULIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if err = m.limit(ctx, biztag, count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetULIDs(ctx, biztag, count)
+}
+
+func (m *RateLimitMidware) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	if err = m.limit(ctx, biztag, size); err != nil {
+		return nil, err
+	}
+	return m.Service.LeaseSegments(ctx, biztag, size, client)
+}
+
+func (m *RateLimitMidware) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if err = m.limit(ctx, biztag, count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetObfuscatedSegments(ctx, biztag, count)
+}
+
+func (m *RateLimitMidware) DecodeObfuscatedSegment(ctx context.Context, biztag string, id string) (decoded *obfuscate.Decoded, err error) {
+	if err = m.limit(ctx, biztag, 0); err != nil {
+		return nil, err
+	}
+	return m.Service.DecodeObfuscatedSegment(ctx, biztag, id)
+}
+
+func (m *RateLimitMidware) GetCodes(ctx context.Context, biztag string, count int) (codes []string, err error) {
+	if err = m.limit(ctx, biztag, count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetCodes(ctx, biztag, count)
+}
+
+// RateLimiting 返回限流Midware, 使用ratelimit.NewRedisLimiter时在多个节点之间共享限制
+func RateLimiting(limiter ratelimit.Limiter, limits RateLimits, logger log.Logger) Midware {
+	return func(svc Service) Service {
+		return &RateLimitMidware{Service: svc, limiter: limiter, limits: limits, logger: logger}
+	}
+}
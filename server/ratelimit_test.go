@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/pkg/ratelimit"
+)
+
+func TestRateLimitMidware(t *testing.T) {
+	limits := RateLimits{
+		Client: RateLimit{Requests: ratelimit.Limit{Rate: 0.01, Burst: 3}},
+		BizTag: RateLimit{IDs: ratelimit.Limit{Rate: 0.01, Burst: 100}},
+		BizTags: map[string]RateLimit{
+			"unlimited": {},
+		},
+	}
+	svc := RateLimiting(ratelimit.NewMemoryLimiter(100), limits, log.DefaultLogger)(&fakeSegmentService{})
+
+	ctx := WithClientID(context.Background(), "job1")
+	// 按ID的数量限制biztag
+	if _, err := svc.GetSnowflakes(ctx, "orders", 80); err != nil {
+		t.Fatal(err)
+	}
+	_, err := svc.GetSnowflakes(ctx, "orders", 30)
+	if e, ok := err.(*RateLimitError); !ok || e.Scope != "biztag" || e.RetryAfter <= 0 {
+		t.Fatalf("err = %v, want biztag rate limit error", err)
+	}
+	// 按请求数限制client
+	if _, err = svc.GetSnowflakes(ctx, "unlimited", 1000); err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.GetSnowflakes(ctx, "unlimited", 1)
+	if e, ok := err.(*RateLimitError); !ok || e.Scope != "client" || e.Key != "job1" {
+		t.Fatalf("err = %v, want client rate limit error", err)
+	}
+	// 其它client不受影响
+	if _, err = svc.GetSnowflakes(WithClientID(context.Background(), "job2"), "unlimited", 1); err != nil {
+		t.Fatal(err)
+	}
+	// 超过burst的请求直接拒绝
+	_, err = svc.GetSnowflakes(WithClientID(context.Background(), "job3"), "orders", 101)
+	if _, ok := err.(*ValidationError); !ok {
+		t.Fatalf("err = %v, want ValidationError", err)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, trusted := range map[string]bool{
+		"10.1.2.3": true, "192.168.1.1": true, "192.168.1.2": false, "::1": true, "127.0.0.1": false, "": false,
+	} {
+		if got := isTrustedProxy(host, proxies); got != trusted {
+			t.Errorf("host = %q, trusted = %v, want = %v", host, got, trusted)
+		}
+	}
+	if _, err = ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("want error for invalid cidr")
+	}
+}
+
+func TestRateLimitHttpHandler(t *testing.T) {
+	limits := RateLimits{Client: RateLimit{Requests: ratelimit.Limit{Rate: 0.5, Burst: 1}}}
+	svc := RateLimiting(ratelimit.NewMemoryLimiter(100), limits, log.DefaultLogger)(&fakeSegmentService{})
+	proxies, _ := ParseTrustedProxies([]string{"127.0.0.1", "::1"})
+	httpServer := httptest.NewServer(NewHttpHandler(svc, log.DefaultLogger, WithTrustedProxies(proxies)))
+	defer httpServer.Close()
+
+	get := func(client string) *http.Response {
+		return getWithClientID(t, httpServer.URL, client)
+	}
+	if httpRsp := get("job1"); httpRsp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want = 200", httpRsp.StatusCode)
+	}
+	httpRsp := get("job1")
+	defer httpRsp.Body.Close()
+	if httpRsp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want = 429", httpRsp.StatusCode)
+	}
+	if v := httpRsp.Header.Get("Retry-After"); v != "2" {
+		t.Errorf("Retry-After = %q, want = 2", v)
+	}
+	var rsp HttpResponse
+	if err := json.NewDecoder(httpRsp.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Code != http.StatusTooManyRequests {
+		t.Errorf("code = %d, want = 429", rsp.Code)
+	}
+	if httpRsp := get("job2"); httpRsp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want = 200", httpRsp.StatusCode)
+	}
+
+	// 不是可信代理时忽略X-Client-Id, 按请求地址限流
+	svc = RateLimiting(ratelimit.NewMemoryLimiter(100), limits, log.DefaultLogger)(&fakeSegmentService{})
+	untrusted := httptest.NewServer(NewHttpHandler(svc, log.DefaultLogger))
+	defer untrusted.Close()
+	if httpRsp := getWithClientID(t, untrusted.URL, "job1"); httpRsp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want = 200", httpRsp.StatusCode)
+	}
+	if httpRsp := getWithClientID(t, untrusted.URL, "job2"); httpRsp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want = 429", httpRsp.StatusCode)
+	}
+}
+
+func getWithClientID(t *testing.T, url, client string) *http.Response {
+	req, _ := http.NewRequest("GET", url+"/api/v1/segments/orders?count=1", nil)
+	req.Header.Set(ClientIDHeader, client)
+	httpRsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httpRsp
+}
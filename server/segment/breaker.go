@@ -0,0 +1,136 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+var (
+	ErrCircuitOpen = errors.New("segment repository circuit open")
+
+	circuitOpenTotal = expvar.NewInt("segment_circuit_open_total")
+)
+
+type breakerRepository struct {
+	Repository
+	failures int
+	cooldown time.Duration
+	logger   log.Logger
+
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time
+	probing     bool
+}
+
+// NewCircuitBreaker 连续failures次可以重试的错误(IsTransient)之后断开,
+// cooldown内的调用直接返回ErrCircuitOpen, 之后只允许一个调用探测数据库是否恢复
+func NewCircuitBreaker(repo Repository, failures int, cooldown time.Duration, logger log.Logger) Repository {
+	if failures <= 0 {
+		return repo
+	}
+	return &breakerRepository{Repository: repo, failures: failures, cooldown: cooldown, logger: logger}
+}
+
+func (b *breakerRepository) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.consecutive < b.failures {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+func (b *breakerRepository) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil || !IsTransient(err) {
+		if b.consecutive >= b.failures {
+			b.logger.Infow("Segment repository circuit closed")
+		}
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	if b.consecutive >= b.failures {
+		if b.consecutive == b.failures {
+			circuitOpenTotal.Add(1)
+			b.logger.Errorw("Segment repository circuit opened", "failures", b.consecutive, "err", err)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+func (b *breakerRepository) call(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.done(err)
+	return err
+}
+
+func (b *breakerRepository) List(ctx context.Context) (segs []*Segment, err error) {
+	err = b.call(func() error {
+		segs, err = b.Repository.List(ctx)
+		return err
+	})
+	return segs, err
+}
+
+func (b *breakerRepository) Get(ctx context.Context, biztag string) (seg *Segment, err error) {
+	err = b.call(func() error {
+		seg, err = b.Repository.Get(ctx, biztag)
+		return err
+	})
+	return seg, err
+}
+
+func (b *breakerRepository) UpdateMaxID(ctx context.Context, biztag string) (seg *Segment, err error) {
+	err = b.call(func() error {
+		seg, err = b.Repository.UpdateMaxID(ctx, biztag)
+		return err
+	})
+	return seg, err
+}
+
+func (b *breakerRepository) UpdateMaxIDWithStep(ctx context.Context, biztag string, step int32) (seg *Segment, err error) {
+	err = b.call(func() error {
+		seg, err = b.Repository.UpdateMaxIDWithStep(ctx, biztag, step)
+		return err
+	})
+	return seg, err
+}
+
+func (b *breakerRepository) UpdatePeriodMaxID(ctx context.Context, biztag, period string, step int32) (seg *Segment, err error) {
+	err = b.call(func() error {
+		seg, err = b.Repository.UpdatePeriodMaxID(ctx, biztag, period, step)
+		return err
+	})
+	return seg, err
+}
+
+func (b *breakerRepository) ListBizTags(ctx context.Context) (tags []string, err error) {
+	err = b.call(func() error {
+		tags, err = b.Repository.ListBizTags(ctx)
+		return err
+	})
+	return tags, err
+}
+
+// RecordLease 断路器打开时不保存租用记录
+func (b *breakerRepository) RecordLease(ctx context.Context, lease *Lease) error {
+	return b.call(func() error {
+		return recordLease(ctx, b.Repository, lease)
+	})
+}
@@ -0,0 +1,173 @@
+package segment
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+var (
+	floorViolationsTotal = expvar.NewMap("segment_floor_violations_total")
+)
+
+// FloorError 数据库返回的号段低于本节点已经发放过的max_id, 可能是主从切换丢失了已经提交的更新
+type FloorError struct {
+	BizTag string
+	Period string
+	MaxID  int64
+	Floor  int64
+}
+
+func (e *FloorError) Error() string {
+	return fmt.Sprintf("segment %s%s max_id %d below local floor %d",
+		e.BizTag, periodSuffix(e.Period), e.MaxID, e.Floor)
+}
+
+func periodSuffix(period string) string {
+	if period == "" {
+		return ""
+	}
+	return "/" + period
+}
+
+// FloorStore 在本地保存每个biztag(biztag/period)已经发放的最大max_id
+type FloorStore interface {
+	Load() (map[string]int64, error)
+	Save(floors map[string]int64) error
+}
+
+type fileFloorStore struct {
+	fileName string
+}
+
+// NewFileFloorStore 使用本地JSON文件保存, 文件不存在时Load返回空
+func NewFileFloorStore(fileName string) FloorStore {
+	return &fileFloorStore{fileName: fileName}
+}
+
+func (s *fileFloorStore) Load() (map[string]int64, error) {
+	floors := make(map[string]int64)
+	data, err := ioutil.ReadFile(s.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return floors, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &floors); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", s.fileName, err)
+	}
+	return floors, nil
+}
+
+// 先写临时文件再rename, 避免写入过程中崩溃导致文件损坏
+func (s *fileFloorStore) Save(floors map[string]int64) error {
+	data, err := json.Marshal(floors)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.fileName), filepath.Base(s.fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.fileName)
+}
+
+// floorGuard 拒绝或者跳过低于本地记录的号段
+type floorGuard struct {
+	store  FloorStore
+	skip   bool
+	logger log.Logger
+
+	mu     sync.Mutex
+	floors map[string]int64
+}
+
+func (g *floorGuard) load() error {
+	floors, err := g.store.Load()
+	if err != nil {
+		return fmt.Errorf("load segment floors: %v", err)
+	}
+	g.mu.Lock()
+	g.floors = floors
+	g.mu.Unlock()
+	return nil
+}
+
+func (g *floorGuard) get(key string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.floors[key]
+}
+
+// check 在事务提交之前检查seg, skip时调用fence将数据库中的max_id推进到floor+step
+func (g *floorGuard) check(biztag, period string, seg *Segment, fence func(maxID int64) error) error {
+	floor := g.get(biztag + periodSuffix(period))
+	if seg.MaxID-int64(seg.Step) >= floor {
+		return nil
+	}
+	floorViolationsTotal.Add(biztag, 1)
+	if !g.skip {
+		err := &FloorError{BizTag: biztag, Period: period, MaxID: seg.MaxID, Floor: floor}
+		g.logger.Errorw("Segment below local floor, possible failover rollback, refused",
+			"biztag", biztag, "period", period, "max_id", seg.MaxID, "step", seg.Step, "floor", floor)
+		return err
+	}
+	maxID := floor + int64(seg.Step)
+	if err := fence(maxID); err != nil {
+		return err
+	}
+	g.logger.Errorw("Segment below local floor, possible failover rollback, skipped forward",
+		"biztag", biztag, "period", period, "max_id", seg.MaxID, "step", seg.Step, "floor", floor, "new_max_id", maxID)
+	seg.MaxID = maxID
+	return nil
+}
+
+// advance 在事务提交之后记录max_id, 保存成功之后才能发放号段。
+// 按周期重置的biztag只保留最新周期的记录, 之前的周期不会再分配号段
+func (g *floorGuard) advance(biztag, period string, maxID int64) error {
+	key := biztag + periodSuffix(period)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if maxID <= g.floors[key] {
+		return nil
+	}
+	if period != "" {
+		prefix := biztag + "/"
+		for k := range g.floors {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			// 同一个biztag的周期格式相同, 可以按字符串比较
+			if p := k[len(prefix):]; p > period {
+				return nil
+			} else if p < period {
+				delete(g.floors, k)
+			}
+		}
+	}
+	g.floors[key] = maxID
+	if err := g.store.Save(g.floors); err != nil {
+		return fmt.Errorf("save segment floor: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package segment
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+func TestFloorGuard(t *testing.T) {
+	store := NewFileFloorStore(filepath.Join(t.TempDir(), "segment.floors"))
+	g := &floorGuard{store: store, logger: log.DefaultLogger}
+	if err := g.load(); err != nil {
+		t.Fatal(err)
+	}
+	noFence := func(maxID int64) error {
+		t.Fatalf("fence(%d) called", maxID)
+		return nil
+	}
+	if err := g.check("biztag1", "", &Segment{BizTag: "biztag1", MaxID: 2001, Step: 1000}, noFence); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.advance("biztag1", "", 2001); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启之后从文件中恢复
+	g = &floorGuard{store: store, logger: log.DefaultLogger}
+	if err := g.load(); err != nil {
+		t.Fatal(err)
+	}
+	// 主从切换之后数据库回到了1001
+	var floorErr *FloorError
+	err := g.check("biztag1", "", &Segment{BizTag: "biztag1", MaxID: 2001, Step: 1000}, noFence)
+	if !errors.As(err, &floorErr) || floorErr.Floor != 2001 {
+		t.Fatalf("err = %v, want FloorError with floor 2001", err)
+	}
+	// 其它周期不受影响
+	if err = g.check("biztag1", "20261019", &Segment{BizTag: "biztag1", MaxID: 1001, Step: 1000}, noFence); err != nil {
+		t.Fatal(err)
+	}
+
+	g.skip = true
+	var fenced int64
+	seg := &Segment{BizTag: "biztag1", MaxID: 2001, Step: 1000}
+	err = g.check("biztag1", "", seg, func(maxID int64) error {
+		fenced = maxID
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fenced != 3001 || seg.MaxID != 3001 {
+		t.Fatalf("fenced = %d, seg = %+v, want max_id = 3001", fenced, seg)
+	}
+}
+
+func TestFloorGuardPrunePeriods(t *testing.T) {
+	store := NewFileFloorStore(filepath.Join(t.TempDir(), "segment.floors"))
+	g := &floorGuard{store: store, logger: log.DefaultLogger}
+	if err := g.load(); err != nil {
+		t.Fatal(err)
+	}
+	advances := []struct {
+		biztag string
+		period string
+		maxID  int64
+	}{
+		{"biztag1", "20261018", 3001},
+		{"biztag1", "20261019", 1001},
+		// 周期切换时还在分配的旧周期号段不再记录
+		{"biztag1", "20261018", 4001},
+		{"biztag1", "", 5001},
+		{"biztag10", "20261018", 2001},
+	}
+	for _, a := range advances {
+		if err := g.advance(a.biztag, a.period, a.maxID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	floors, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"biztag1/20261019": 1001, "biztag1": 5001, "biztag10/20261018": 2001}
+	if len(floors) != len(want) {
+		t.Fatalf("floors = %v, want %v", floors, want)
+	}
+	for k, v := range want {
+		if floors[k] != v {
+			t.Fatalf("floors = %v, want %v", floors, want)
+		}
+	}
+}
@@ -2,114 +2,286 @@ package segment
 
 import (
 	"context"
+	"errors"
+	"expvar"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	lowWaterTotal     = expvar.NewMap("segment_low_water_total")
+	emergencyIDsTotal = expvar.NewMap("segment_emergency_ids_total")
 )
 
+// MaxStep 频繁获取号段时step最多增大到MaxStep
+const MaxStep = 1000000
+
 type generator struct {
-	svc        *Service
-	biztag     string
-	waits      chan *Segment
-	next       chan int64
-	closed     int32
-	inited     int32
-	closeC     chan struct{}
-	minStep    int32
-	curStep    int32
+	svc    *Service
+	biztag string
+	period string            // 为空表示不按周期重置
+	waits  chan updateResult // updater返回的新号段
+	closed int32
+	closeC chan struct{}
+
+	mu         sync.Mutex
+	cur        int64    // 当前号段中下一个可用的ID
+	end        int64    // 当前号段的结束位置, 不包含
+	pct75      int64    // 使用到这里时预取下一个号段
+	next       *Segment // 预取的号段
+	loading    bool     // 正在获取新的号段
+	ready      *segmentLoad
+	step       int32 // 当前号段的step
+	curStep    int32 // 下次获取号段使用的step
 	lastUpdate time.Time
 	total      int64
+
+	lowWater bool // 已经发出剩余ID不足的告警
+	// 降级模式下使用的预留号段, 上一次获取号段失败时使用
+	ecur     int64
+	eend     int64
+	degraded bool
+	eLogged  bool
 }
 
-func newGenerator(svc *Service, biztag string, waits chan *Segment) *generator {
+// 一次获取号段的结果, done关闭之后err不再改变
+type segmentLoad struct {
+	done chan struct{}
+	err  error
+}
+
+func newSegmentLoad() *segmentLoad {
+	return &segmentLoad{done: make(chan struct{})}
+}
+
+func newGenerator(svc *Service, biztag, period string, waits chan updateResult) *generator {
 	return &generator{
-		biztag: biztag,
-		waits:  waits,
-		next:   make(chan int64, 100),
-		svc:    svc,
-		closeC: make(chan struct{}),
+		biztag:     biztag,
+		period:     period,
+		waits:      waits,
+		svc:        svc,
+		closeC:     make(chan struct{}),
+		ready:      newSegmentLoad(),
+		lastUpdate: time.Now(),
 	}
 }
 
-func (g *generator) get(ctx context.Context) (int64, error) {
-	if atomic.LoadInt32(&g.closed) != 0 {
-		return 0, ErrClosed
+// 根据上次获取号段的时间调整step, 调用者需要持有锁
+func (g *generator) adjustStep() {
+	now := time.Now()
+	duration := now.Sub(g.lastUpdate)
+	g.svc.logger.Infow("Updating", "biztag", g.biztag, "period", g.period,
+		"cur", g.cur, "end", g.end, "pct75", g.pct75, "step", g.curStep, "duration", duration)
+	if duration <= 10*time.Minute {
+		// 少于十分钟增大step
+		step := g.step * 2
+		if step > MaxStep {
+			step = MaxStep
+		}
+		g.curStep = step
+	} else if duration >= 20*time.Minute {
+		// 超过20分钟减小step
+		step := g.curStep / 2
+		if step < g.step {
+			step = g.step
+		}
+		g.curStep = step
+	} else {
+		g.curStep = g.step
 	}
-	// 第一次获取可能会有些延时
-	if atomic.CompareAndSwapInt32(&g.inited, 0, 1) {
-		g.svc.notifyUpdate(g.biztag, g.curStep, g.waits)
-		g.lastUpdate = time.Now()
+	g.lastUpdate = now
+}
+
+// 切换到预取的号段, 调用者需要持有锁
+func (g *generator) switchSegment() {
+	seg := g.next
+	g.next = nil
+	g.step = seg.Step
+	g.cur = seg.MaxID - int64(seg.Step)
+	g.end = seg.MaxID
+	g.pct75 = int64(float64(seg.Step)*0.75 + float64(g.cur))
+	g.lowWater = false
+}
+
+// 下一个号段还没有获取到并且剩余的ID少于step*lowWater时告警, 调用者需要持有锁
+func (g *generator) checkLowWater() {
+	ratio := g.svc.opts.lowWater
+	if ratio <= 0 || g.lowWater || g.next != nil || g.end-g.cur >= int64(float64(g.step)*ratio) {
+		return
 	}
-	select {
-	case id, ok := <-g.next:
-		if !ok {
-			return 0, ErrClosed
-		}
-		return id, nil
-	case <-ctx.Done():
-		return 0, ctx.Err()
+	g.lowWater = true
+	lowWaterTotal.Add(g.biztag, 1)
+	g.svc.logger.Warnw("Segment running low", "biztag", g.biztag, "period", g.period,
+		"remaining", g.end-g.cur, "step", g.step, "loading", g.loading)
+}
+
+// 获取号段时需要同时预留的号段大小, 调用者需要持有锁
+func (g *generator) reserveSize() int32 {
+	if g.period != "" || g.ecur < g.eend {
+		return 0
 	}
+	return g.svc.opts.emergencySize
 }
 
-func (g *generator) buildOneSegment(seg *Segment) {
-	if g.minStep == 0 {
-		g.minStep = seg.Step
+// 从预留号段中取出最多n个ID, 调用者需要持有锁
+func (g *generator) takeEmergency(n int64) (start, end int64, ok bool) {
+	if g.ecur >= g.eend {
+		if g.eLogged {
+			g.eLogged = false
+			g.svc.logger.Errorw("Segment emergency range exhausted", "biztag", g.biztag)
+		}
+		return 0, 0, false
 	}
-	start := seg.MaxID - int64(seg.Step)
-	end := seg.MaxID
-	pct75 := int64(float64(seg.Step)*0.75 + float64(start))
-
-	for i := start; i < end; i++ {
-		if i == pct75 { // 使用超过65%时，通知updater获取新号段
-			now := time.Now()
-			duration := now.Sub(g.lastUpdate)
-			g.svc.logger.Infow("Updating", "biztag", g.biztag,
-				"start", start, "end", end, "pct75", pct75, "step", g.curStep, "duration", duration)
-			if duration <= 10*time.Minute {
-				// 少于五分钟增大step
-				step := seg.Step * 2
-				if step > 1000000 {
-					step = 1000000
-				}
-				g.curStep = step
-			} else if duration >= 20*time.Minute {
-				// 超过20分钟减小step
-				step := g.curStep / 2
-				if step < seg.Step {
-					step = seg.Step
+	start = g.ecur
+	end = start + n
+	if end > g.eend {
+		end = g.eend
+	}
+	g.ecur = end
+	if !g.eLogged {
+		g.eLogged = true
+		g.svc.logger.Warnw("Segment degraded, serving from emergency range",
+			"biztag", g.biztag, "start", start, "remaining", g.eend-start)
+	}
+	emergencyIDsTotal.Add(g.biztag, end-start)
+	return start, end, true
+}
+
+// 从当前号段中取出最多n个连续的ID, 当前号段用完时切换到预取的号段
+func (g *generator) take(ctx context.Context, n int64) (start, end int64, err error) {
+	for {
+		if atomic.LoadInt32(&g.closed) != 0 {
+			return 0, 0, ErrClosed
+		}
+		g.mu.Lock()
+		if g.cur >= g.end && g.next != nil {
+			g.switchSegment()
+		}
+		if g.cur < g.end {
+			start = g.cur
+			end = start + n
+			if end > g.end {
+				end = g.end
+			}
+			g.cur = end
+			// 使用超过75%时，通知updater获取新号段
+			update := !g.loading && g.next == nil && end > g.pct75
+			if update {
+				g.loading = true
+				g.adjustStep()
+			}
+			g.checkLowWater()
+			if g.total/1000000 != (g.total+end-start)/1000000 {
+				g.svc.logger.Infow("Generated", "biztag", g.biztag, "curid", end-1, "total", g.total+end-start)
+			}
+			g.total += end - start
+			step, reserve := g.curStep, g.reserveSize()
+			g.mu.Unlock()
+			if update {
+				g.svc.notifyUpdate(ctx, g.biztag, g.period, step, reserve, g.waits)
+			}
+			return start, end, nil
+		}
+		// 没有可用的号段, 第一次获取可能会有些延时
+		update := !g.loading
+		g.loading = true
+		step, reserve := g.curStep, g.reserveSize()
+		ready := g.ready
+		if g.degraded {
+			// 数据库不可用时直接使用预留号段, 同时在后台重新获取号段
+			start, end, ok := g.takeEmergency(n)
+			g.mu.Unlock()
+			if update {
+				g.svc.notifyUpdate(ctx, g.biztag, g.period, step, reserve, g.waits)
+			}
+			if ok {
+				return start, end, nil
+			}
+		} else {
+			g.mu.Unlock()
+			if update {
+				g.svc.notifyUpdate(ctx, g.biztag, g.period, step, reserve, g.waits)
+			}
+		}
+		if err = g.wait(ctx, ready); err != nil {
+			var updateErr *UpdateError
+			if errors.As(err, &updateErr) {
+				g.mu.Lock()
+				start, end, ok := g.takeEmergency(n)
+				g.mu.Unlock()
+				if ok {
+					return start, end, nil
 				}
-				g.curStep = step
-			} else {
-				g.curStep = seg.Step
 			}
-			g.svc.notifyUpdate(g.biztag, g.curStep, g.waits)
-			g.lastUpdate = time.Now()
+			return 0, 0, err
 		}
-		select {
-		case <-g.closeC: // FIXME:
-			return
-		case g.next <- i:
+	}
+}
+
+// 等待新的号段
+func (g *generator) wait(ctx context.Context, ready *segmentLoad) (err error) {
+	_, span := tracer().Start(ctx, "segment.wait", trace.WithAttributes(
+		attribute.String("biztag", g.biztag), attribute.String("period", g.period)))
+	defer func() { endSpan(span, err) }()
+	select {
+	case <-ready.done:
+		return ready.err
+	case <-g.closeC:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 获取count个ID, 尽量使用连续的范围
+func (g *generator) getRanges(ctx context.Context, count int) (ranges []Range, err error) {
+	for remain := int64(count); remain > 0; {
+		start, end, err := g.take(ctx, remain)
+		if err != nil {
+			return nil, err
 		}
-		g.total++
-		if g.total%1000000 == 0 {
-			g.svc.logger.Infow("Generated", "biztag", g.biztag, "curid", i, "total", g.total)
+		remain -= end - start
+		// 相邻的号段合并为一个范围
+		if n := len(ranges); n > 0 && ranges[n-1].End == start {
+			ranges[n-1].End = end
+			continue
 		}
+		ranges = append(ranges, Range{Start: start, End: end, Period: g.period})
 	}
+	return ranges, nil
 }
 
-// 每个biztag使用一个单独的routine负责
+// 每个biztag使用一个单独的routine负责接收新的号段
 func (g *generator) run() {
-	defer func() {
-		close(g.next)
-	}()
 	for {
 		select {
 		case <-g.closeC:
 			return
-		case item, ok := <-g.waits:
+		case res, ok := <-g.waits:
 			if !ok {
 				return
 			}
-			g.buildOneSegment(item)
+			g.mu.Lock()
+			g.next = res.seg
+			g.loading = false
+			g.degraded = res.err != nil
+			if !g.degraded {
+				g.eLogged = false
+			}
+			if seg := res.emergency; seg != nil {
+				g.ecur = seg.MaxID - int64(seg.Step)
+				g.eend = seg.MaxID
+				g.svc.logger.Infow("Segment emergency range reserved", "biztag", g.biztag, "start", g.ecur, "end", g.eend)
+			}
+			// 唤醒等待号段的请求, 获取失败时返回错误, 下一个请求重新获取
+			g.ready.err = res.err
+			close(g.ready.done)
+			g.ready = newSegmentLoad()
+			g.mu.Unlock()
 		}
 	}
 }
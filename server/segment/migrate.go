@@ -0,0 +1,335 @@
+package segment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	schemaTable = "segment_schema_migrations"
+	// 多个节点同时执行迁移时只有一个执行
+	migrateLock        = "gleafd_segment_migrate"
+	migrateLockTimeout = 30
+
+	mysqlErrNoSuchTable = 1146
+)
+
+var (
+	// ErrIrreversible 迁移没有Down, 撤销会丢失数据
+	ErrIrreversible = errors.New("segment migration is irreversible")
+	// ErrDataLoss Down删除的表中有数据
+	ErrDataLoss = errors.New("segment migration would drop tables with rows")
+)
+
+// Migration 一个版本的表结构变更, Down撤销Up, 为空时不能撤销。
+// Tables为Down删除的表, 有数据时只有force才执行Down
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+	Tables  []string
+}
+
+// MigrationStatus 没有执行时Applied为零值
+type MigrationStatus struct {
+	Migration
+	Applied time.Time
+}
+
+// SchemaError 数据库中的版本与程序需要的版本不一致。
+// Unversioned为true时表由旧版本自动创建, 还没有记录版本
+type SchemaError struct {
+	Version     int
+	Latest      int
+	Unversioned bool
+}
+
+func (e *SchemaError) Error() string {
+	if e.Unversioned {
+		return fmt.Sprintf("segment tables have no schema version, want %d, run 'gleafd migrate up' to record it", e.Latest)
+	}
+	return fmt.Sprintf("segment schema version %d, want %d, run 'gleafd migrate up'", e.Version, e.Latest)
+}
+
+// 版本号从1开始连续递增, 已经发布的迁移不能修改。
+// segments不能删除, 删除之后会丢失已经分配的max_id, 重新创建之后会发放重复的ID
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create segments",
+		Up: []string{"CREATE TABLE IF NOT EXISTS `segments`(" +
+			"	`biz_tag` VARCHAR(128) NOT NULL DEFAULT ''," +
+			"	`max_id` 	BIGINT(20) NOT NULL DEFAULT '1'," +
+			"	`step` 	INT(11) NOT NULL," +
+			"	`desc` 	VARCHAR(256)  DEFAULT NULL," +
+			"	`updated` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP," +
+			"	PRIMARY KEY (`biz_tag`)" +
+			");",
+			"INSERT IGNORE INTO `segments`(`biz_tag`,`step`,`desc`) VALUES('example', 1000, 'gleafd example')"},
+	},
+	{
+		Version: 2,
+		Name:    "create segment_periods",
+		Up: []string{"CREATE TABLE IF NOT EXISTS `segment_periods`(" +
+			"	`biz_tag` VARCHAR(128) NOT NULL," +
+			"	`period` 	VARCHAR(32) NOT NULL," +
+			"	`max_id` 	BIGINT(20) NOT NULL DEFAULT '1'," +
+			"	`updated` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP," +
+			"	PRIMARY KEY (`biz_tag`, `period`)" +
+			");"},
+		Down:   []string{"DROP TABLE IF EXISTS `segment_periods`"},
+		Tables: []string{"segment_periods"},
+	},
+	{
+		Version: 3,
+		Name:    "create segment_leases",
+		Up: []string{"CREATE TABLE IF NOT EXISTS `segment_leases`(" +
+			"	`id` BIGINT(20) NOT NULL AUTO_INCREMENT," +
+			"	`biz_tag` VARCHAR(128) NOT NULL," +
+			"	`period` 	VARCHAR(32) NOT NULL DEFAULT ''," +
+			"	`start_id` BIGINT(20) NOT NULL," +
+			"	`end_id` 	BIGINT(20) NOT NULL," +
+			"	`client` 	VARCHAR(256) NOT NULL DEFAULT ''," +
+			"	`created` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+			"	PRIMARY KEY (`id`)," +
+			"	KEY `idx_biz_tag` (`biz_tag`, `start_id`)" +
+			");"},
+		Down:   []string{"DROP TABLE IF EXISTS `segment_leases`"},
+		Tables: []string{"segment_leases"},
+	},
+}
+
+// Migrator 按版本执行表结构变更, 已经执行的版本记录在segment_schema_migrations中。
+// 旧版本自动创建的表使用IF NOT EXISTS, 第一次执行Up时只记录版本
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Latest 程序需要的版本
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// 已经执行的版本, 版本表不存在时为空。只读, 不执行DDL
+func (m *Migrator) applied(ctx context.Context, q queryer) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, "SELECT `version`,`applied` FROM `"+schemaTable+"`")
+	if err != nil {
+		var myErr *mysql.MySQLError
+		if errors.As(err, &myErr) && myErr.Number == mysqlErrNoSuchTable {
+			return map[int]time.Time{}, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			ts      time.Time
+		)
+		if err = rows.Scan(&version, &ts); err != nil {
+			return nil, err
+		}
+		applied[version] = ts
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) status(applied map[int]time.Time) []MigrationStatus {
+	status := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		status = append(status, MigrationStatus{Migration: mig, Applied: applied[mig.Version]})
+	}
+	return status
+}
+
+// 已经执行的最大版本
+func version(applied map[int]time.Time) int {
+	v := 0
+	for version := range applied {
+		if version > v {
+			v = version
+		}
+	}
+	return v
+}
+
+// Status 返回所有迁移的执行状态
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	return m.status(applied), nil
+}
+
+// 没有版本表时segments是否已经存在, 旧版本启动时自动创建表
+func (m *Migrator) unversioned(ctx context.Context) (bool, error) {
+	var n int
+	q := "SELECT COUNT(*) FROM information_schema.tables WHERE `table_schema`=DATABASE() AND `table_name`='segments'"
+	if err := m.db.QueryRowContext(ctx, q).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Check 数据库中的版本与Latest不一致, 或者有没有执行的迁移时返回SchemaError
+func (m *Migrator) Check(ctx context.Context) error {
+	applied, err := m.applied(ctx, m.db)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		unversioned, err := m.unversioned(ctx)
+		if err != nil {
+			return err
+		}
+		if unversioned {
+			return &SchemaError{Latest: m.Latest(), Unversioned: true}
+		}
+	}
+	v := version(applied)
+	if v != m.Latest() || len(applied) != len(m.migrations) {
+		return &SchemaError{Version: v, Latest: m.Latest()}
+	}
+	return nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// 使用同一个连接加锁和执行迁移, 返回的函数释放锁和连接
+func (m *Migrator) lock(ctx context.Context) (*sql.Conn, func(), error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ok sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrateLock, migrateLockTimeout).Scan(&ok); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if ok.Int64 != 1 {
+		conn.Close()
+		return nil, nil, errors.New("segment migration is running on another node")
+	}
+	return conn, func() {
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrateLock)
+		conn.Close()
+	}, nil
+}
+
+// Up 按版本执行所有没有执行的迁移, 返回本次执行的迁移
+func (m *Migrator) Up(ctx context.Context) (done []Migration, err error) {
+	conn, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	q := "CREATE TABLE IF NOT EXISTS `" + schemaTable + "`(" +
+		"	`version` INT(11) NOT NULL," +
+		"	`name` 	VARCHAR(128) NOT NULL DEFAULT ''," +
+		"	`applied` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"	PRIMARY KEY (`version`)" +
+		");"
+	if _, err = conn.ExecContext(ctx, q); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		// MySQL的DDL会隐式提交, 失败时需要手动处理已经执行的语句
+		for _, stmt := range mig.Up {
+			if _, err = conn.ExecContext(ctx, stmt); err != nil {
+				return done, fmt.Errorf("migrate up %d %s: %v", mig.Version, mig.Name, err)
+			}
+		}
+		q = "INSERT INTO `" + schemaTable + "`(`version`,`name`) VALUES(?,?)"
+		if _, err = conn.ExecContext(ctx, q, mig.Version, mig.Name); err != nil {
+			return done, err
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// 表中是否有数据
+func hasRows(ctx context.Context, conn *sql.Conn, table string) (bool, error) {
+	var n int
+	err := conn.QueryRowContext(ctx, "SELECT 1 FROM `"+table+"` LIMIT 1").Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == mysqlErrNoSuchTable {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Down 撤销最后执行的一个迁移, 没有执行过的迁移时返回nil, 迁移不能撤销时返回ErrIrreversible。
+// 删除的表中有数据并且force为false时返回ErrDataLoss
+func (m *Migrator) Down(ctx context.Context, force bool) (*Migration, error) {
+	conn, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	v := version(applied)
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version != v {
+			continue
+		}
+		if len(mig.Down) == 0 {
+			return nil, fmt.Errorf("migrate down %d %s: %w", mig.Version, mig.Name, ErrIrreversible)
+		}
+		for i := 0; i < len(mig.Tables) && !force; i++ {
+			rows, err := hasRows(ctx, conn, mig.Tables[i])
+			if err != nil {
+				return nil, err
+			}
+			if rows {
+				return nil, fmt.Errorf("migrate down %d %s: %w: %s", mig.Version, mig.Name, ErrDataLoss, mig.Tables[i])
+			}
+		}
+		for _, stmt := range mig.Down {
+			if _, err = conn.ExecContext(ctx, stmt); err != nil {
+				return nil, fmt.Errorf("migrate down %d %s: %v", mig.Version, mig.Name, err)
+			}
+		}
+		q := "DELETE FROM `" + schemaTable + "` WHERE `version`=?"
+		if _, err = conn.ExecContext(ctx, q, mig.Version); err != nil {
+			return nil, err
+		}
+		return &mig, nil
+	}
+	if v != 0 {
+		return nil, &SchemaError{Version: v, Latest: m.Latest()}
+	}
+	return nil, nil
+}
@@ -0,0 +1,42 @@
+package segment
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMigrations(t *testing.T) {
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			t.Fatalf("migrations[%d].Version = %d, want = %d", i, mig.Version, i+1)
+		}
+		if mig.Name == "" || len(mig.Up) == 0 {
+			t.Fatalf("migrations[%d] = %+v, want name and up", i, mig)
+		}
+		// segments不能删除, 其它迁移可以撤销
+		if irreversible := len(mig.Down) == 0; irreversible != (mig.Version == 1) {
+			t.Fatalf("migrations[%d].Down = %v", i, mig.Down)
+		}
+	}
+}
+
+func TestMigratorStatus(t *testing.T) {
+	m := &Migrator{migrations: migrations}
+	ts := time.Now()
+	applied := map[int]time.Time{1: ts, 2: ts}
+	if v := version(applied); v != 2 {
+		t.Fatalf("version = %d, want = 2", v)
+	}
+	status := m.status(applied)
+	if len(status) != len(migrations) {
+		t.Fatalf("len(status) = %d, want = %d", len(status), len(migrations))
+	}
+	for _, s := range status {
+		if pending := s.Applied.IsZero(); pending != (s.Version > 2) {
+			t.Fatalf("status %d applied = %v", s.Version, s.Applied)
+		}
+	}
+	if v := version(map[int]time.Time{}); v != 0 {
+		t.Fatalf("version = %d, want = 0", v)
+	}
+}
@@ -0,0 +1,121 @@
+package segment
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	BizTagCreated = "created"
+	BizTagUpdated = "updated" // 丢弃已经缓存的号段
+	BizTagDeleted = "deleted"
+
+	notifierPingInterval = 30 * time.Second
+)
+
+// BizTagEvent biztag的变更通知, 收到之后从仓储读取biztag的最新状态, 事件只作为提示
+type BizTagEvent struct {
+	Type   string `json:"type"`
+	BizTag string `json:"biztag"`
+}
+
+// Notifier 在所有节点之间广播biztag的变更
+type Notifier interface {
+	Publish(ctx context.Context, ev BizTagEvent) error
+	// Subscribe 返回的channel在ctx取消或者连接断开时关闭, 之后需要重新订阅
+	Subscribe(ctx context.Context) (<-chan BizTagEvent, error)
+}
+
+type redisNotifier struct {
+	pool    *redis.Pool
+	channel string
+}
+
+// NewRedisNotifier 使用redis pub/sub广播, cluster模式下PUBLISH会转发到所有节点
+func NewRedisNotifier(pool *redis.Pool, channel string) Notifier {
+	return &redisNotifier{pool: pool, channel: channel}
+}
+
+func (n *redisNotifier) Publish(ctx context.Context, ev BizTagEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	conn := n.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", n.channel, data)
+	return err
+}
+
+func (n *redisNotifier) Subscribe(ctx context.Context) (<-chan BizTagEvent, error) {
+	psc := redis.PubSubConn{Conn: n.pool.Get()}
+	if err := psc.Subscribe(n.channel); err != nil {
+		psc.Close()
+		return nil, err
+	}
+	// 等待订阅成功
+	for subscribed := false; !subscribed; {
+		switch v := psc.Receive().(type) {
+		case error:
+			psc.Close()
+			return nil, v
+		case redis.Subscription:
+			subscribed = v.Kind == "subscribe"
+		}
+	}
+	events := make(chan BizTagEvent, 16)
+	done, writerDone := make(chan struct{}), make(chan struct{})
+	// 定期ping检查连接, ctx取消时退订, Receive随之返回。
+	// 连接不支持并发写, 等待这个goroutine退出之后才能关闭连接
+	go func() {
+		defer close(writerDone)
+		t := time.NewTicker(notifierPingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				psc.Unsubscribe()
+				<-done
+				return
+			case <-t.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer close(events)
+		defer func() {
+			close(done)
+			<-writerDone
+			psc.Close()
+		}()
+		for {
+			switch v := psc.Receive().(type) {
+			case error:
+				return
+			case redis.Subscription:
+				if v.Count == 0 {
+					return
+				}
+			case redis.Message:
+				var ev BizTagEvent
+				if err := json.Unmarshal(v.Data, &ev); err != nil || ev.BizTag == "" {
+					continue
+				}
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,112 @@
+package segment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+type chanNotifier struct {
+	events chan BizTagEvent
+}
+
+func (n *chanNotifier) Publish(ctx context.Context, ev BizTagEvent) error {
+	n.events <- ev
+	return nil
+}
+
+func (n *chanNotifier) Subscribe(ctx context.Context) (<-chan BizTagEvent, error) {
+	events := make(chan BizTagEvent)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case ev := <-n.events:
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func waitBizTag(t *testing.T, svc *Service, biztag string, exists bool) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := svc.findGenerator(biztag)
+		if (err == nil) == exists {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("biztag %s exists = %v, want = %v", biztag, err == nil, exists)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServiceBizTagEvents(t *testing.T) {
+	ts := time.Now()
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", ts}}}
+	n := &chanNotifier{events: make(chan BizTagEvent, 1)}
+	svc := NewService(repo, log.DefaultLogger, WithNotifier(n), WithPollInterval(time.Hour))
+	defer svc.Close()
+
+	repo.Lock()
+	repo.segs = append(repo.segs, &Segment{"biztag2", 1, 10, "", ts})
+	repo.Unlock()
+	n.Publish(context.Background(), BizTagEvent{Type: BizTagCreated, BizTag: "biztag2"})
+	waitBizTag(t, svc, "biztag2", true)
+	if _, err := svc.Get(context.Background(), "biztag2", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 事件只作为提示, 仓储中仍然存在的biztag不会删除
+	n.Publish(context.Background(), BizTagEvent{Type: BizTagDeleted, BizTag: "biztag1"})
+	repo.Lock()
+	repo.segs = repo.segs[:1]
+	repo.Unlock()
+	n.Publish(context.Background(), BizTagEvent{Type: BizTagDeleted, BizTag: "biztag2"})
+	waitBizTag(t, svc, "biztag2", false)
+	if _, err := svc.Get(context.Background(), "biztag2", 1); err != ErrBizTagNotFound {
+		t.Fatalf("err = %v, want = %v", err, ErrBizTagNotFound)
+	}
+	waitBizTag(t, svc, "biztag1", true)
+}
+
+func TestServiceBizTagUpdated(t *testing.T) {
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", time.Now()}}}
+	n := &chanNotifier{events: make(chan BizTagEvent, 1)}
+	svc := NewService(repo, log.DefaultLogger, WithNotifier(n), WithPollInterval(time.Hour))
+	defer svc.Close()
+	ids, err := svc.Get(context.Background(), "biztag1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := svc.findGenerator("biztag1")
+
+	// 修改max_id之后丢弃缓存的号段
+	repo.Lock()
+	repo.segs[0].MaxID = 1000
+	repo.Unlock()
+	n.Publish(context.Background(), BizTagEvent{Type: BizTagUpdated, BizTag: "biztag1"})
+	deadline := time.Now().Add(time.Second)
+	for g, _ := svc.findGenerator("biztag1"); g == old; g, _ = svc.findGenerator("biztag1") {
+		if time.Now().After(deadline) {
+			t.Fatal("generator not reset")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err = old.getRanges(context.Background(), 1); err != ErrClosed {
+		t.Fatalf("err = %v, want = %v", err, ErrClosed)
+	}
+	if ids, err = svc.Get(context.Background(), "biztag1", 1); err != nil || ids[0] < 1000 {
+		t.Fatalf("ids = %v, err = %v, want >= 1000", ids, err)
+	}
+}
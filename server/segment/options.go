@@ -0,0 +1,94 @@
+package segment
+
+import "time"
+
+type Options struct {
+	// 按周期重置序列号的biztags
+	periods map[string]*Period
+	// 每次调用仓储的超时时间
+	callTimeout time.Duration
+	// 可以重试的错误最多重试的次数和第一次重试前等待的时间
+	retries      int
+	retryBackoff time.Duration
+	// 下一个号段还没有获取到并且剩余的ID少于step*lowWater时告警
+	lowWater float64
+	// 降级模式预留的号段大小, 0表示不预留
+	emergencySize int32
+	// 广播biztag的变更, 为空时只定期全量更新
+	notifier     Notifier
+	pollInterval time.Duration
+	// 检查仓储中的biztag能否通过接口访问, 不能访问时输出告警
+	validateBizTag func(biztag string) error
+}
+
+func newDefaultOptions() *Options {
+	return &Options{
+		callTimeout:  3 * time.Second,
+		retries:      3,
+		retryBackoff: 100 * time.Millisecond,
+		pollInterval: time.Minute,
+	}
+}
+
+type Option func(opts *Options)
+
+// WithPeriods 设置按周期重置序列号的biztags, key为biztag
+func WithPeriods(periods map[string]*Period) Option {
+	return func(opts *Options) {
+		opts.periods = periods
+	}
+}
+
+// WithBizTagValidator 加载biztag时使用validate检查, 不符合接口要求的biztag仍然加载, 同时输出告警日志
+func WithBizTagValidator(validate func(biztag string) error) Option {
+	return func(opts *Options) {
+		opts.validateBizTag = validate
+	}
+}
+
+// WithCallTimeout 设置每次调用仓储的超时时间, 0表示不限制
+func WithCallTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.callTimeout = timeout
+	}
+}
+
+// WithRetries 设置连接断开, 超时和死锁等错误最多重试的次数, 重试间隔从backoff开始每次加倍
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(opts *Options) {
+		opts.retries = retries
+		opts.retryBackoff = backoff
+	}
+}
+
+// WithLowWater 下一个号段还没有获取到并且当前号段剩余的ID少于step*ratio时输出告警日志
+func WithLowWater(ratio float64) Option {
+	return func(opts *Options) {
+		opts.lowWater = ratio
+	}
+}
+
+// WithNotifier 收到biztag的变更通知时立即创建或者删除generator
+func WithNotifier(n Notifier) Option {
+	return func(opts *Options) {
+		opts.notifier = n
+	}
+}
+
+// WithPollInterval 设置全量更新biztags的间隔, 使用Notifier时作为补充
+func WithPollInterval(interval time.Duration) Option {
+	return func(opts *Options) {
+		if interval > 0 {
+			opts.pollInterval = interval
+		}
+	}
+}
+
+// WithEmergencyRange 获取号段时同时为每个biztag预留size个ID。
+// 获取号段失败时使用预留的ID继续发放, 用完之后立即返回错误。
+// 预留的ID小于当前号段, 降级期间ID不再递增。按周期重置的biztags不预留
+func WithEmergencyRange(size int32) Option {
+	return func(opts *Options) {
+		opts.emergencySize = size
+	}
+}
@@ -0,0 +1,76 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+	PeriodYearly  = "yearly"
+)
+
+var (
+	ErrPeriodExpired = errors.New("period expired")
+)
+
+// Period 序列号的重置周期, 每个周期开始时序列号从1重新开始
+type Period struct {
+	unit   string
+	layout string
+	loc    *time.Location
+}
+
+// NewPeriod unit为daily|monthly|yearly, timezone为IANA时区名称, 为空时使用本地时区
+func NewPeriod(unit, timezone string) (*Period, error) {
+	p := &Period{unit: unit, loc: time.Local}
+	switch unit {
+	case PeriodDaily:
+		p.layout = "20060102"
+	case PeriodMonthly:
+		p.layout = "200601"
+	case PeriodYearly:
+		p.layout = "2006"
+	default:
+		return nil, fmt.Errorf("unknown segment period: %s", unit)
+	}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+		p.loc = loc
+	}
+	return p, nil
+}
+
+// Key 返回t所在周期的标识, 例如daily为20261017
+func (p *Period) Key(t time.Time) string {
+	return t.In(p.loc).Format(p.layout)
+}
+
+// In 返回t在周期时区中的时间
+func (p *Period) In(t time.Time) time.Time {
+	return t.In(p.loc)
+}
+
+// Unit 返回daily|monthly|yearly
+func (p *Period) Unit() string {
+	return p.unit
+}
+
+// Equal 周期和时区都相同时返回true
+func (p *Period) Equal(o *Period) bool {
+	return o != nil && p.unit == o.unit && p.loc.String() == o.loc.String()
+}
+
+func (p *Period) String() string {
+	return fmt.Sprintf("%s(%s)", p.unit, p.loc)
+}
+
+// 相同格式的周期标识可以直接比较大小
+func periodBefore(a, b string) bool {
+	return len(a) == len(b) && a < b
+}
@@ -0,0 +1,231 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	RegionInterleave = "interleave"
+	RegionPrefix     = "prefix"
+)
+
+var (
+	ErrRegionExhausted = errors.New("segment region id space exhausted")
+	// interleave模式下号段的step或者租用的size大于block
+	ErrRegionBlockTooSmall = errors.New("segment region block is smaller than the step")
+	// 号段连续多次跨越块的边界, 映射之后的ID数量少于step
+	ErrRegionTruncated = errors.New("segment truncated at the region block boundary")
+)
+
+// 号段跨越块的边界时重新分配的次数
+const regionRetries = 3
+
+// Region 多个数据中心各自使用独立的segments表时, 将本地分配的序列号映射到互不重叠的ID空间。
+//
+// interleave: 本地序列号按block分块, 第k块映射到[(k*stride+offset)*block, (k*stride+offset+1)*block),
+// 每个数据中心使用相同的stride和block, 不同的offset。
+//
+// prefix: ID的高位为prefix, 低bits位为本地序列号
+type Region struct {
+	mode   string
+	offset int64
+	stride int64
+	block  int64
+	prefix int64
+	bits   uint
+}
+
+// NewInterleavedRegion 0 <= offset < stride, block不能小于号段的step和租用的size, 应当远大于step。
+// 号段跨越块的边界时丢弃前一块中的部分并重新分配
+func NewInterleavedRegion(offset, stride, block int64) (*Region, error) {
+	if stride <= 0 || offset < 0 || offset >= stride {
+		return nil, fmt.Errorf("invalid segment region offset %d and stride %d", offset, stride)
+	}
+	if block <= 0 {
+		return nil, fmt.Errorf("invalid segment region block %d", block)
+	}
+	return &Region{mode: RegionInterleave, offset: offset, stride: stride, block: block}, nil
+}
+
+// NewPrefixRegion ID的最高位保持为0, prefix最多占用63-bits位
+func NewPrefixRegion(prefix int64, bits uint) (*Region, error) {
+	if bits == 0 || bits > 62 {
+		return nil, fmt.Errorf("invalid segment region bits %d", bits)
+	}
+	if prefix < 0 || prefix >= int64(1)<<(63-bits) {
+		return nil, fmt.Errorf("invalid segment region prefix %d for %d bits", prefix, bits)
+	}
+	return &Region{mode: RegionPrefix, prefix: prefix, bits: bits}, nil
+}
+
+func (r *Region) String() string {
+	if r.mode == RegionPrefix {
+		return fmt.Sprintf("prefix(%d, %d bits)", r.prefix, r.bits)
+	}
+	return fmt.Sprintf("interleave(%d/%d, block %d)", r.offset, r.stride, r.block)
+}
+
+// CheckSize 检查size个连续的ID能否映射到region中, interleave模式下size不能大于block
+func (r *Region) CheckSize(size int64) error {
+	if r.mode == RegionPrefix {
+		if size > int64(1)<<r.bits {
+			return fmt.Errorf("%w: size %d > %d", ErrRegionExhausted, size, int64(1)<<r.bits)
+		}
+		return nil
+	}
+	if size > r.block {
+		return fmt.Errorf("%w: %d > block %d", ErrRegionBlockTooSmall, size, r.block)
+	}
+	return nil
+}
+
+// 本地序列号n对应的ID
+func (r *Region) id(n int64) (int64, error) {
+	if r.mode == RegionPrefix {
+		if n >= int64(1)<<r.bits {
+			return 0, ErrRegionExhausted
+		}
+		return r.prefix<<r.bits | n, nil
+	}
+	k := n / r.block
+	if k > (math.MaxInt64/r.block-r.offset-1)/r.stride {
+		return 0, ErrRegionExhausted
+	}
+	return (k*r.stride+r.offset)*r.block + n%r.block, nil
+}
+
+// 映射本地号段[MaxID-Step, MaxID), interleave模式只保留最后一块中的部分, 映射之后的ID仍然连续
+func (r *Region) mapSegment(seg *Segment) (*Segment, error) {
+	if err := r.CheckSize(int64(seg.Step)); err != nil {
+		return nil, err
+	}
+	lo, hi := seg.MaxID-int64(seg.Step), seg.MaxID
+	if r.mode == RegionPrefix {
+		if hi > int64(1)<<r.bits {
+			return nil, ErrRegionExhausted
+		}
+	} else if start := (hi - 1) / r.block * r.block; start > lo {
+		lo = start
+	}
+	start, err := r.id(lo)
+	if err != nil {
+		return nil, err
+	}
+	mapped := *seg
+	mapped.MaxID = start + hi - lo
+	mapped.Step = int32(hi - lo)
+	return &mapped, nil
+}
+
+// 只映射MaxID, 用于查询
+func (r *Region) mapMaxID(seg *Segment) (*Segment, error) {
+	if seg.MaxID <= 0 {
+		return seg, nil
+	}
+	id, err := r.id(seg.MaxID - 1)
+	if err != nil {
+		return nil, err
+	}
+	mapped := *seg
+	mapped.MaxID = id + 1
+	return &mapped, nil
+}
+
+type regionRepository struct {
+	Repository
+	region  *Region
+	biztags map[string]*Region
+}
+
+// NewRegionRepository 按region映射repo分配的号段, biztags中的配置优先于region, 都为nil时不映射
+func NewRegionRepository(repo Repository, region *Region, biztags map[string]*Region) Repository {
+	if region == nil && len(biztags) == 0 {
+		return repo
+	}
+	return &regionRepository{Repository: repo, region: region, biztags: biztags}
+}
+
+func (r *regionRepository) regionOf(biztag string) *Region {
+	if region, ok := r.biztags[biztag]; ok {
+		return region
+	}
+	return r.region
+}
+
+// 分配并映射号段, 跨越块的边界时丢弃前一块中的部分并重新分配, 保证返回完整的step个ID
+func (r *regionRepository) mapSegment(biztag string, update func() (*Segment, error)) (*Segment, error) {
+	region := r.regionOf(biztag)
+	if region == nil {
+		return update()
+	}
+	for i := 0; i < regionRetries; i++ {
+		seg, err := update()
+		if err != nil {
+			return nil, err
+		}
+		mapped, err := region.mapSegment(seg)
+		if err != nil {
+			return nil, fmt.Errorf("%s region %v: %w", biztag, region, err)
+		}
+		if mapped.Step == seg.Step {
+			return mapped, nil
+		}
+	}
+	return nil, fmt.Errorf("%s region %v: %w", biztag, region, ErrRegionTruncated)
+}
+
+// List step大于block的biztag返回错误
+func (r *regionRepository) List(ctx context.Context) ([]*Segment, error) {
+	segs, err := r.Repository.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, seg := range segs {
+		if region := r.regionOf(seg.BizTag); region != nil {
+			if err = region.CheckSize(int64(seg.Step)); err != nil {
+				return nil, fmt.Errorf("%s region %v: %w", seg.BizTag, region, err)
+			}
+			if segs[i], err = region.mapMaxID(seg); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return segs, nil
+}
+
+func (r *regionRepository) Get(ctx context.Context, biztag string) (*Segment, error) {
+	seg, err := r.Repository.Get(ctx, biztag)
+	if err != nil {
+		return nil, err
+	}
+	if region := r.regionOf(biztag); region != nil {
+		return region.mapMaxID(seg)
+	}
+	return seg, nil
+}
+
+func (r *regionRepository) UpdateMaxID(ctx context.Context, biztag string) (*Segment, error) {
+	return r.mapSegment(biztag, func() (*Segment, error) {
+		return r.Repository.UpdateMaxID(ctx, biztag)
+	})
+}
+
+func (r *regionRepository) UpdateMaxIDWithStep(ctx context.Context, biztag string, step int32) (*Segment, error) {
+	return r.mapSegment(biztag, func() (*Segment, error) {
+		return r.Repository.UpdateMaxIDWithStep(ctx, biztag, step)
+	})
+}
+
+func (r *regionRepository) UpdatePeriodMaxID(ctx context.Context, biztag, period string, step int32) (*Segment, error) {
+	return r.mapSegment(biztag, func() (*Segment, error) {
+		return r.Repository.UpdatePeriodMaxID(ctx, biztag, period, step)
+	})
+}
+
+// RecordLease lease中已经是映射之后的范围, 直接保存
+func (r *regionRepository) RecordLease(ctx context.Context, lease *Lease) error {
+	return recordLease(ctx, r.Repository, lease)
+}
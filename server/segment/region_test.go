@@ -0,0 +1,128 @@
+package segment
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+func TestRegionInterleave(t *testing.T) {
+	ts := time.Now()
+	newRepo := func(offset int64) Repository {
+		region, err := NewInterleavedRegion(offset, 2, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 每个数据中心使用单独的segments表
+		repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 30, "", ts}}}
+		return NewRegionRepository(repo, region, nil)
+	}
+	seen := make(map[int64]bool)
+	for offset := int64(0); offset < 2; offset++ {
+		repo := newRepo(offset)
+		var last int64
+		for i := 0; i < 10; i++ {
+			seg, err := repo.UpdateMaxID(context.Background(), "biztag1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 跨越块的边界时重新分配完整的号段
+			if seg.Step != 30 {
+				t.Fatalf("seg = %+v, want step = 30", seg)
+			}
+			for id := seg.MaxID - int64(seg.Step); id < seg.MaxID; id++ {
+				if id <= last {
+					t.Fatalf("id %d after %d, want ascending", id, last)
+				}
+				last = id
+				if (id/100)%2 != offset {
+					t.Fatalf("id %d not in region %d", id, offset)
+				}
+				if seen[id] {
+					t.Fatalf("duplicated id %d", id)
+				}
+				seen[id] = true
+			}
+		}
+	}
+}
+
+func TestRegionPrefix(t *testing.T) {
+	region, err := NewPrefixRegion(3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRegionRepository(&testRepo{segs: []*Segment{&Segment{"biztag1", 1000, 20, "", time.Now()}}},
+		nil, map[string]*Region{"biztag1": region})
+	seg, err := repo.UpdateMaxID(context.Background(), "biztag1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seg.MaxID != 3<<10|1020 || seg.Step != 20 {
+		t.Fatalf("seg = %+v, want max_id = %d", seg, 3<<10|1020)
+	}
+	// 本地序列号超过低10位
+	if _, err = repo.UpdateMaxID(context.Background(), "biztag1"); !errors.Is(err, ErrRegionExhausted) {
+		t.Fatalf("err = %v, want = %v", err, ErrRegionExhausted)
+	}
+	if _, err = NewPrefixRegion(1<<53, 10); err == nil {
+		t.Fatal("prefix overflow accepted")
+	}
+}
+
+func TestRegionInterleaveLease(t *testing.T) {
+	region, err := NewInterleavedRegion(1, 2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 30, "", time.Now()}}}
+	svc := NewService(NewRegionRepository(repo, region, nil), log.DefaultLogger)
+	defer svc.Close()
+	var last int64
+	for i := 0; i < 10; i++ {
+		r, err := svc.Lease(context.Background(), "biztag1", 60, "client1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 跨越块的边界时重新分配, 不返回更短的号段
+		if r.End-r.Start != 60 {
+			t.Fatalf("lease = [%d, %d), want 60 ids", r.Start, r.End)
+		}
+		if r.Start < last || (r.Start/100)%2 != 1 || ((r.End-1)/100)%2 != 1 {
+			t.Fatalf("lease = [%d, %d) not in region 1 after %d", r.Start, r.End, last)
+		}
+		last = r.End
+	}
+	if _, err = svc.Lease(context.Background(), "biztag1", 101, "client1"); !errors.Is(err, ErrRegionBlockTooSmall) {
+		t.Fatalf("err = %v, want = %v", err, ErrRegionBlockTooSmall)
+	}
+	// 每次都跨越块的边界
+	for err == nil || errors.Is(err, ErrRegionBlockTooSmall) {
+		if _, err = svc.Lease(context.Background(), "biztag1", 90, "client1"); err != nil && !errors.Is(err, ErrRegionTruncated) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegionBlockTooSmall(t *testing.T) {
+	region, err := NewInterleavedRegion(0, 2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = region.CheckSize(100); err != nil {
+		t.Fatal(err)
+	}
+	if err = region.CheckSize(101); !errors.Is(err, ErrRegionBlockTooSmall) {
+		t.Fatalf("err = %v, want = %v", err, ErrRegionBlockTooSmall)
+	}
+	repo := NewRegionRepository(&testRepo{segs: []*Segment{&Segment{"biztag1", 1, 200, "", time.Now()}}}, region, nil)
+	if _, err = repo.List(context.Background()); !errors.Is(err, ErrRegionBlockTooSmall) {
+		t.Fatalf("err = %v, want = %v", err, ErrRegionBlockTooSmall)
+	}
+	if _, err = repo.UpdateMaxID(context.Background(), "biztag1"); !errors.Is(err, ErrRegionBlockTooSmall) {
+		t.Fatalf("err = %v, want = %v", err, ErrRegionBlockTooSmall)
+	}
+}
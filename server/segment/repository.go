@@ -4,18 +4,78 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+
+	"github.com/derry6/gleafd/pkg/log"
 )
 
 type Repository interface {
 	List(ctx context.Context) ([]*Segment, error)
+	// Get biztag不存在时返回ErrBizTagNotFound
 	Get(ctx context.Context, biztag string) (*Segment, error)
 	UpdateMaxID(ctx context.Context, biztag string) (*Segment, error)
+	// UpdateMaxIDWithStep 按step分配号段, 返回号段的Step为实际分配的大小
 	UpdateMaxIDWithStep(ctx context.Context, biztag string, step int32) (*Segment, error)
 	ListBizTags(ctx context.Context) ([]string, error)
+	// UpdatePeriodMaxID 分配biztag在period内的号段, 每个period的序列号都从1开始。
+	// step<=0时使用biztag的step
+	UpdatePeriodMaxID(ctx context.Context, biztag, period string, step int32) (*Segment, error)
+}
+
+// LeaseAuditor 记录号段的租用, 用于审计。Repository可以选择实现该接口
+type LeaseAuditor interface {
+	RecordLease(ctx context.Context, lease *Lease) error
+}
+
+// recordLease repo没有实现LeaseAuditor时不记录
+func recordLease(ctx context.Context, repo Repository, lease *Lease) error {
+	if auditor, ok := repo.(LeaseAuditor); ok {
+		return auditor.RecordLease(ctx, lease)
+	}
+	return nil
 }
 
 type defaultRepository struct {
-	db *sql.DB
+	db    *sql.DB
+	floor *floorGuard
+}
+
+// RepositoryOption defaultRepository的选项
+type RepositoryOption func(r *defaultRepository)
+
+// WithFloor 在本地保存每个biztag已经发放的最大max_id。主从切换丢失已经提交的更新时,
+// 数据库返回的号段会低于本地记录, skip为true时将max_id推进到本地记录之后, 否则返回FloorError
+func WithFloor(store FloorStore, skip bool, logger log.Logger) RepositoryOption {
+	return func(r *defaultRepository) {
+		r.floor = &floorGuard{store: store, skip: skip, logger: logger}
+	}
+}
+
+// 检查事务中分配的号段, 没有设置floor时不检查
+func (r *defaultRepository) checkFloor(ctx context.Context, tx *sql.Tx, seg *Segment, period string) error {
+	if r.floor == nil {
+		return nil
+	}
+	return r.floor.check(seg.BizTag, period, seg, func(maxID int64) error {
+		if period != "" {
+			q := "UPDATE `segment_periods` SET `max_id`=? WHERE `biz_tag`=? AND `period`=?"
+			_, err := tx.ExecContext(ctx, q, maxID, seg.BizTag, period)
+			return err
+		}
+		q := "UPDATE `segments` SET `max_id`=? WHERE `biz_tag`=?"
+		_, err := tx.ExecContext(ctx, q, maxID, seg.BizTag)
+		return err
+	})
+}
+
+// 提交事务并且记录本地floor
+func (r *defaultRepository) commit(tx *sql.Tx, seg *Segment, period string) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if r.floor == nil {
+		return nil
+	}
+	return r.floor.advance(seg.BizTag, period, seg.MaxID)
 }
 
 func (r *defaultRepository) List(ctx context.Context) (segs []*Segment, err error) {
@@ -49,14 +109,16 @@ func (r *defaultRepository) Get(ctx context.Context, biztag string) (*Segment, e
 	var seg Segment
 	q := "SELECT `biz_tag`,`max_id`,`step`,`updated` FROM `segments` WHERE `biz_tag`=?"
 	row := r.db.QueryRowContext(ctx, q, biztag)
-	if err := row.Scan(&seg.BizTag, &seg.MaxID, &seg.Step, &seg.Updated); err != nil {
+	if err := row.Scan(&seg.BizTag, &seg.MaxID, &seg.Step, &seg.Updated); err == sql.ErrNoRows {
+		return nil, ErrBizTagNotFound
+	} else if err != nil {
 		return nil, err
 	}
 	return &seg, nil
 }
 
 func (r *defaultRepository) UpdateMaxID(ctx context.Context, biztag string) (*Segment, error) {
-	tx, err := r.db.Begin()
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -78,14 +140,17 @@ func (r *defaultRepository) UpdateMaxID(ctx context.Context, biztag string) (*Se
 	if err != nil {
 		return nil, err
 	}
-	if err = tx.Commit(); err != nil {
+	if err = r.checkFloor(ctx, tx, seg, ""); err != nil {
+		return nil, err
+	}
+	if err = r.commit(tx, seg, ""); err != nil {
 		return nil, err
 	}
 	return seg, nil
 }
 
 func (r *defaultRepository) UpdateMaxIDWithStep(ctx context.Context, biztag string, step int32) (*Segment, error) {
-	tx, err := r.db.Begin()
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -107,12 +172,59 @@ func (r *defaultRepository) UpdateMaxIDWithStep(ctx context.Context, biztag stri
 	if err != nil {
 		return nil, err
 	}
-	if err = tx.Commit(); err != nil {
+	seg.Step = step
+	if err = r.checkFloor(ctx, tx, seg, ""); err != nil {
+		return nil, err
+	}
+	if err = r.commit(tx, seg, ""); err != nil {
 		return nil, err
 	}
 	return seg, nil
 }
 
+func (r *defaultRepository) UpdatePeriodMaxID(ctx context.Context, biztag, period string, step int32) (*Segment, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seg, err := r.getSegment(ctx, tx, biztag)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("segment not found")
+	} else if err != nil {
+		return nil, err
+	}
+	if step <= 0 {
+		step = seg.Step
+	}
+	// 新的period从1开始分配
+	q := "INSERT INTO `segment_periods`(`biz_tag`,`period`,`max_id`) VALUES(?,?,?) " +
+		"ON DUPLICATE KEY UPDATE `max_id`=`max_id`+?"
+	if _, err = tx.ExecContext(ctx, q, biztag, period, 1+int64(step), step); err != nil {
+		return nil, err
+	}
+	q = "SELECT `max_id`,`updated` FROM `segment_periods` WHERE `biz_tag`=? AND `period`=?"
+	row := tx.QueryRowContext(ctx, q, biztag, period)
+	if err = row.Scan(&seg.MaxID, &seg.Updated); err != nil {
+		return nil, err
+	}
+	seg.Step = step
+	if err = r.checkFloor(ctx, tx, seg, period); err != nil {
+		return nil, err
+	}
+	if err = r.commit(tx, seg, period); err != nil {
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (r *defaultRepository) RecordLease(ctx context.Context, lease *Lease) error {
+	q := "INSERT INTO `segment_leases`(`biz_tag`,`period`,`start_id`,`end_id`,`client`) VALUES(?,?,?,?,?)"
+	_, err := r.db.ExecContext(ctx, q, lease.BizTag, lease.Period, lease.Start, lease.End, lease.Client)
+	return err
+}
+
 func (r *defaultRepository) ListBizTags(ctx context.Context) (biztags []string, err error) {
 	q := "SELECT `biz_tag` FROM segments"
 	rows, err := r.db.QueryContext(ctx, q)
@@ -130,30 +242,16 @@ func (r *defaultRepository) ListBizTags(ctx context.Context) (biztags []string,
 	return biztags, nil
 }
 
-func (r *defaultRepository) createTables() (err error) {
-	_, err = r.db.Exec(
-		"CREATE TABLE IF NOT EXISTS `segments`(" +
-			"	`biz_tag` VARCHAR(128) NOT NULL DEFAULT ''," +
-			"	`max_id` 	BIGINT(20) NOT NULL DEFAULT '1'," +
-			"	`step` 	INT(11) NOT NULL," +
-			"	`desc` 	VARCHAR(256)  DEFAULT NULL," +
-			"	`updated` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP," +
-			"	PRIMARY KEY (`biz_tag`)" +
-			");")
-	if err != nil {
-		return err
-	}
-	_, err = r.db.Exec(
-		"INSERT INTO `segments`(`biz_tag`,`step`,`desc`) " +
-			"VALUES('example', 1000, 'gleafd example')")
-	// Ignore error
-	return nil
-}
-
-func NewDefaultRepository(db *sql.DB) (Repository, error) {
+// NewDefaultRepository 不创建表, 表结构由Migrator管理
+func NewDefaultRepository(db *sql.DB, opts ...RepositoryOption) (Repository, error) {
 	r := &defaultRepository{db: db}
-	if err := r.createTables(); err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.floor != nil {
+		if err := r.floor.load(); err != nil {
+			return nil, err
+		}
 	}
 	return r, nil
 }
@@ -0,0 +1,80 @@
+package segment
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+
+	maxRetryBackoff = 2 * time.Second
+)
+
+// UpdateError 获取新号段失败, 等待号段的请求会立即返回该错误
+type UpdateError struct {
+	BizTag string
+	Period string
+	Err    error
+}
+
+func (e *UpdateError) Error() string {
+	if e.Period != "" {
+		return fmt.Sprintf("update segment %s/%s: %v", e.BizTag, e.Period, e.Err)
+	}
+	return fmt.Sprintf("update segment %s: %v", e.BizTag, e.Err)
+}
+
+func (e *UpdateError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient 判断是否为可以重试的错误: 连接断开, 单次调用超时, 死锁和锁等待超时
+func IsTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number == mysqlErrDeadlock || myErr.Number == mysqlErrLockWaitTimeout
+	}
+	return false
+}
+
+// 调用仓储, 每次调用最多callTimeout, 可以重试的错误按指数退避最多重试retries次
+func (s *Service) callRepo(ctx context.Context, biztag string, fn func(ctx context.Context) (*Segment, error)) (seg *Segment, err error) {
+	backoff := s.opts.retryBackoff
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if s.opts.callTimeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, s.opts.callTimeout)
+		}
+		seg, err = fn(callCtx)
+		cancel()
+		if err == nil || attempt >= s.opts.retries || !IsTransient(err) || ctx.Err() != nil {
+			return seg, err
+		}
+		s.logger.Warnw("Segment repository call failed, retrying",
+			"biztag", biztag, "attempt", attempt+1, "backoff", backoff, "err", err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-s.closeC:
+			t.Stop()
+			return nil, ErrClosed
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
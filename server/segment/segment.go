@@ -9,3 +9,21 @@ type Segment struct {
 	Description string
 	Updated     time.Time
 }
+
+// Range 连续的ID范围[Start, End), 不包含End
+type Range struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// 按周期重置的biztag为ID所在的周期
+	Period string `json:"period,omitempty"`
+}
+
+// Lease 号段的租用记录
+type Lease struct {
+	BizTag  string
+	Period  string
+	Start   int64
+	End     int64
+	Client  string
+	Created time.Time
+}
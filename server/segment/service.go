@@ -3,22 +3,36 @@ package segment
 import (
 	"context"
 	"errors"
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/derry6/gleafd/pkg/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	ErrClosed         = errors.New("service closed")
-	ErrBizTagNotFound = errors.New("biztag not found")
+	ErrClosed           = errors.New("service closed")
+	ErrBizTagNotFound   = errors.New("biztag not found")
+	ErrInvalidLeaseSize = errors.New("invalid lease size")
 )
 
 type waitItem struct {
+	ctx    context.Context // 触发更新的请求的trace
 	biztag string
-	result chan *Segment
+	period string
+	result chan updateResult
 	step   int32
+	// 大于0时同时预留降级模式使用的号段
+	reserve int32
+}
+
+type updateResult struct {
+	seg       *Segment
+	emergency *Segment
+	err       error
 }
 
 type Service struct {
@@ -30,6 +44,10 @@ type Service struct {
 	closed int32 // 是否关闭Flag
 	closeC chan struct{}
 	wg     sync.WaitGroup
+
+	// 按周期重置的generators, 每个biztag只保留当前period
+	periods map[string]*generator
+	opts    *Options
 }
 
 // 查找对应biztag的generator
@@ -50,9 +68,50 @@ func (s *Service) getGenerators() (gs []*generator) {
 	for _, g := range s.gs {
 		gs = append(gs, g)
 	}
+	for _, g := range s.periods {
+		gs = append(gs, g)
+	}
 	return gs
 }
 
+// 查找biztag在period内的generator, 进入新的period时替换旧的generator
+func (s *Service) findPeriodGenerator(biztag, period string) (*generator, error) {
+	if _, err := s.findGenerator(biztag); err != nil {
+		return nil, err
+	}
+	s.gsMu.Lock()
+	defer s.gsMu.Unlock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, ErrClosed
+	}
+	if g, ok := s.periods[biztag]; ok {
+		if g.period == period {
+			return g, nil
+		}
+		// 已经进入下一个period, 不再为旧的period分配ID
+		if periodBefore(period, g.period) {
+			return nil, ErrPeriodExpired
+		}
+		// 旧period剩余的ID不再使用
+		g.stop()
+	}
+	g := s.startGenerator(biztag, period)
+	s.periods[biztag] = g
+	return g, nil
+}
+
+func (s *Service) startGenerator(biztag, period string) *generator {
+	// generator读
+	usc := make(chan updateResult, 1)
+	g := newGenerator(s, biztag, period, usc)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		g.run()
+	}()
+	return g
+}
+
 // 获取当前所有的biztags
 func (s *Service) getBizTagsUnsafe() (tags []string) {
 	for k, _ := range s.gs {
@@ -101,16 +160,31 @@ func (s *Service) updateBizTagsFromRepo() error {
 		return err
 	}
 	added, removed := s.handleBizTagsUpdated(tags)
+	s.applyBizTags(added, removed)
+	return nil
+}
+
+// 创建和删除biztags对应的generators
+func (s *Service) applyBizTags(added, removed []string) {
 	if len(added) > 0 {
 		s.logger.Infow("Segment biztags added", "tags", added)
 	}
+	if s.opts.validateBizTag != nil {
+		for _, biztag := range added {
+			if err := s.opts.validateBizTag(biztag); err != nil {
+				s.logger.Warnw("Segment biztag is not reachable through the api, rename it", "biztag", biztag, "err", err)
+			}
+		}
+	}
 	if len(removed) > 0 {
 		s.logger.Infow("Segment biztags removed", "tags", removed)
 	}
-	// 删除对应的generators
-	uscMap := make(map[string]chan *Segment)
-
 	s.gsMu.Lock()
+	defer s.gsMu.Unlock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return
+	}
+	// 删除对应的generators
 	for _, biztag := range removed {
 		g, ok := s.gs[biztag]
 		if ok {
@@ -119,65 +193,153 @@ func (s *Service) updateBizTagsFromRepo() error {
 		if ok {
 			g.stop()
 		}
+		if g, ok = s.periods[biztag]; ok {
+			delete(s.periods, biztag)
+			g.stop()
+		}
 	}
 	// 创建相应的generators
 	for _, biztag := range added {
-		// generator读
-		usc := make(chan *Segment, 1)
-		g := newGenerator(s, biztag, usc)
-		s.wg.Add(1)
-		go func() {
-			defer s.wg.Done()
-			g.run()
-		}()
-		uscMap[biztag] = usc
-		s.gs[biztag] = g
+		if _, ok := s.gs[biztag]; ok {
+			continue
+		}
+		s.gs[biztag] = s.startGenerator(biztag, "")
 	}
-	s.gsMu.Unlock()
-	return nil
 }
 
-func (s *Service) notifyUpdate(biztag string, step int32, result chan *Segment) {
+// 修改了biztag的step或者max_id之后丢弃缓存的号段, 下一个请求从仓储重新获取。
+// 正在使用旧generator的请求返回ErrClosed之后使用新的generator重试
+func (s *Service) resetBizTag(biztag string) {
+	s.gsMu.Lock()
+	defer s.gsMu.Unlock()
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return
+	}
+	g, ok := s.gs[biztag]
+	if !ok {
+		return
+	}
+	s.gs[biztag] = s.startGenerator(biztag, "")
+	g.stop()
+	if g, ok = s.periods[biztag]; ok {
+		delete(s.periods, biztag)
+		g.stop()
+	}
+	s.logger.Infow("Segment biztag reset", "biztag", biztag)
+}
+
+// 收到biztag的变更通知之后从仓储读取biztag, 读取失败时等待下次全量更新
+func (s *Service) applyBizTagEvent(ctx context.Context, ev BizTagEvent) {
+	if s.opts.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.callTimeout)
+		defer cancel()
+	}
+	_, err := s.repo.Get(ctx, ev.BizTag)
+	_, findErr := s.findGenerator(ev.BizTag)
+	exists := findErr == nil
+	switch {
+	case err == nil:
+		if !exists {
+			s.applyBizTags([]string{ev.BizTag}, nil)
+		} else if ev.Type == BizTagUpdated {
+			s.resetBizTag(ev.BizTag)
+		}
+	case errors.Is(err, ErrBizTagNotFound):
+		if exists {
+			s.applyBizTags(nil, []string{ev.BizTag})
+		}
+	default:
+		s.logger.Warnw("Apply segment biztag event", "type", ev.Type, "biztag", ev.BizTag, "err", err)
+	}
+}
+
+// 订阅biztag的变更, 重新订阅之后全量更新一次, 避免丢失断开期间的变更
+func (s *Service) watchBizTags(ctx context.Context) {
+	for subscribed := false; ; {
+		events, err := s.opts.notifier.Subscribe(ctx)
+		if err != nil {
+			s.logger.Warnw("Subscribe segment biztag events", "err", err)
+		} else {
+			if subscribed {
+				if err = s.updateBizTagsFromRepo(); err != nil {
+					s.logger.Warnw("Update segment biztags", "err", err)
+				}
+			}
+			subscribed = true
+			for ev := range events {
+				s.applyBizTagEvent(ctx, ev)
+			}
+		}
+		t := time.NewTimer(time.Second)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// NotifyBizTag 立即在本节点应用biztag的变更, 并且通知其它节点
+func (s *Service) NotifyBizTag(ctx context.Context, ev BizTagEvent) error {
+	s.applyBizTagEvent(ctx, ev)
+	if s.opts.notifier == nil {
+		return nil
+	}
+	return s.opts.notifier.Publish(ctx, ev)
+}
+
+func (s *Service) notifyUpdate(ctx context.Context, biztag, period string, step, reserve int32, result chan updateResult) {
 	// waitUpdateBizTags/closeC 生命周期跟Service相同
 	select {
 	case <-s.closeC:
 		return
-	case s.waits <- waitItem{biztag, result, step}:
+	case s.waits <- waitItem{detach(ctx), biztag, period, result, step, reserve}:
 	}
 }
 
-func (s *Service) update(ws waitItem) error {
-	var (
-		seg *Segment
-		err error
-	)
-	ctx := context.Background()
-	if ws.step <= 0 {
-		seg, err = s.repo.UpdateMaxID(ctx, ws.biztag)
-		if err != nil {
-			return err 
+func (s *Service) update(ws waitItem) (err error) {
+	var seg *Segment
+	ctx, span := tracer().Start(ws.ctx, "segment.update", trace.WithAttributes(
+		attribute.String("biztag", ws.biztag), attribute.String("period", ws.period), attribute.Int("step", int(ws.step))))
+	defer func() { endSpan(span, err) }()
+	seg, err = s.callRepo(ctx, ws.biztag, func(ctx context.Context) (*Segment, error) {
+		if ws.period != "" {
+			return s.repo.UpdatePeriodMaxID(ctx, ws.biztag, ws.period, ws.step)
+		} else if ws.step <= 0 {
+			// use default step
+			return s.repo.UpdateMaxID(ctx, ws.biztag)
 		}
-		// use default step 
-	} else {
-		seg, err = s.repo.UpdateMaxIDWithStep(ctx, ws.biztag, ws.step)
+		return s.repo.UpdateMaxIDWithStep(ctx, ws.biztag, ws.step)
+	})
+	result := updateResult{seg: seg}
+	if err != nil {
+		s.logger.Errorw("Update segment", "biztag", ws.biztag, "period", ws.period, "err", err)
+		// 通知等待号段的请求
+		result.err = &UpdateError{BizTag: ws.biztag, Period: ws.period, Err: err}
+	} else if ws.reserve > 0 {
+		result.emergency, err = s.callRepo(ctx, ws.biztag, func(ctx context.Context) (*Segment, error) {
+			return s.repo.UpdateMaxIDWithStep(ctx, ws.biztag, ws.reserve)
+		})
 		if err != nil {
-			return err 
+			// 下次获取号段时重试
+			s.logger.Warnw("Reserve segment emergency range", "biztag", ws.biztag, "err", err)
+			err = nil
 		}
-		// move to UpdateMaxIDWithStep ?
-		seg.Step  = ws.step
 	}
-	// 如果usc被关闭？
 	select {
 	case <-s.closeC:
 		return ErrClosed
-	case ws.result <- seg:
-		return nil
+	case ws.result <- result:
+		return err
 	}
 }
 
-// 负责从数据库中拉取数据
+// 负责从数据库中拉取数据, 定期全量更新biztags作为变更通知的补充
 func (s *Service) run() error {
-	timer := time.NewTicker(time.Minute)
+	timer := time.NewTicker(s.opts.pollInterval)
+	defer timer.Stop()
 	for {
 		select {
 		case <-s.closeC:
@@ -186,8 +348,12 @@ func (s *Service) run() error {
 			if !ok {
 				return ErrClosed
 			}
-			if err := s.update(item); err != nil {
-			}
+			// 每个generator同时最多只有一个更新, 一个biztag的重试不影响其它biztags
+			s.wg.Add(1)
+			go func(item waitItem) {
+				defer s.wg.Done()
+				s.update(item)
+			}(item)
 		case <-timer.C:
 			s.updateBizTagsFromRepo()
 		}
@@ -199,18 +365,124 @@ func (s *Service) init() error {
 }
 
 func (s *Service) Get(ctx context.Context, biztag string, count int) (ids []int64, err error) {
-	g, err := s.findGenerator(biztag)
+	ids, _, err = s.GetWithPeriod(ctx, biztag, count)
+	return ids, err
+}
+
+// GetWithPeriod 按周期重置的biztag返回当前周期的ID和周期标识, ID只在周期内唯一。
+// 其它biztag的周期标识为空
+func (s *Service) GetWithPeriod(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	ranges, err := s.GetRanges(ctx, biztag, count)
+	if err != nil {
+		return nil, "", err
+	}
+	return expandRanges(ranges, count), ranges[0].Period, nil
+}
+
+// GetRanges 获取count个ID, 以连续的范围返回。
+// 每次从当前号段中取出尽量多的连续ID, 只有跨越号段时才会返回多个范围
+func (s *Service) GetRanges(ctx context.Context, biztag string, count int) (ranges []Range, err error) {
+	p, ok := s.opts.periods[biztag]
+	if !ok {
+		return s.getRanges(ctx, biztag, "", count)
+	}
+	// 请求跨越周期边界时使用新的周期重试
+	for i := 0; i < 3; i++ {
+		if ranges, err = s.getRanges(ctx, biztag, p.Key(time.Now()), count); err != ErrPeriodExpired {
+			break
+		}
+	}
+	return ranges, err
+}
+
+// GetPeriod 获取biztag在period内的ID, 每个period的序列号都从1开始。
+// period为空时不重置序列号, period早于当前周期时返回ErrPeriodExpired
+func (s *Service) GetPeriod(ctx context.Context, biztag, period string, count int) (ids []int64, err error) {
+	ranges, err := s.getRanges(ctx, biztag, period, count)
 	if err != nil {
 		return nil, err
 	}
-	for i := 0; i < count; i++ {
-		id, err := g.get(ctx)
+	return expandRanges(ranges, count), nil
+}
+
+func (s *Service) getRanges(ctx context.Context, biztag, period string, count int) (ranges []Range, err error) {
+	for i := 0; ; i++ {
+		var g *generator
+		if period == "" {
+			g, err = s.findGenerator(biztag)
+		} else {
+			g, err = s.findPeriodGenerator(biztag, period)
+		}
 		if err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
+		ranges, err = g.getRanges(ctx, count)
+		if err != ErrClosed || atomic.LoadInt32(&s.closed) != 0 {
+			return ranges, err
+		}
+		if period != "" {
+			// generator已经被下一个周期替换
+			return nil, ErrPeriodExpired
+		}
+		// generator已经被resetBizTag替换, 使用新的generator重试
+		if i >= 2 {
+			return nil, err
+		}
+	}
+}
+
+func expandRanges(ranges []Range, count int) []int64 {
+	ids := make([]int64, 0, count)
+	for _, r := range ranges {
+		for id := r.Start; id < r.End; id++ {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Lease 直接从仓储中分配size个连续的ID, 由client在本地使用。
+// 租用记录会输出到日志, 仓储实现了LeaseAuditor时同时保存到仓储中
+func (s *Service) Lease(ctx context.Context, biztag string, size int, client string) (*Range, error) {
+	if size <= 0 || size > math.MaxInt32 {
+		return nil, ErrInvalidLeaseSize
+	}
+	if _, err := s.findGenerator(biztag); err != nil {
+		return nil, err
+	}
+	var (
+		seg    *Segment
+		period string
+		err    error
+	)
+	if p, ok := s.opts.periods[biztag]; ok {
+		period = p.Key(time.Now())
 	}
-	return ids, nil
+	seg, err = s.callRepo(ctx, biztag, func(ctx context.Context) (*Segment, error) {
+		if period != "" {
+			return s.repo.UpdatePeriodMaxID(ctx, biztag, period, int32(size))
+		}
+		return s.repo.UpdateMaxIDWithStep(ctx, biztag, int32(size))
+	})
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{
+		BizTag:  biztag,
+		Period:  period,
+		Start:   seg.MaxID - int64(seg.Step),
+		End:     seg.MaxID,
+		Client:  client,
+		Created: time.Now(),
+	}
+	s.logger.Infow("Segment range leased", "biztag", biztag, "period", period,
+		"start", lease.Start, "end", lease.End, "client", client)
+	if err = recordLease(ctx, s.repo, lease); err != nil {
+		// 没有审计记录的号段不交给client使用
+		s.logger.Errorw("Record segment lease", "biztag", biztag, "start", lease.Start, "err", err)
+		return nil, err
+	}
+	return &Range{Start: lease.Start, End: lease.End, Period: period}, nil
 }
 
 func (s *Service) Close() error {
@@ -220,20 +492,26 @@ func (s *Service) Close() error {
 		for _, g := range gs {
 			g.stop()
 		}
+		// generator可能仍在notifyUpdate, 不能关闭waits
 		close(s.closeC)
-		close(s.waits)
 		s.wg.Wait()
 	}
 	return nil
 }
 
-func NewService(repo Repository, logger log.Logger) *Service {
+func NewService(repo Repository, logger log.Logger, opts ...Option) *Service {
+	sopts := newDefaultOptions()
+	for _, o := range opts {
+		o(sopts)
+	}
 	s := &Service{
-		repo:   repo,
-		gs:     make(map[string]*generator),
-		waits:  make(chan waitItem, 100),
-		closeC: make(chan struct{}),
-		logger: logger,
+		repo:    repo,
+		opts:    sopts,
+		gs:      make(map[string]*generator),
+		periods: make(map[string]*generator),
+		waits:   make(chan waitItem, 100),
+		closeC:  make(chan struct{}),
+		logger:  logger,
 	}
 	if err := s.init(); err != nil {
 		logger.Fatalw("New segment service", "err", err)
@@ -245,5 +523,18 @@ func NewService(repo Repository, logger log.Logger) *Service {
 			return
 		}
 	}()
+	if sopts.notifier != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.wg.Add(2)
+		go func() {
+			defer s.wg.Done()
+			<-s.closeC
+			cancel()
+		}()
+		go func() {
+			defer s.wg.Done()
+			s.watchBizTags(ctx)
+		}()
+	}
 	return s
 }
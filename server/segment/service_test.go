@@ -2,7 +2,9 @@ package segment
 
 import (
 	"context"
+	"database/sql/driver"
 	"errors"
+	"expvar"
 	"fmt"
 	"math"
 	"math/rand"
@@ -11,10 +13,13 @@ import (
 	"time"
 
 	"github.com/derry6/gleafd/pkg/log"
+	"github.com/go-sql-driver/mysql"
 )
 
 type testRepo struct {
-	segs []*Segment
+	segs    []*Segment
+	periods map[string]int64 // biztag/period -> max_id
+	leases  []*Lease
 	sync.RWMutex
 }
 
@@ -36,7 +41,7 @@ func (r *testRepo) Get(ctx context.Context, biztag string) (*Segment, error) {
 			return &seg, nil
 		}
 	}
-	return nil, errors.New("biztag not in test repo")
+	return nil, ErrBizTagNotFound
 }
 func (r *testRepo) UpdateMaxID(ctx context.Context, biztag string) (*Segment, error) {
 	r.Lock()
@@ -57,11 +62,39 @@ func (r *testRepo) UpdateMaxIDWithStep(ctx context.Context, biztag string, step
 		if pSeg.BizTag == biztag {
 			pSeg.MaxID += int64(step)
 			seg := *pSeg
+			seg.Step = step
 			return &seg, nil
 		}
 	}
 	return nil, errors.New("biztag not found in test repo")
 }
+func (r *testRepo) UpdatePeriodMaxID(ctx context.Context, biztag, period string, step int32) (*Segment, error) {
+	r.Lock()
+	defer r.Unlock()
+	for _, pSeg := range r.segs {
+		if pSeg.BizTag == biztag {
+			if step <= 0 {
+				step = pSeg.Step
+			}
+			if r.periods == nil {
+				r.periods = make(map[string]int64)
+			}
+			key := biztag + "/" + period
+			if _, ok := r.periods[key]; !ok {
+				r.periods[key] = 1
+			}
+			r.periods[key] += int64(step)
+			return &Segment{BizTag: biztag, MaxID: r.periods[key], Step: step}, nil
+		}
+	}
+	return nil, errors.New("biztag not found in test repo")
+}
+func (r *testRepo) RecordLease(ctx context.Context, lease *Lease) error {
+	r.Lock()
+	defer r.Unlock()
+	r.leases = append(r.leases, lease)
+	return nil
+}
 func (r *testRepo) ListBizTags(ctx context.Context) (tags []string, err error) {
 	r.RLock()
 	defer r.RUnlock()
@@ -113,6 +146,130 @@ func TestServiceGet(t *testing.T) {
 	svc.Close()
 }
 
+func TestServiceGetPeriod(t *testing.T) {
+	ts := time.Now()
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1001, 100, "", ts}}}
+	svc := NewService(repo, log.DefaultLogger)
+	defer svc.Close()
+
+	tests := []struct {
+		period string
+		want   []int64
+	}{
+		{"20261017", []int64{1, 2, 3}},
+		{"20261017", []int64{4, 5}},
+		// 新的period重新从1开始
+		{"20261018", []int64{1, 2, 3}},
+		{"", []int64{1001, 1002}},
+	}
+	for _, tt := range tests {
+		ids, err := svc.GetPeriod(context.Background(), "biztag1", tt.period, len(tt.want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+			t.Errorf("period = %q, ids = %v, want = %v", tt.period, ids, tt.want)
+		}
+	}
+	if _, err := svc.GetPeriod(context.Background(), "unknown", "20261017", 1); err != ErrBizTagNotFound {
+		t.Errorf("err = %v, want = %v", err, ErrBizTagNotFound)
+	}
+	// 已经进入下一个周期, 不能再分配旧周期的ID
+	if _, err := svc.GetPeriod(context.Background(), "biztag1", "20261017", 1); err != ErrPeriodExpired {
+		t.Errorf("err = %v, want = %v", err, ErrPeriodExpired)
+	}
+}
+
+func TestServiceLease(t *testing.T) {
+	ts := time.Now()
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1001, 100, "", ts}}}
+	svc := NewService(repo, log.DefaultLogger)
+	defer svc.Close()
+
+	r, err := svc.Lease(context.Background(), "biztag1", 100000, "importer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Start != 1001 || r.End != 101001 {
+		t.Errorf("range = %+v, want = [1001, 101001)", r)
+	}
+	// 租用的范围不会再由generator分配
+	ids, err := svc.Get(context.Background(), "biztag1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[0] != 101001 {
+		t.Errorf("id = %d, want = 101001", ids[0])
+	}
+	if len(repo.leases) != 1 || repo.leases[0].Client != "importer" || repo.leases[0].Start != 1001 {
+		t.Errorf("leases = %+v", repo.leases)
+	}
+	if _, err = svc.Lease(context.Background(), "biztag1", 0, "importer"); err != ErrInvalidLeaseSize {
+		t.Errorf("err = %v, want = %v", err, ErrInvalidLeaseSize)
+	}
+	if _, err = svc.Lease(context.Background(), "unknown", 10, "importer"); err != ErrBizTagNotFound {
+		t.Errorf("err = %v, want = %v", err, ErrBizTagNotFound)
+	}
+}
+
+func TestPeriodKey(t *testing.T) {
+	ts := time.Date(2026, 12, 31, 20, 0, 0, 0, time.UTC)
+	tests := []struct {
+		unit, timezone, want string
+	}{
+		{PeriodDaily, "UTC", "20261231"},
+		{PeriodMonthly, "UTC", "202612"},
+		{PeriodYearly, "UTC", "2026"},
+		// 东八区已经是第二年
+		{PeriodYearly, "Asia/Shanghai", "2027"},
+		{PeriodDaily, "Asia/Shanghai", "20270101"},
+	}
+	for _, tt := range tests {
+		p, err := NewPeriod(tt.unit, tt.timezone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Key(ts); got != tt.want {
+			t.Errorf("%s key = %s, want = %s", p, got, tt.want)
+		}
+	}
+	if _, err := NewPeriod("weekly", ""); err == nil {
+		t.Errorf("unknown period must be rejected")
+	}
+}
+
+func TestServiceGetWithPeriod(t *testing.T) {
+	ts := time.Now()
+	repo := &testRepo{segs: []*Segment{
+		&Segment{"invoice", 5001, 100, "", ts},
+		&Segment{"orders", 5001, 100, "", ts},
+	}}
+	yearly, err := NewPeriod(PeriodYearly, "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(repo, log.DefaultLogger, WithPeriods(map[string]*Period{"invoice": yearly}))
+	defer svc.Close()
+
+	ids, period, err := svc.GetWithPeriod(context.Background(), "invoice", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := yearly.Key(time.Now()); period != want {
+		t.Errorf("period = %s, want = %s", period, want)
+	}
+	if fmt.Sprint(ids) != "[1 2 3]" {
+		t.Errorf("ids = %v, want = [1 2 3]", ids)
+	}
+	ids, period, err = svc.GetWithPeriod(context.Background(), "orders", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period != "" || fmt.Sprint(ids) != "[5001 5002]" {
+		t.Errorf("period = %q, ids = %v, want = [5001 5002]", period, ids)
+	}
+}
+
 func BenchmarkServiceGet(b *testing.B) {
 	ts := time.Now()
 	rand.Seed(ts.UnixNano())
@@ -148,3 +305,263 @@ func BenchmarkServiceGetParallel(b *testing.B) {
 	})
 	svc.Close()
 }
+
+func TestServiceGetRanges(t *testing.T) {
+	ts := time.Now()
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", ts}}}
+	svc := NewService(repo, log.DefaultLogger)
+	defer svc.Close()
+
+	// 请求跨越多个号段时从下一个号段继续分配
+	ids, err := svc.Get(context.Background(), "biztag1", 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("ids[%d] = %d, want = %d", i, id, i+1)
+		}
+	}
+	if len(ids) != 25 {
+		t.Fatalf("len(ids) = %d, want = 25", len(ids))
+	}
+	// 其它节点分配了下一个号段
+	repo.UpdateMaxIDWithStep(context.Background(), "biztag1", 1000)
+
+	ranges, err := svc.GetRanges(context.Background(), "biztag1", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for i, r := range ranges {
+		if r.Start >= r.End {
+			t.Fatalf("ranges[%d] = %+v", i, r)
+		}
+		if i > 0 && r.Start <= ranges[i-1].End {
+			t.Fatalf("ranges = %+v, want disjoint and ascending", ranges)
+		}
+		n += r.End - r.Start
+	}
+	if n != 1000 || len(ranges) < 2 {
+		t.Fatalf("ranges = %+v, want 1000 ids in 2 or more ranges", ranges)
+	}
+	if ranges[0].Start != 26 {
+		t.Fatalf("ranges[0] = %+v, want start = 26", ranges[0])
+	}
+}
+
+func BenchmarkServiceGetRanges(b *testing.B) {
+	ts := time.Now()
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 100000, "", ts}}}
+	svc := NewService(repo, log.DefaultLogger)
+	for i := 0; i < b.N; i++ {
+		if _, err := svc.GetRanges(context.Background(), "biztag1", 10000); err != nil {
+			b.Fatal(err)
+		}
+	}
+	svc.Close()
+}
+
+// 前len(errs)次更新号段依次返回errs中的错误, down时总是返回driver.ErrBadConn
+type failingRepo struct {
+	*testRepo
+	mu    sync.Mutex
+	errs  []error
+	calls int
+	down  bool
+}
+
+func (r *failingRepo) fail() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.down {
+		return driver.ErrBadConn
+	}
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (r *failingRepo) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func (r *failingRepo) UpdateMaxID(ctx context.Context, biztag string) (*Segment, error) {
+	if err := r.fail(); err != nil {
+		return nil, err
+	}
+	return r.testRepo.UpdateMaxID(ctx, biztag)
+}
+
+func (r *failingRepo) UpdateMaxIDWithStep(ctx context.Context, biztag string, step int32) (*Segment, error) {
+	if err := r.fail(); err != nil {
+		return nil, err
+	}
+	return r.testRepo.UpdateMaxIDWithStep(ctx, biztag, step)
+}
+
+func TestServiceUpdateRetry(t *testing.T) {
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+	repo := &failingRepo{
+		testRepo: &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", time.Now()}}},
+		errs:     []error{deadlock, driver.ErrBadConn},
+	}
+	svc := NewService(repo, log.DefaultLogger, WithRetries(3, time.Millisecond))
+	defer svc.Close()
+
+	ids, err := svc.Get(context.Background(), "biztag1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids[0] != 1 || repo.calls != 3 {
+		t.Fatalf("ids = %v, calls = %d, want = [1 2], 3", ids, repo.calls)
+	}
+}
+
+func TestServiceUpdateError(t *testing.T) {
+	dbErr := errors.New("table segments doesn't exist")
+	repo := &failingRepo{
+		testRepo: &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", time.Now()}}},
+		errs:     []error{dbErr},
+	}
+	svc := NewService(repo, log.DefaultLogger, WithRetries(3, time.Millisecond))
+	defer svc.Close()
+
+	// 等待号段的请求立即返回错误, 不可重试的错误只调用一次
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := svc.Get(ctx, "biztag1", 2)
+	var updateErr *UpdateError
+	if !errors.As(err, &updateErr) || !errors.Is(err, dbErr) || updateErr.BizTag != "biztag1" {
+		t.Fatalf("err = %v, want UpdateError", err)
+	}
+	if repo.calls != 1 {
+		t.Fatalf("calls = %d, want = 1", repo.calls)
+	}
+	// 之后的请求重新获取号段
+	if ids, err := svc.Get(ctx, "biztag1", 2); err != nil || ids[0] != 1 {
+		t.Fatalf("ids = %v, err = %v", ids, err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := map[error]bool{
+		&mysql.MySQLError{Number: 1213}:                  true,
+		&mysql.MySQLError{Number: 1205}:                  true,
+		&mysql.MySQLError{Number: 1062}:                  false,
+		driver.ErrBadConn:                                true,
+		mysql.ErrInvalidConn:                             true,
+		fmt.Errorf("exec: %w", context.DeadlineExceeded): true,
+		context.Canceled:                                 false,
+		errors.New("segment not found"):                  false,
+	}
+	for err, want := range tests {
+		if got := IsTransient(err); got != want {
+			t.Errorf("IsTransient(%v) = %v, want = %v", err, got, want)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	repo := &failingRepo{
+		testRepo: &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", time.Now()}}},
+		down:     true,
+	}
+	b := NewCircuitBreaker(repo, 2, 50*time.Millisecond, log.DefaultLogger)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := b.UpdateMaxID(ctx, "biztag1"); err != driver.ErrBadConn {
+			t.Fatalf("err = %v, want = %v", err, driver.ErrBadConn)
+		}
+	}
+	// 断开之后不再访问数据库
+	if _, err := b.UpdateMaxID(ctx, "biztag1"); err != ErrCircuitOpen || repo.calls != 2 {
+		t.Fatalf("err = %v, calls = %d, want = %v, 2", err, repo.calls, ErrCircuitOpen)
+	}
+	repo.setDown(false)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := b.UpdateMaxID(ctx, "biztag1"); err != nil {
+		t.Fatalf("probe err = %v", err)
+	}
+	if _, err := b.UpdateMaxID(ctx, "biztag1"); err != nil || repo.calls != 4 {
+		t.Fatalf("err = %v, calls = %d, want = nil, 4", err, repo.calls)
+	}
+}
+
+func TestServiceEmergencyRange(t *testing.T) {
+	repo := &failingRepo{
+		testRepo: &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", time.Now()}}},
+	}
+	svc := NewService(NewCircuitBreaker(repo, 1, time.Minute, log.DefaultLogger), log.DefaultLogger,
+		WithRetries(0, time.Millisecond), WithEmergencyRange(100), WithLowWater(0.5))
+	defer svc.Close()
+	ctx := context.Background()
+	emergencyIDs := func() int64 {
+		if v, ok := emergencyIDsTotal.Get("biztag1").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := emergencyIDs()
+
+	seen := make(map[int64]bool)
+	ids, err := svc.Get(ctx, "biztag1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen[ids[0]] = true
+	// 等待预留号段
+	time.Sleep(20 * time.Millisecond)
+	repo.setDown(true)
+
+	// 数据库不可用时使用预留的号段, 用完之后立即返回错误
+	for {
+		ids, err = svc.Get(ctx, "biztag1", 1)
+		if err != nil {
+			break
+		}
+		if seen[ids[0]] {
+			t.Fatalf("duplicated id %d", ids[0])
+		}
+		seen[ids[0]] = true
+	}
+	var updateErr *UpdateError
+	if !errors.As(err, &updateErr) || !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want UpdateError with ErrCircuitOpen", err)
+	}
+	if len(seen) < 110 {
+		t.Fatalf("served %d ids, want >= 110", len(seen))
+	}
+	if n := emergencyIDs() - before; n != 100 {
+		t.Errorf("emergency ids = %d, want = 100", n)
+	}
+	if v := lowWaterTotal.Get("biztag1"); v == nil {
+		t.Errorf("low water alert not triggered")
+	}
+}
+
+func TestServiceBizTagValidator(t *testing.T) {
+	ts := time.Now()
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", ts}, &Segment{"biz tag2", 1, 10, "", ts}}}
+	var invalid []string
+	validate := func(biztag string) error {
+		if biztag == "biz tag2" {
+			invalid = append(invalid, biztag)
+			return errors.New("invalid biztag")
+		}
+		return nil
+	}
+	svc := NewService(repo, log.DefaultLogger, WithBizTagValidator(validate), WithPollInterval(time.Hour))
+	defer svc.Close()
+	// 不符合要求的biztag仍然加载
+	if len(invalid) != 1 {
+		t.Fatalf("invalid = %v, want = [biz tag2]", invalid)
+	}
+	waitBizTag(t, svc, "biz tag2", true)
+}
@@ -0,0 +1,89 @@
+package segment
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/derry6/gleafd/server/segment"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// 只保留ctx中的trace, 后台获取号段不受请求取消的影响
+func detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type tracingRepository struct {
+	Repository
+}
+
+// NewTracingRepository 为repo的每次调用创建span
+func NewTracingRepository(repo Repository) Repository {
+	return &tracingRepository{Repository: repo}
+}
+
+func (r *tracingRepository) start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("db.system", "mysql"))
+	return tracer().Start(ctx, "segment.Repository/"+name,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (r *tracingRepository) List(ctx context.Context) (segs []*Segment, err error) {
+	ctx, span := r.start(ctx, "List")
+	defer func() { endSpan(span, err) }()
+	return r.Repository.List(ctx)
+}
+
+func (r *tracingRepository) Get(ctx context.Context, biztag string) (seg *Segment, err error) {
+	ctx, span := r.start(ctx, "Get", attribute.String("biztag", biztag))
+	defer func() { endSpan(span, err) }()
+	return r.Repository.Get(ctx, biztag)
+}
+
+func (r *tracingRepository) UpdateMaxID(ctx context.Context, biztag string) (seg *Segment, err error) {
+	ctx, span := r.start(ctx, "UpdateMaxID", attribute.String("biztag", biztag))
+	defer func() { endSpan(span, err) }()
+	return r.Repository.UpdateMaxID(ctx, biztag)
+}
+
+func (r *tracingRepository) UpdateMaxIDWithStep(ctx context.Context, biztag string, step int32) (seg *Segment, err error) {
+	ctx, span := r.start(ctx, "UpdateMaxIDWithStep",
+		attribute.String("biztag", biztag), attribute.Int("step", int(step)))
+	defer func() { endSpan(span, err) }()
+	return r.Repository.UpdateMaxIDWithStep(ctx, biztag, step)
+}
+
+func (r *tracingRepository) UpdatePeriodMaxID(ctx context.Context, biztag, period string, step int32) (seg *Segment, err error) {
+	ctx, span := r.start(ctx, "UpdatePeriodMaxID", attribute.String("biztag", biztag),
+		attribute.String("period", period), attribute.Int("step", int(step)))
+	defer func() { endSpan(span, err) }()
+	return r.Repository.UpdatePeriodMaxID(ctx, biztag, period, step)
+}
+
+func (r *tracingRepository) ListBizTags(ctx context.Context) (tags []string, err error) {
+	ctx, span := r.start(ctx, "ListBizTags")
+	defer func() { endSpan(span, err) }()
+	return r.Repository.ListBizTags(ctx)
+}
+
+// RecordLease 在span中保存租用记录
+func (r *tracingRepository) RecordLease(ctx context.Context, lease *Lease) (err error) {
+	ctx, span := r.start(ctx, "RecordLease", attribute.String("biztag", lease.BizTag))
+	defer func() { endSpan(span, err) }()
+	return recordLease(ctx, r.Repository, lease)
+}
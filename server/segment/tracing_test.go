@@ -0,0 +1,44 @@
+package segment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingRepository(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	repo := &testRepo{segs: []*Segment{&Segment{"biztag1", 1, 10, "", time.Now()}}}
+	svc := NewService(NewTracingRepository(repo), log.DefaultLogger)
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+	if _, err := svc.Get(ctx, "biztag1", 5); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+	// 等待后台的更新结束
+	svc.Close()
+
+	// 等待号段的请求和获取号段的调用属于同一个trace
+	names := make(map[string]bool)
+	for _, s := range exporter.GetSpans() {
+		if s.SpanContext.TraceID() == span.SpanContext().TraceID() {
+			names[s.Name] = true
+		}
+	}
+	for _, name := range []string{"segment.wait", "segment.update", "segment.Repository/UpdateMaxID"} {
+		if !names[name] {
+			t.Errorf("span %s not found in trace, spans = %v", name, names)
+		}
+	}
+}
@@ -46,11 +46,11 @@ func (s *Server) Close() (err error) {
 	return nil
 }
 
-func New(svc Service, logger log.Logger) (*Server, error) {
+func New(svc Service, logger log.Logger, opts ...HandlerOption) (*Server, error) {
 	if logger == nil {
 		logger = log.DefaultLogger
 	}
-	hdlr := NewHttpHandler(svc, logger)
+	hdlr := NewHttpHandler(svc, logger, opts...)
 	s := &Server{
 		logger:  logger,
 		svc:     svc,
@@ -3,13 +3,30 @@ package server
 import (
 	"context"
 
+	"github.com/derry6/gleafd/server/code"
+	"github.com/derry6/gleafd/server/obfuscate"
 	"github.com/derry6/gleafd/server/segment"
 	"github.com/derry6/gleafd/server/snowflake"
+	"github.com/derry6/gleafd/server/uuid"
 )
 
 type Service interface {
-	GetSegments(ctx context.Context, biztag string, count int) (ids []int64, err error)
+	// 按周期重置的biztag同时返回ID所在的周期, ID只在周期内唯一
+	GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error)
+	// 以连续范围[start, end)的形式返回count个segment ID
+	GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error)
 	GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error)
+	DecodeSnowflake(ctx context.Context, biztag string, id int64) (info *snowflake.IDInfo, err error)
+	GetUUIDs(ctx context.Context, biztag string, count int) (ids []string, err error)
+	GetULIDs(ctx context.Context, biztag string, count int) (ids []string, err error)
+	// 租用size个连续的segment ID, client用于审计
+	LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error)
+	// 将segment ID映射为不可猜测的ID
+	GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error)
+	DecodeObfuscatedSegment(ctx context.Context, biztag string, id string) (decoded *obfuscate.Decoded, err error)
+	GetCodes(ctx context.Context, biztag string, count int) (codes []string, err error)
+	// 通知所有节点biztag的创建, 修改和删除, event为created|updated|deleted
+	NotifyBizTag(ctx context.Context, biztag, event string) error
 	HealthCheck(ctx context.Context, name string) (status int, err error)
 	Close() error
 }
@@ -17,14 +34,24 @@ type Service interface {
 type gleafService struct {
 	name    string
 	segsvc  *segment.Service
+	codesvc *code.Service
+	obfsvc  *obfuscate.Service
 	snowsvc *snowflake.Service
+	uuidsvc *uuid.Service
 }
 
-func (glfs *gleafService) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+func (glfs *gleafService) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	if glfs.segsvc == nil {
+		return nil, "", ErrServiceDisabled
+	}
+	return glfs.segsvc.GetWithPeriod(ctx, biztag, count)
+}
+
+func (glfs *gleafService) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
 	if glfs.segsvc == nil {
 		return nil, ErrServiceDisabled
 	}
-	return glfs.segsvc.Get(ctx, biztag, count)
+	return glfs.segsvc.GetRanges(ctx, biztag, count)
 }
 
 func (glfs *gleafService) GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error) {
@@ -34,11 +61,75 @@ func (glfs *gleafService) GetSnowflakes(ctx context.Context, biztag string, coun
 	return glfs.snowsvc.Get(ctx, biztag, count)
 }
 
+func (glfs *gleafService) DecodeSnowflake(ctx context.Context, biztag string, id int64) (info *snowflake.IDInfo, err error) {
+	if glfs.snowsvc == nil {
+		return nil, ErrServiceDisabled
+	}
+	return glfs.snowsvc.Decode(biztag, id)
+}
+
+func (glfs *gleafService) GetUUIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if glfs.uuidsvc == nil {
+		return nil, ErrServiceDisabled
+	}
+	return glfs.uuidsvc.GetUUIDs(ctx, biztag, count)
+}
+
+func (glfs *gleafService) GetULIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if glfs.uuidsvc == nil {
+		return nil, ErrServiceDisabled
+	}
+	return glfs.uuidsvc.GetULIDs(ctx, biztag, count)
+}
+
+func (glfs *gleafService) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	if glfs.segsvc == nil {
+		return nil, ErrServiceDisabled
+	}
+	return glfs.segsvc.Lease(ctx, biztag, size, client)
+}
+
+func (glfs *gleafService) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if glfs.obfsvc == nil {
+		return nil, ErrServiceDisabled
+	}
+	return glfs.obfsvc.Get(ctx, biztag, count)
+}
+
+func (glfs *gleafService) DecodeObfuscatedSegment(ctx context.Context, biztag string, id string) (decoded *obfuscate.Decoded, err error) {
+	if glfs.obfsvc == nil {
+		return nil, ErrServiceDisabled
+	}
+	return glfs.obfsvc.Decode(ctx, biztag, id)
+}
+
+func (glfs *gleafService) GetCodes(ctx context.Context, biztag string, count int) (codes []string, err error) {
+	if glfs.codesvc == nil {
+		return nil, ErrServiceDisabled
+	}
+	return glfs.codesvc.Get(ctx, biztag, count)
+}
+
+func (glfs *gleafService) NotifyBizTag(ctx context.Context, biztag, event string) error {
+	if glfs.segsvc == nil {
+		return ErrServiceDisabled
+	}
+	return glfs.segsvc.NotifyBizTag(ctx, segment.BizTagEvent{Type: event, BizTag: biztag})
+}
+
 func (glfs *gleafService) HealthCheck(ctx context.Context, name string) (status int, err error) {
+	if glfs.snowsvc != nil {
+		if err = glfs.snowsvc.HealthCheck(); err != nil {
+			return 0, err
+		}
+	}
 	return 1, nil
 }
 
 func (glfs *gleafService) Close() (err error) {
+	if glfs.uuidsvc != nil {
+		glfs.uuidsvc.Close()
+	}
 	if glfs.snowsvc != nil {
 		glfs.snowsvc.Close()
 	}
@@ -56,18 +147,30 @@ func NewService(opts ...Option) Service {
 	glfsvc := &gleafService{name: sopts.name}
 
 	if sopts.repo != nil {
-		// segment service
-		segsvc := segment.NewService(sopts.repo, sopts.logger)
+		// segment service, 数据库中不符合ValidateBizTag的biztag加载时告警
+		segOpts := append([]segment.Option{segment.WithBizTagValidator(ValidateBizTag)}, sopts.segOpts...)
+		segsvc := segment.NewService(sopts.repo, sopts.logger, segOpts...)
 		glfsvc.segsvc = segsvc
+		if len(sopts.codeTemplates) > 0 {
+			glfsvc.codesvc = code.NewService(segsvc, sopts.codeTemplates, sopts.logger)
+		}
+		if len(sopts.obfuscators) > 0 {
+			glfsvc.obfsvc = obfuscate.NewService(segsvc, sopts.obfuscators, sopts.logger)
+		}
 	}
 	if sopts.stor != nil {
 		// snowflake service
-		snowsvc := snowflake.NewService(sopts.name, sopts.addr, sopts.stor, sopts.logger)
+		snowsvc := snowflake.NewService(sopts.name, sopts.addr, sopts.stor, sopts.logger, sopts.snowOpts...)
 		glfsvc.snowsvc = snowsvc
 	}
+	if sopts.uuidEnabled {
+		// uuid service
+		glfsvc.uuidsvc = uuid.NewService(sopts.logger, sopts.uuidOpts...)
+	}
 	var s Service = glfsvc
 	for _, mdw := range sopts.mdws {
 		s = mdw(s)
 	}
-	return s
+	// 参数检查最先执行, 被拒绝的请求也会记录在trace中
+	return Tracing()(Validation(sopts.limits)(s))
 }
@@ -0,0 +1,114 @@
+package snowflake
+
+import (
+	"context"
+	"expvar"
+	"hash/fnv"
+	"time"
+)
+
+var biztagIDsTotal = expvar.NewMap("snowflake_biztag_ids_total")
+
+// factoryPool 共享machineID的一组factory, 每个序列号分片一个
+type factoryPool struct {
+	fs       chan Factory // 使用chan 代替使用锁
+	refs     int          // 正在使用的请求数量, 由Service.tagsMu保护
+	lastUsed int64        // 最后使用的时间(毫秒), 由Service.tagsMu保护
+}
+
+func (p *factoryPool) get(ctx context.Context, count int) ([]int64, error) {
+	var f Factory
+	select {
+	case f = <-p.fs:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// fs的容量等于factory的数量, 放回时不会阻塞
+	defer func() { p.fs <- f }()
+	return f.NextN(count)
+}
+
+func (s *Service) newFactoryPool(tag int) (*factoryPool, error) {
+	p := &factoryPool{
+		fs:       make(chan Factory, 1<<s.opts.shardBits),
+		lastUsed: nowMs(),
+	}
+	for shard := 0; shard < cap(p.fs); shard++ {
+		// 新建的factory不会使用小于s.wm的时间戳, 所以biztag被回收后重新创建也不会重复
+		f, err := newFactory(factoryConfig{
+			layout:    s.opts.layout,
+			machineID: s.md.MachineID,
+			tag:       tag,
+			tagBits:   s.opts.tagBits,
+			shard:     shard,
+			shardBits: s.opts.shardBits,
+			wm:        &s.wm,
+			policy:    s.policy,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.fs <- f
+	}
+	return p, nil
+}
+
+// BizTagValue 返回biztag在ID中的编号, bits为0时总是0
+func BizTagValue(biztag string, bits uint8) int {
+	if bits == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(biztag))
+	return int(h.Sum32() & (1<<bits - 1))
+}
+
+// 查找biztag对应的factoryPool, 不存在则创建。
+// factoryPool按biztag的hash查找, hash相同的biztag共享序列号, 否则ID会重复
+func (s *Service) acquire(biztag string) (*factoryPool, error) {
+	if !s.opts.perBizTag {
+		return s.pool, nil
+	}
+	tag := BizTagValue(biztag, s.opts.tagBits)
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	p, ok := s.tags[tag]
+	if !ok {
+		var err error
+		if p, err = s.newFactoryPool(tag); err != nil {
+			return nil, err
+		}
+		s.tags[tag] = p
+		s.logger.Debugw("Snowflake biztag created", "biztag", biztag, "tag", tag)
+	}
+	p.refs++
+	return p, nil
+}
+
+func (s *Service) release(p *factoryPool) {
+	if !s.opts.perBizTag {
+		return
+	}
+	s.tagsMu.Lock()
+	p.refs--
+	p.lastUsed = nowMs()
+	s.tagsMu.Unlock()
+}
+
+// 回收超过idle没有使用的biztag
+func (s *Service) evictIdleBizTags(idle time.Duration) {
+	now := nowMs()
+	idleMs := idle.Nanoseconds() / 1000000
+	var evicted []int
+	s.tagsMu.Lock()
+	for tag, p := range s.tags {
+		if p.refs == 0 && now-p.lastUsed > idleMs {
+			delete(s.tags, tag)
+			evicted = append(evicted, tag)
+		}
+	}
+	s.tagsMu.Unlock()
+	if len(evicted) > 0 {
+		s.logger.Debugw("Snowflake biztags evicted", "tags", evicted)
+	}
+}
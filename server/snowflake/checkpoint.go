@@ -0,0 +1,96 @@
+package snowflake
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 每次保存的租约比需要的时间戳多1秒, 重启时最多等待1秒
+const checkpointLease = time.Second
+
+// Checkpoint 在本地保存可以发放ID的时间戳租约(毫秒), 发放的ID不会超过保存的时间戳
+type Checkpoint interface {
+	Load() (int64, error)
+	Save(ts int64) error
+}
+
+type fileCheckpoint struct {
+	fileName string
+}
+
+// NewFileCheckpoint 使用本地文件保存时间戳, 文件不存在时Load返回0
+func NewFileCheckpoint(fileName string) Checkpoint {
+	return &fileCheckpoint{fileName: fileName}
+}
+
+func (cp *fileCheckpoint) Load() (int64, error) {
+	data, err := ioutil.ReadFile(cp.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// 先写临时文件再rename, 避免写入过程中崩溃导致文件损坏
+func (cp *fileCheckpoint) Save(ts int64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(cp.fileName), filepath.Base(cp.fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(strconv.FormatInt(ts, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cp.fileName)
+}
+
+// watermark 记录已经发放的最大时间戳, 由factory更新。
+// extend不为nil时, 超过租约之前先同步保存新的租约, 保存失败时不能发放
+type watermark struct {
+	ts     int64
+	lease  int64
+	mu     sync.Mutex
+	extend func(ts int64) (int64, error)
+}
+
+func (w *watermark) load() int64 {
+	return atomic.LoadInt64(&w.ts)
+}
+
+func (w *watermark) advance(ts int64) error {
+	if w.extend != nil && ts > atomic.LoadInt64(&w.lease) {
+		w.mu.Lock()
+		if ts > atomic.LoadInt64(&w.lease) {
+			lease, err := w.extend(ts)
+			if err != nil {
+				w.mu.Unlock()
+				return err
+			}
+			atomic.StoreInt64(&w.lease, lease)
+		}
+		w.mu.Unlock()
+	}
+	for {
+		old := atomic.LoadInt64(&w.ts)
+		if ts <= old || atomic.CompareAndSwapInt64(&w.ts, old, ts) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package snowflake
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+)
+
+const (
+	RollbackFailFast = "fail"
+	RollbackWait     = "wait"
+	RollbackBorrow   = "borrow"
+)
+
+var clockBackwardsTotal = expvar.NewMap("snowflake_clock_backwards_total")
+
+// ClockRollbackPolicy 处理系统时钟回拨。
+// 当前时间now小于需要的最小时间戳min时调用, 返回一个不小于min的时间戳用于生成ID,
+// 或者返回错误。
+type ClockRollbackPolicy interface {
+	Backwards(min, now int64) (int64, error)
+}
+
+type failFastPolicy struct{}
+
+// FailFast 时钟回拨时直接返回ErrClockMoveBackwards
+func FailFast() ClockRollbackPolicy {
+	return failFastPolicy{}
+}
+
+func (failFastPolicy) Backwards(min, now int64) (int64, error) {
+	return 0, ErrClockMoveBackwards
+}
+
+func (failFastPolicy) String() string {
+	return RollbackFailFast
+}
+
+type waitPolicy struct {
+	max int64
+}
+
+// WaitUpTo 回拨不超过max时等待系统时间追上, 否则返回ErrClockMoveBackwards
+func WaitUpTo(max time.Duration) ClockRollbackPolicy {
+	return waitPolicy{max: int64(max / time.Millisecond)}
+}
+
+func (p waitPolicy) Backwards(min, now int64) (int64, error) {
+	if min-now > p.max {
+		return 0, ErrClockMoveBackwards
+	}
+	time.Sleep(time.Duration(min-now) * time.Millisecond)
+	for now = nowMs(); now < min; now = nowMs() {
+		time.Sleep(100 * time.Microsecond)
+	}
+	return now, nil
+}
+
+func (p waitPolicy) String() string {
+	return fmt.Sprintf("%s(%dms)", RollbackWait, p.max)
+}
+
+type borrowPolicy struct {
+	max int64
+}
+
+// BorrowFuture 回拨不超过max时继续使用最后的时间戳, 序列号用完后借用之后的时间戳,
+// 保证回拨期间ID仍然可以持续发放。超过max时返回ErrClockMoveBackwards。
+func BorrowFuture(max time.Duration) ClockRollbackPolicy {
+	return borrowPolicy{max: int64(max / time.Millisecond)}
+}
+
+func (p borrowPolicy) Backwards(min, now int64) (int64, error) {
+	if min-now > p.max {
+		return 0, ErrClockMoveBackwards
+	}
+	return min, nil
+}
+
+func (p borrowPolicy) String() string {
+	return fmt.Sprintf("%s(%dms)", RollbackBorrow, p.max)
+}
+
+// ParseClockRollbackPolicy 根据配置创建回拨处理策略
+func ParseClockRollbackPolicy(mode string, max time.Duration) (ClockRollbackPolicy, error) {
+	switch mode {
+	case RollbackFailFast:
+		return FailFast(), nil
+	case "", RollbackWait:
+		return WaitUpTo(max), nil
+	case RollbackBorrow:
+		return BorrowFuture(max), nil
+	default:
+		return nil, fmt.Errorf("unknown clock rollback policy: %s", mode)
+	}
+}
+
+// 是否借用之后的时间戳
+func isBorrowPolicy(policy ClockRollbackPolicy) bool {
+	if p, ok := policy.(*observedPolicy); ok {
+		policy = p.ClockRollbackPolicy
+	}
+	_, ok := policy.(borrowPolicy)
+	return ok
+}
+
+// ObservePolicy 记录每次时钟回拨的处理结果, 日志每秒最多输出一次
+func ObservePolicy(policy ClockRollbackPolicy, logger log.Logger) ClockRollbackPolicy {
+	return &observedPolicy{ClockRollbackPolicy: policy, logger: logger}
+}
+
+type observedPolicy struct {
+	ClockRollbackPolicy
+	logger     log.Logger
+	mu         sync.Mutex
+	lastLog    time.Time
+	suppressed int
+}
+
+func (p *observedPolicy) Backwards(min, now int64) (int64, error) {
+	ts, err := p.ClockRollbackPolicy.Backwards(min, now)
+	if err != nil {
+		clockBackwardsTotal.Add("failed", 1)
+	} else {
+		clockBackwardsTotal.Add("handled", 1)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastLog) < time.Second {
+		p.suppressed++
+		return ts, err
+	}
+	p.logger.Warnw("System clock moved backwards",
+		"policy", p.ClockRollbackPolicy, "offset", min-now, "ts", ts, "err", err, "suppressed", p.suppressed)
+	p.lastLog = time.Now()
+	p.suppressed = 0
+	return ts, err
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / 1000000
+}
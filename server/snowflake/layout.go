@@ -0,0 +1,105 @@
+package snowflake
+
+import (
+	"fmt"
+	"time"
+)
+
+// Layout ID的位分布: 1位符号位 + 时间 + machineID + 序列号
+type Layout struct {
+	Name          string
+	TimeUnit      time.Duration // 时间戳的单位, 必须是毫秒的整数倍
+	TimeBits      uint8
+	MachineIDBits uint8
+	SeqBits       uint8
+}
+
+var (
+	// DefaultLayout 1+41+10+12, 毫秒精度, 约69年, 1024台机器, 每毫秒4096个ID
+	DefaultLayout = Layout{
+		Name:          "default",
+		TimeUnit:      time.Millisecond,
+		TimeBits:      41,
+		MachineIDBits: MachineIDBits,
+		SeqBits:       SeqBits,
+	}
+	// SonyflakeLayout 1+39+16+8, 10毫秒精度, 约174年, 65536台机器, 每10毫秒256个ID
+	SonyflakeLayout = Layout{
+		Name:          "sonyflake",
+		TimeUnit:      10 * time.Millisecond,
+		TimeBits:      39,
+		MachineIDBits: 16,
+		SeqBits:       8,
+	}
+)
+
+func LayoutByName(name string) (Layout, error) {
+	switch name {
+	case "", DefaultLayout.Name:
+		return DefaultLayout, nil
+	case SonyflakeLayout.Name:
+		return SonyflakeLayout, nil
+	default:
+		return Layout{}, fmt.Errorf("unknown snowflake layout: %s", name)
+	}
+}
+
+func (l Layout) validate() error {
+	if l.TimeBits+l.MachineIDBits+l.SeqBits != 63 {
+		return fmt.Errorf("invalid snowflake layout %s: total bits must be 63", l.Name)
+	}
+	if l.TimeUnit < time.Millisecond || l.TimeUnit%time.Millisecond != 0 {
+		return fmt.Errorf("invalid snowflake layout %s: time unit must be a multiple of 1ms", l.Name)
+	}
+	if l.SeqBits < 4 {
+		return fmt.Errorf("invalid snowflake layout %s: at least 4 sequence bits", l.Name)
+	}
+	return nil
+}
+
+// 每个时间单位的毫秒数
+func (l Layout) unitMs() int64 {
+	return int64(l.TimeUnit / time.Millisecond)
+}
+
+func (l Layout) MachineIDMax() int {
+	return -1 ^ (-1 << l.MachineIDBits)
+}
+
+func (l Layout) SeqMask() int32 {
+	return -1 ^ (-1 << l.SeqBits)
+}
+
+// MaxShardBits 每个分片至少保留16个序列号
+func (l Layout) MaxShardBits() uint8 {
+	return l.SeqBits - 4
+}
+
+// IDInfo 解析后的ID
+type IDInfo struct {
+	ID        int64     `json:"id"`
+	Layout    string    `json:"layout"`
+	Time      time.Time `json:"time"`
+	MachineID int       `json:"machine_id"`
+	Sequence  int       `json:"sequence"`
+	Tag       int       `json:"tag"`   // biztag的编号, 没有嵌入biztag时为0
+	Shard     int       `json:"shard"` // 序列号分片, 没有分片时为0
+}
+
+// Decode 按照layout解析ID, tagBits和shardBits需要与生成ID时相同
+func (l Layout) Decode(id int64, tagBits, shardBits uint8) IDInfo {
+	seq := int32(id) & l.SeqMask()
+	machineID := int(id>>l.SeqBits) & l.MachineIDMax()
+	ticks := id >> (l.SeqBits + l.MachineIDBits)
+	ms := epoch + ticks*l.unitMs()
+	localBits := l.SeqBits - tagBits - shardBits
+	return IDInfo{
+		ID:        id,
+		Layout:    l.Name,
+		Time:      time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)),
+		MachineID: machineID,
+		Sequence:  int(seq & (-1 ^ (-1 << localBits))),
+		Tag:       int(seq >> (l.SeqBits - tagBits)),
+		Shard:     int(seq>>localBits) & (-1 ^ (-1 << shardBits)),
+	}
+}
@@ -5,4 +5,5 @@ type Metadata struct {
 	Addr      string // 监听IP:PORT
 	MachineID int    // 机器ID 0 - 1023
 	Timestamp int64  // 最后更新的时间
+	Layout    string // 生成ID使用的layout, 为空表示由不支持layout的版本创建, 使用的是DefaultLayout
 }
@@ -0,0 +1,126 @@
+package snowflake
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Options struct {
+	layout         Layout
+	shards         int
+	shardBits      uint8
+	perBizTag      bool
+	bizTagIdle     time.Duration
+	tagBits        uint8
+	policy         ClockRollbackPolicy
+	checkpoint     Checkpoint
+	maxStartupWait time.Duration
+	// 时钟偏差检查
+	skewThreshold     time.Duration
+	skewCheckInterval time.Duration
+	peerStaleAfter    time.Duration
+}
+
+func newDefaultOptions() *Options {
+	return &Options{
+		layout:            DefaultLayout,
+		shards:            1,
+		policy:            defaultRollbackPolicy,
+		maxStartupWait:    5 * time.Second,
+		skewCheckInterval: time.Minute,
+		peerStaleAfter:    time.Minute,
+	}
+}
+
+type Option func(opts *Options)
+
+// WithCheckpoint 发放的时间戳超过本地保存的租约之前同步保存新的租约, 重启时等待系统时间超过租约
+func WithCheckpoint(cp Checkpoint) Option {
+	return func(opts *Options) {
+		opts.checkpoint = cp
+	}
+}
+
+// WithMaxStartupWait 启动时系统时间落后于最后发放ID的时间戳时, 最多等待的时间。
+// 超过该时间则拒绝启动。
+func WithMaxStartupWait(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.maxStartupWait = d
+	}
+}
+
+// WithClockSkewCheck 启动时以及每隔interval比较本机时间与其它节点的平均时间,
+// 偏差超过threshold时拒绝服务。threshold为0时不检查。
+func WithClockSkewCheck(threshold, interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.skewThreshold = threshold
+		if interval > 0 {
+			opts.skewCheckInterval = interval
+		}
+	}
+}
+
+// WithPeerStaleAfter 时间戳比最新上报的节点落后超过该时间的节点不参与时钟偏差计算
+func WithPeerStaleAfter(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.peerStaleAfter = d
+	}
+}
+
+// WithClockRollbackPolicy 设置系统时钟回拨时的处理策略, BorrowFuture需要同时设置WithCheckpoint
+func WithClockRollbackPolicy(policy ClockRollbackPolicy) Option {
+	return func(opts *Options) {
+		opts.policy = policy
+	}
+}
+
+// WithShards 将序列号空间分成shards个分片, 每个分片使用单独的factory并发生成ID。
+// shards必须是2的幂, 否则NewService拒绝启动, 每个分片每毫秒最多生成4096/shards个ID。
+// shards大于1时, 同一节点并发请求之间的ID不再保证递增, 单个请求内仍然是递增的。
+func WithShards(shards int) Option {
+	return func(opts *Options) {
+		opts.shards = shards
+	}
+}
+
+// WithPerBizTag 每个biztag使用单独的序列号, 在第一次请求时创建, 超过idle没有使用时回收。
+// 序列号的最高tagBits位为biztag的hash, 用于区分不同biztag生成的ID, tagBits必须大于0。
+// hash相同的biztag共享同一个序列号, 之间的ID不会重复。
+func WithPerBizTag(idle time.Duration, tagBits uint8) Option {
+	return func(opts *Options) {
+		opts.perBizTag = true
+		opts.bizTagIdle = idle
+		opts.tagBits = tagBits
+	}
+}
+
+// 检查选项并计算shardBits
+func (opts *Options) validate() error {
+	if opts.shards < 1 || opts.shards&(opts.shards-1) != 0 {
+		return fmt.Errorf("%w: %d is not a power of 2", ErrInvalidShards, opts.shards)
+	}
+	opts.shardBits = 0
+	for 1<<opts.shardBits < opts.shards {
+		opts.shardBits++
+	}
+	if opts.perBizTag && opts.bizTagIdle <= 0 {
+		return errors.New("biztag idle timeout must be positive")
+	}
+	// 借用的时间戳超过当前时间, 没有本地租约时重启之后可能重复发放
+	if isBorrowPolicy(opts.policy) && opts.checkpoint == nil {
+		return errors.New("borrow clock rollback policy requires a checkpoint")
+	}
+	// 没有biztag的hash时不同biztag的ID会重复
+	if opts.perBizTag && opts.tagBits == 0 {
+		return errors.New("per biztag sequence requires biztag bits > 0")
+	}
+	return nil
+}
+
+// WithLayout 设置ID的位分布, 例如SonyflakeLayout
+func WithLayout(layout Layout) Option {
+	return func(opts *Options) {
+		opts.layout = layout
+	}
+}
@@ -2,7 +2,6 @@ package snowflake
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -12,13 +11,20 @@ import (
 )
 
 type Service struct {
-	md     Metadata
-	stor   Storage
-	fs     chan Factory // 使用chan 代替使用锁
-	logger log.Logger
-	wg     sync.WaitGroup
-	closed int32 // 退出标记
-	closeC chan struct{}
+	md   Metadata
+	stor Storage
+	opts *Options
+	wm   watermark // 已经发放的最大时间戳
+	// 时钟偏差超过阈值时不为nil
+	skewErr atomic.Value
+	policy  ClockRollbackPolicy
+	pool    *factoryPool         // 所有biztag共享的factory
+	tags    map[int]*factoryPool // 每个biztag的hash单独的factory
+	tagsMu  sync.Mutex
+	logger  log.Logger
+	wg      sync.WaitGroup
+	closed  int32 // 退出标记
+	closeC  chan struct{}
 }
 
 func (s *Service) start() error {
@@ -36,7 +42,57 @@ func (s *Service) start() error {
 }
 
 func (s *Service) isValidMachineID(id int) bool {
-	return id >= 0 && id < 1023
+	return id >= 0 && id <= s.opts.layout.MachineIDMax()
+}
+
+// 相同epoch下切换layout之后生成的ID可能小于之前的ID, 甚至与之前的ID重复, 拒绝启动
+func (s *Service) checkLayout(md Metadata) error {
+	prev := md.Layout
+	if prev == "" {
+		if md.Timestamp <= 0 {
+			// 新节点
+			return nil
+		}
+		prev = DefaultLayout.Name
+	}
+	if prev != s.opts.layout.Name {
+		return fmt.Errorf("snowflake layout of %s@%s changed from %s to %s, IDs would not be ordered and may duplicate",
+			md.Name, md.Addr, prev, s.opts.layout.Name)
+	}
+	return nil
+}
+
+// 最后发放ID的时间戳, 取storage和本地checkpoint中较大的值
+func (s *Service) lastIssued(md Metadata) (int64, error) {
+	last := md.Timestamp
+	if s.opts.checkpoint != nil {
+		ts, err := s.opts.checkpoint.Load()
+		if err != nil {
+			return 0, fmt.Errorf("load checkpoint: %v", err)
+		}
+		if ts > last {
+			last = ts
+		}
+	}
+	return last, nil
+}
+
+// 等待系统时间超过last, 避免时钟回拨后重启时重复发放ID
+func (s *Service) waitUntil(last int64) error {
+	now := s.nowMs()
+	if now > last {
+		return nil
+	}
+	wait := time.Duration(last-now+1) * time.Millisecond
+	if wait > s.opts.maxStartupWait {
+		return fmt.Errorf("system clock is %v behind the last issued timestamp %d", wait, last)
+	}
+	s.logger.Warnw("Waiting for system clock", "last", last, "now", now, "wait", wait)
+	time.Sleep(wait)
+	for s.nowMs() <= last {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
 }
 
 func (s *Service) init() error {
@@ -45,26 +101,52 @@ func (s *Service) init() error {
 	if err != nil {
 		return err
 	}
-	if s.isValidMachineID(md.MachineID) {
-		s.md.MachineID = md.MachineID
-		// 检查时间
-		if md.Timestamp > s.nowMs() {
-			return fmt.Errorf("last update time greate than current time")
-		}
-		return s.start()
-	} else {
-		return fmt.Errorf("invalid machine id: %v", s.md.MachineID)
+	if !s.isValidMachineID(md.MachineID) {
+		return fmt.Errorf("invalid machine id: %v", md.MachineID)
+	}
+	s.md.MachineID = md.MachineID
+	if err = s.checkLayout(md); err != nil {
+		return err
 	}
+	s.md.Layout = s.opts.layout.Name
+	// 检查时间
+	last, err := s.lastIssued(md)
+	if err != nil {
+		return err
+	}
+	if err = s.waitUntil(last); err != nil {
+		return err
+	}
+	s.wm.advance(last)
+	if s.opts.checkpoint != nil {
+		s.wm.extend = s.extendLease
+	}
+	s.updateClockSkew()
+	return s.start()
 }
 
 func (s *Service) run() error {
 	timer := time.NewTicker(3 * time.Second)
+	defer timer.Stop()
+	skewTimer := time.NewTicker(s.opts.skewCheckInterval)
+	defer skewTimer.Stop()
+	var evictC <-chan time.Time
+	if s.opts.perBizTag {
+		evictTimer := time.NewTicker(s.opts.bizTagIdle / 2)
+		defer evictTimer.Stop()
+		evictC = evictTimer.C
+	}
 	for {
 		select {
 		case <-s.closeC:
-			return errors.New("service closed")
+			return ErrClosed
+		case <-skewTimer.C:
+			s.updateClockSkew()
+		case <-evictC:
+			s.evictIdleBizTags(s.opts.bizTagIdle)
 		case <-timer.C:
 			if err := s.update(); err != nil {
+				s.logger.Warnw("Update snowflake metadata", "err", err)
 			}
 		}
 	}
@@ -74,71 +156,108 @@ func (s *Service) nowMs() int64 {
 	return time.Now().UnixNano() / 1000000
 }
 
+// 保存已经发放的最大时间戳, borrow策略发放的时间戳可能超过当前时间
 func (s *Service) update() error {
-	now := s.nowMs()
-	if s.md.Timestamp > now {
+	ts := s.nowMs()
+	if issued := s.wm.load(); issued > ts {
+		ts = issued
+	}
+	if s.md.Timestamp > ts {
 		return nil
 	}
-	s.md.Timestamp = now
+	s.md.Timestamp = ts
 	return s.stor.Update(context.Background(), s.md)
 }
 
+// 发放的时间戳超过租约之前同步保存新的租约到本地, 租约为ts+checkpointLease。
+// 重启时等待系统时间超过租约, 租约越长重启时可能需要等待的时间越长
+func (s *Service) extendLease(ts int64) (int64, error) {
+	lease := ts + int64(checkpointLease/time.Millisecond)
+	if err := s.opts.checkpoint.Save(lease); err != nil {
+		s.logger.Warnw("Save snowflake checkpoint", "lease", lease, "err", err)
+		return 0, err
+	}
+	return lease, nil
+}
+
 func (s *Service) Close() error {
 	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
 		close(s.closeC)
-		close(s.fs)
 		s.wg.Wait()
 	}
 	return nil
 }
 
-func (s *Service) Get(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+// HealthCheck 时钟偏差超过阈值时返回ClockSkewError, 关闭之后返回ErrClosed
+func (s *Service) HealthCheck() error {
 	if atomic.LoadInt32(&s.closed) == 1 {
-		return nil, errors.New("service closed")
+		return ErrClosed
 	}
-	gen := func() (id int64, er error) {
-		var f Factory
-		select {
-		case f = <-s.fs:
-		case <-ctx.Done():
-			return 0, ctx.Err()
-		}
-		defer func() {
-			select {
-			case s.fs <- f:
-			case <-ctx.Done():
-				id = 0
-				er = ctx.Err()
-				return
-			}
-		}()
-		return f.Next()
+	if skewErr := s.skewErr.Load().(*ClockSkewError); skewErr != nil {
+		return skewErr
 	}
-	for i := 0; i < count; i++ {
-		id, err := gen()
-		if err != nil {
-			return nil, err
-		}
-		ids = append(ids, id)
+	return nil
+}
+
+func (s *Service) Get(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	if err = s.HealthCheck(); err != nil {
+		return nil, err
 	}
-	return ids, nil
+	p, err := s.acquire(biztag)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(p)
+	if ids, err = p.get(ctx, count); err == nil {
+		biztagIDsTotal.Add(biztag, int64(len(ids)))
+	}
+	return ids, err
+}
+
+// Decode 按照当前的layout解析ID
+func (s *Service) Decode(biztag string, id int64) (*IDInfo, error) {
+	if id <= 0 {
+		return nil, fmt.Errorf("invalid snowflake id: %d", id)
+	}
+	var tagBits uint8
+	if s.opts.perBizTag {
+		tagBits = s.opts.tagBits
+	}
+	info := s.opts.layout.Decode(id, tagBits, s.opts.shardBits)
+	return &info, nil
 }
 
-func NewService(name, addr string, storage Storage, logger log.Logger) *Service {
+func NewService(name, addr string, storage Storage, logger log.Logger, opts ...Option) *Service {
+	sopts := newDefaultOptions()
+	for _, o := range opts {
+		o(sopts)
+	}
 	s := &Service{
 		md: Metadata{
 			Name: name,
 			Addr: addr,
 		},
 		stor:   storage,
+		opts:   sopts,
 		closeC: make(chan struct{}),
-		fs:     make(chan Factory, 1),
+		policy: ObservePolicy(sopts.policy, logger),
+		tags:   make(map[int]*factoryPool),
 		logger: logger,
 	}
+	s.skewErr.Store((*ClockSkewError)(nil))
+	if err := sopts.layout.validate(); err != nil {
+		logger.Fatalw("New snowflake service", "err", err)
+	}
+	if err := sopts.validate(); err != nil {
+		logger.Fatalw("New snowflake service", "err", err)
+	}
 	if err := s.init(); err != nil {
 		logger.Fatalw("New snowflake service", "err", err)
 	}
-	f, _ := NewFactory(s.md.MachineID)
-	s.fs <- f
+	pool, err := s.newFactoryPool(0)
+	if err != nil {
+		logger.Fatalw("New snowflake factory", "err", err)
+	}
+	s.pool = pool
 	return s
 }
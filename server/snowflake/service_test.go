@@ -4,9 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/derry6/gleafd/pkg/log"
 )
@@ -55,6 +59,7 @@ func (r *testStorage) Update(ctx context.Context, md Metadata) (err error) {
 	m, ok := r.metadatas[r.key(md.Name, md.Addr)]
 	if ok {
 		m.Timestamp = md.Timestamp
+		m.Layout = md.Layout
 		return nil
 	}
 	return errors.New("not exists")
@@ -100,3 +105,348 @@ func TestServiceGet(t *testing.T) {
 		}
 	}
 }
+
+func TestFileCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gleafd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cp := NewFileCheckpoint(filepath.Join(dir, "snowflake.checkpoint"))
+	// 文件不存在
+	if ts, err := cp.Load(); err != nil || ts != 0 {
+		t.Fatalf("ts = %d, err = %v, want = 0, nil", ts, err)
+	}
+	if err = cp.Save(1234567); err != nil {
+		t.Fatal(err)
+	}
+	if ts, err := cp.Load(); err != nil || ts != 1234567 {
+		t.Fatalf("ts = %d, err = %v, want = 1234567, nil", ts, err)
+	}
+}
+
+func TestServiceWaitsForCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gleafd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cp := NewFileCheckpoint(filepath.Join(dir, "snowflake.checkpoint"))
+	// 模拟重启前时钟比现在快
+	last := time.Now().UnixNano()/1000000 + 50
+	if err = cp.Save(last); err != nil {
+		t.Fatal(err)
+	}
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger,
+		WithCheckpoint(cp), WithMaxStartupWait(time.Second))
+	ids, err := svc.Get(context.Background(), "example", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := ids[0]>>TimeShift + epoch
+	if ts <= last {
+		t.Fatalf("timestamp = %d, must be greater than %d", ts, last)
+	}
+	// 不调用Close, 模拟进程崩溃
+	saved, err := cp.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved < ids[len(ids)-1]>>TimeShift+epoch {
+		t.Fatalf("saved = %d, want >= %d", saved, ids[len(ids)-1]>>TimeShift+epoch)
+	}
+	svc.Close()
+}
+
+type failCheckpoint struct {
+	saves int
+}
+
+func (cp *failCheckpoint) Load() (int64, error) { return 0, nil }
+
+func (cp *failCheckpoint) Save(ts int64) error {
+	cp.saves++
+	return errors.New("disk full")
+}
+
+func TestServiceCheckpointSaveFailed(t *testing.T) {
+	cp := &failCheckpoint{}
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger, WithCheckpoint(cp))
+	defer svc.Close()
+	// 租约保存失败时不能发放ID
+	if _, err := svc.Get(context.Background(), "example", 1); err == nil {
+		t.Fatal("want error when checkpoint can not be saved")
+	}
+	if cp.saves == 0 {
+		t.Fatal("checkpoint not saved")
+	}
+}
+
+func TestServiceClockSkew(t *testing.T) {
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	now := time.Now().UnixNano() / 1000000
+	// 其它节点的时间比本机快10秒
+	stor.metadatas[stor.key("gleafd1", "127.0.0.1:8091")] = &Metadata{
+		Name: "gleafd1", Addr: "127.0.0.1:8091", MachineID: 10, Timestamp: now + 10000}
+	stor.metadatas[stor.key("gleafd2", "127.0.0.1:8092")] = &Metadata{
+		Name: "gleafd2", Addr: "127.0.0.1:8092", MachineID: 11, Timestamp: now + 10000}
+	// 已经下线的节点不参与计算
+	stor.metadatas[stor.key("gleafd3", "127.0.0.1:8093")] = &Metadata{
+		Name: "gleafd3", Addr: "127.0.0.1:8093", MachineID: 12, Timestamp: now - 3600000}
+
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger,
+		WithClockSkewCheck(5*time.Second, time.Minute))
+	defer svc.Close()
+	_, err := svc.Get(context.Background(), "example", 1)
+	skewErr, ok := err.(*ClockSkewError)
+	if !ok {
+		t.Fatalf("err = %v, want ClockSkewError", err)
+	}
+	if len(skewErr.Peers) != 2 {
+		t.Fatalf("peers = %v, want 2 peers", skewErr.Peers)
+	}
+
+	// 其它节点恢复正常
+	stor.Lock()
+	for _, md := range stor.metadatas {
+		if md.Name != "gleafd3" {
+			md.Timestamp = now
+		}
+	}
+	stor.Unlock()
+	svc.updateClockSkew()
+	if _, err = svc.Get(context.Background(), "example", 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceClockSkewLocalAhead(t *testing.T) {
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	now := time.Now().UnixNano() / 1000000
+	// 本机时间比其它节点快2分钟, 超过peerStaleAfter, 其它节点仍然在线
+	stor.metadatas[stor.key("gleafd1", "127.0.0.1:8091")] = &Metadata{
+		Name: "gleafd1", Addr: "127.0.0.1:8091", MachineID: 10, Timestamp: now - 120000}
+	stor.metadatas[stor.key("gleafd2", "127.0.0.1:8092")] = &Metadata{
+		Name: "gleafd2", Addr: "127.0.0.1:8092", MachineID: 11, Timestamp: now - 121000}
+	// 比最新的节点落后超过peerStaleAfter, 已经下线
+	stor.metadatas[stor.key("gleafd3", "127.0.0.1:8093")] = &Metadata{
+		Name: "gleafd3", Addr: "127.0.0.1:8093", MachineID: 12, Timestamp: now - 3600000}
+
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger,
+		WithClockSkewCheck(5*time.Second, time.Minute))
+	defer svc.Close()
+	_, err := svc.Get(context.Background(), "example", 1)
+	skewErr, ok := err.(*ClockSkewError)
+	if !ok {
+		t.Fatalf("err = %v, want ClockSkewError", err)
+	}
+	if len(skewErr.Peers) != 2 || skewErr.Skew < 2*time.Minute {
+		t.Fatalf("skew = %v, peers = %v, want >= 2m and 2 peers", skewErr.Skew, skewErr.Peers)
+	}
+}
+
+func TestServiceShards(t *testing.T) {
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger, WithShards(4))
+	defer svc.Close()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[int64]bool)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ids, err := svc.Get(context.Background(), "example", 100)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				for _, id := range ids {
+					if seen[id] {
+						t.Errorf("duplicated id: %d", id)
+					}
+					seen[id] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 8*100*100 {
+		t.Fatalf("len(ids) = %d, want = %d", len(seen), 8*100*100)
+	}
+}
+
+func TestServiceCheckLayout(t *testing.T) {
+	opts := newDefaultOptions()
+	WithLayout(SonyflakeLayout)(opts)
+	svc := &Service{opts: opts}
+	for _, c := range []struct {
+		md Metadata
+		ok bool
+	}{
+		{Metadata{}, true},
+		{Metadata{Timestamp: 1, Layout: SonyflakeLayout.Name}, true},
+		{Metadata{Timestamp: 1, Layout: DefaultLayout.Name}, false},
+		// 旧版本创建的节点使用的是DefaultLayout
+		{Metadata{Timestamp: 1}, false},
+	} {
+		if err := svc.checkLayout(c.md); (err == nil) != c.ok {
+			t.Fatalf("md = %+v, err = %v, want ok = %v", c.md, err, c.ok)
+		}
+	}
+
+	// 启动之后保存layout
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc = NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger, WithLayout(SonyflakeLayout))
+	defer svc.Close()
+	if md := stor.metadatas[stor.key("gleafd0", "127.0.0.1:8090")]; md.Layout != SonyflakeLayout.Name {
+		t.Fatalf("layout = %s, want = %s", md.Layout, SonyflakeLayout.Name)
+	}
+}
+
+func TestOptionsShards(t *testing.T) {
+	for shards, bits := range map[int]uint8{1: 0, 2: 1, 4: 2, 64: 6} {
+		opts := newDefaultOptions()
+		WithShards(shards)(opts)
+		if err := opts.validate(); err != nil || opts.shardBits != bits {
+			t.Fatalf("shards = %d, shardBits = %d, err = %v, want = %d, nil", shards, opts.shardBits, err, bits)
+		}
+	}
+	for _, shards := range []int{0, -1, 3, 6} {
+		opts := newDefaultOptions()
+		WithShards(shards)(opts)
+		if err := opts.validate(); !errors.Is(err, ErrInvalidShards) {
+			t.Fatalf("shards = %d, err = %v, want = %v", shards, err, ErrInvalidShards)
+		}
+	}
+}
+
+func TestOptionsBorrowRequiresCheckpoint(t *testing.T) {
+	opts := newDefaultOptions()
+	WithClockRollbackPolicy(ObservePolicy(BorrowFuture(time.Second), log.DefaultLogger))(opts)
+	if err := opts.validate(); err == nil {
+		t.Fatal("borrow without checkpoint accepted")
+	}
+	WithCheckpoint(NewFileCheckpoint(filepath.Join(t.TempDir(), "checkpoint")))(opts)
+	if err := opts.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceUpdateIssuedTimestamp(t *testing.T) {
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger)
+	defer svc.Close()
+	// 借用的时间戳超过当前时间时保存实际发放的时间戳
+	issued := svc.nowMs() + 10000
+	svc.wm.advance(issued)
+	if err := svc.update(); err != nil {
+		t.Fatal(err)
+	}
+	mds, _ := stor.List(context.Background())
+	if len(mds) != 1 || mds[0].Timestamp != issued {
+		t.Fatalf("metadata = %+v, want timestamp = %d", mds, issued)
+	}
+}
+
+func benchmarkServiceGetParallel(b *testing.B, shards int) {
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger, WithShards(shards))
+	defer svc.Close()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := svc.Get(context.Background(), "example", 10); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkServiceGetParallel1(b *testing.B) { benchmarkServiceGetParallel(b, 1) }
+func BenchmarkServiceGetParallel4(b *testing.B) { benchmarkServiceGetParallel(b, 4) }
+
+func TestServicePerBizTag(t *testing.T) {
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger,
+		WithPerBizTag(time.Minute, 2))
+	defer svc.Close()
+
+	seen := make(map[int64]bool)
+	for _, biztag := range []string{"orders", "users", "orders"} {
+		ids, err := svc.Get(context.Background(), biztag, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if tag := (int32(id) & SeqMask) >> (SeqBits - 2); int(tag) != BizTagValue(biztag, 2) {
+				t.Fatalf("biztag = %s, tag of id = %d, want = %d", biztag, tag, BizTagValue(biztag, 2))
+			}
+			if biztag == "orders" && seen[id] {
+				t.Fatalf("duplicated id: %d", id)
+			}
+			seen[id] = true
+		}
+	}
+	if len(svc.tags) != 2 {
+		t.Fatalf("len(tags) = %d, want = 2", len(svc.tags))
+	}
+
+	// 回收之后重新创建, ID仍然递增
+	last := svc.wm.load()
+	time.Sleep(2 * time.Millisecond)
+	svc.evictIdleBizTags(0)
+	if len(svc.tags) != 0 {
+		t.Fatalf("len(tags) = %d, want = 0", len(svc.tags))
+	}
+	ids, err := svc.Get(context.Background(), "orders", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := ids[0]>>TimeShift + epoch; ts <= last {
+		t.Fatalf("timestamp = %d, must be greater than %d", ts, last)
+	}
+}
+
+func TestServicePerBizTagCollision(t *testing.T) {
+	opts := newDefaultOptions()
+	WithPerBizTag(time.Minute, 0)(opts)
+	if err := opts.validate(); err == nil {
+		t.Fatal("want error when biztag bits is 0")
+	}
+
+	stor := &testStorage{metadatas: make(map[string]*Metadata), machindId: -1}
+	svc := NewService("gleafd0", "127.0.0.1:8090", stor, log.DefaultLogger,
+		WithPerBizTag(time.Minute, 2))
+	defer svc.Close()
+	// 找到与orders的hash相同的biztag
+	other := ""
+	for i := 0; other == ""; i++ {
+		if biztag := fmt.Sprintf("biztag%d", i); BizTagValue(biztag, 2) == BizTagValue("orders", 2) {
+			other = biztag
+		}
+	}
+	seen := make(map[int64]bool)
+	for i := 0; i < 100; i++ {
+		for _, biztag := range []string{"orders", other} {
+			ids, err := svc.Get(context.Background(), biztag, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range ids {
+				if seen[id] {
+					t.Fatalf("duplicated id: %d, biztag = %s", id, biztag)
+				}
+				seen[id] = true
+			}
+		}
+	}
+	if len(svc.tags) != 1 {
+		t.Fatalf("len(tags) = %d, want = 1", len(svc.tags))
+	}
+}
@@ -0,0 +1,90 @@
+package snowflake
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ClockSkewError 本机时钟与其它节点的平均时间偏差超过阈值
+type ClockSkewError struct {
+	Skew  time.Duration // 本机时间减去其它节点的平均时间
+	Peers []string      // 偏差超过阈值的节点
+}
+
+func (e *ClockSkewError) Error() string {
+	return fmt.Sprintf("system clock skew %v exceeds threshold, peers: %v", e.Skew, e.Peers)
+}
+
+func absMs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// 参考Leaf的做法, 比较本机时间与其它节点上报时间戳的平均值。
+// 比最新上报的节点落后超过peerStaleAfter的节点认为已经下线, 不参与计算。
+// 不使用本机时间判断, 否则本机时钟过快时所有节点都被认为已经下线。
+func (s *Service) checkClockSkew(ctx context.Context) (*ClockSkewError, error) {
+	mds, err := s.stor.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := s.nowMs()
+	threshold := int64(s.opts.skewThreshold / time.Millisecond)
+	staleAfter := int64(s.opts.peerStaleAfter / time.Millisecond)
+
+	others := make([]Metadata, 0, len(mds))
+	var newest int64
+	for _, md := range mds {
+		if md.Name == s.md.Name && md.Addr == s.md.Addr {
+			continue
+		}
+		others = append(others, md)
+		if md.Timestamp > newest {
+			newest = md.Timestamp
+		}
+	}
+	var sum, n int64
+	var peers []string
+	for _, md := range others {
+		if md.Timestamp <= 0 || newest-md.Timestamp > staleAfter {
+			continue
+		}
+		sum += md.Timestamp
+		n++
+		if absMs(now-md.Timestamp) > threshold {
+			peers = append(peers, fmt.Sprintf("%s@%s(%dms)", md.Name, md.Addr, now-md.Timestamp))
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	skew := now - sum/n
+	if absMs(skew) <= threshold {
+		return nil, nil
+	}
+	return &ClockSkewError{Skew: time.Duration(skew) * time.Millisecond, Peers: peers}, nil
+}
+
+// 检查时钟偏差, 超过阈值时标记服务不可用
+func (s *Service) updateClockSkew() {
+	if s.opts.skewThreshold <= 0 {
+		return
+	}
+	skewErr, err := s.checkClockSkew(context.Background())
+	if err != nil {
+		// 无法获取其它节点时保持之前的状态
+		s.logger.Warnw("Check clock skew", "err", err)
+		return
+	}
+	prev := s.skewErr.Load().(*ClockSkewError)
+	if skewErr != nil {
+		s.logger.Errorw("Clock skew detected, refuse to serve",
+			"skew", skewErr.Skew, "threshold", s.opts.skewThreshold, "peers", skewErr.Peers)
+	} else if prev != nil {
+		s.logger.Infow("Clock skew recovered")
+	}
+	s.skewErr.Store(skewErr)
+}
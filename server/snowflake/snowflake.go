@@ -13,9 +13,14 @@ var (
 var (
 	ErrClockMoveBackwards = errors.New("system clock move backwards")
 	ErrInvalidMachineID   = errors.New("invalid machine id")
+	ErrInvalidShards      = errors.New("invalid shards")
+	ErrClosed             = errors.New("service closed")
 )
 
-// 1+41+10+12
+// 回拨5ms以内时等待
+var defaultRollbackPolicy = WaitUpTo(5 * time.Millisecond)
+
+// 1+41+10+12, 默认的layout
 const (
 	MachineIDBits  uint8 = 10
 	SeqBits        uint8 = 12
@@ -23,79 +28,180 @@ const (
 	TimeShift            = SeqBits + MachineIDBits
 	MachineIDMax   int   = -1 ^ (-1 << MachineIDBits)
 	SeqMask        int32 = -1 ^ (-1 << SeqBits)
+	// 每个分片至少保留16个序列号
+	MaxShardBits uint8 = SeqBits - 4
 )
 
 type Factory interface {
 	Next() (int64, error)
+	// NextN 连续生成n个ID, 同一个时间单位内剩余的序列号一次分配
+	NextN(n int) ([]int64, error)
 }
 
 type factory struct {
 	machineID int
-	lastTs    int64
+	layout    Layout
+	unit      int64 // 时间单位的毫秒数
+	lastTs    int64 // 最后发放ID的时间, 单位为layout.TimeUnit
 	seq       int32
+	seqMask   int32 // 分片内序列号的掩码
+	seqPrefix int32 // 分片编号, 位于序列号的高位
+	seqRand   int   // 每个时间单位的起始序列号小于seqRand
 	rnd       *rand.Rand
+	wm        *watermark
+	policy    ClockRollbackPolicy
+}
+
+type factoryConfig struct {
+	layout    Layout // 为空时使用DefaultLayout
+	machineID int
+	// 序列号的最高tagBits位为biztag的编号
+	tag     int
+	tagBits uint8
+	// 将序列号空间分成1<<shardBits个分片, 每个factory使用其中一个分片,
+	// 多个factory可以使用相同的machineID并发生成ID
+	shard     int
+	shardBits uint8
+	// 不会生成时间戳小于wm的ID
+	wm     *watermark
+	policy ClockRollbackPolicy
 }
 
 // 不支持多routine并发
 func NewFactory(machineID int) (Factory, error) {
-	if machineID < 0 || MachineIDMax < machineID {
+	return newFactory(factoryConfig{
+		machineID: machineID,
+		wm:        &watermark{},
+		policy:    defaultRollbackPolicy,
+	})
+}
+
+func newFactory(cfg factoryConfig) (*factory, error) {
+	if cfg.layout == (Layout{}) {
+		cfg.layout = DefaultLayout
+	}
+	if err := cfg.layout.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.machineID < 0 || cfg.layout.MachineIDMax() < cfg.machineID {
 		return nil, ErrInvalidMachineID
 	}
+	if cfg.tagBits+cfg.shardBits > cfg.layout.MaxShardBits() ||
+		cfg.shard < 0 || cfg.shard >= 1<<cfg.shardBits ||
+		cfg.tag < 0 || cfg.tag >= 1<<cfg.tagBits {
+		return nil, ErrInvalidShards
+	}
 	nano := time.Now().UTC().UnixNano()
 	rnd := rand.New(rand.NewSource(nano))
+	seqBits := cfg.layout.SeqBits
+	localBits := seqBits - cfg.tagBits - cfg.shardBits
+	seqMask := int32(-1 ^ (-1 << localBits))
+	// 随机起始最多占用1/16的序列号, 分片较小时从0开始
+	seqRand := int(seqMask / 16)
+	if seqRand > 10 {
+		seqRand = 10
+	} else if seqRand < 1 {
+		seqRand = 1
+	}
+	unit := cfg.layout.unitMs()
 	return &factory{
-		machineID: machineID,
-		lastTs:    0,
-		seq:       0,
+		machineID: cfg.machineID,
+		layout:    cfg.layout,
+		unit:      unit,
+		lastTs:    cfg.wm.load() / unit,
+		// 认为lastTs的序列号已经用完, 在同一个时间单位内不会再生成ID
+		seq:       seqMask,
+		seqMask:   seqMask,
+		seqRand:   seqRand,
+		seqPrefix: int32(cfg.tag)<<(seqBits-cfg.tagBits) | int32(cfg.shard)<<localBits,
 		rnd:       rnd,
+		wm:        cfg.wm,
+		policy:    cfg.policy,
 	}, nil
 }
 
 func (sf *factory) Next() (int64, error) {
-	ts := sf.nowMs()
+	var err error
+	ts := sf.nowTs()
 	if ts < sf.lastTs { // 时钟回溯的问题
-		offset := sf.lastTs - ts
-		if offset > 5 {
-			return int64(0), ErrClockMoveBackwards
-		}
-		// 等待两倍的时间差
-		time.Sleep(time.Duration(offset<<1) * time.Millisecond)
-		ts = sf.nowMs()
-		if ts < sf.lastTs {
-			return int64(0), ErrClockMoveBackwards
+		if ts, err = sf.backwards(sf.lastTs); err != nil {
+			return int64(0), err
 		}
 	}
 	// 同一毫秒内，随机数递增
 	if ts == sf.lastTs {
-		sf.seq = (sf.seq + 1) & SeqMask
+		sf.seq = (sf.seq + 1) & sf.seqMask
 		if sf.seq == 0 {
-			ts = sf.waitNextTs()
+			if ts, err = sf.waitNextTs(); err != nil {
+				return int64(0), err
+			}
 		}
 	} else {
-		// 每一个毫秒开始是选择一个0到9随机数
+		// 每一个毫秒开始是选择一个0到seqRand-1的随机数
 		// 避免出现个位数为0的ID太多。
-		sf.seq = int32(sf.rnd.Intn(10))
+		sf.seq = int32(sf.rnd.Intn(sf.seqRand))
 	}
 	return sf.buildFinalId(ts)
 }
 
 func (sf *factory) buildFinalId(now int64) (int64, error) {
+	if now != sf.lastTs {
+		// 记录这个时间单位的最后一毫秒
+		if err := sf.wm.advance(now*sf.unit + sf.unit - 1); err != nil {
+			return 0, err
+		}
+	}
 	sf.lastTs = now
-	timestamp := (now - epoch) << TimeShift
-	machineID := int64(sf.machineID << MachineIDShift)
-	n := timestamp | machineID | int64(sf.seq)
+	l := sf.layout
+	timestamp := (now - epoch/sf.unit) << (l.SeqBits + l.MachineIDBits)
+	machineID := int64(sf.machineID) << l.SeqBits
+	n := timestamp | machineID | int64(sf.seqPrefix|sf.seq)
 	return int64(n), nil
 }
 
-func (sf *factory) waitNextTs() int64 {
-	t := sf.nowMs()
+func (sf *factory) NextN(n int) ([]int64, error) {
+	ids := make([]int64, 0, n)
+	for len(ids) < n {
+		id, err := sf.Next()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		// 序列号位于ID的最低位, 同一个时间单位内剩余的序列号直接递增, 不再读取时钟
+		k := int(sf.seqMask - sf.seq)
+		if k > n-len(ids) {
+			k = n - len(ids)
+		}
+		for i := 1; i <= k; i++ {
+			ids = append(ids, id+int64(i))
+		}
+		sf.seq += int32(k)
+	}
+	return ids, nil
+}
+
+func (sf *factory) waitNextTs() (int64, error) {
+	t := sf.nowTs()
 	for t <= sf.lastTs {
+		if t < sf.lastTs { // 回拨期间借用了之后的时间戳
+			return sf.backwards(sf.lastTs + 1)
+		}
 		time.Sleep(100 * time.Microsecond) // sleep 100us
-		t = sf.nowMs()
+		t = sf.nowTs()
+	}
+	return t, nil
+}
+
+// 时钟回拨时由policy决定使用的时间, min为需要的最小时间
+func (sf *factory) backwards(min int64) (int64, error) {
+	ms, err := sf.policy.Backwards(min*sf.unit, nowMs())
+	if err != nil {
+		return 0, err
 	}
-	return t
+	return ms / sf.unit, nil
 }
 
-func (sf *factory) nowMs() int64 {
-	return time.Now().UnixNano() / 1000000
+// 当前时间, 单位为layout.TimeUnit
+func (sf *factory) nowTs() int64 {
+	return nowMs() / sf.unit
 }
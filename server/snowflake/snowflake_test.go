@@ -1,6 +1,9 @@
 package snowflake
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestNewFactory(t *testing.T) {
 	_, err := NewFactory(-1)
@@ -113,3 +116,136 @@ func BenchmarkFactoryParallel2(b *testing.B) {
 		}
 	})
 }
+
+func TestClockRollbackPolicy(t *testing.T) {
+	if _, err := FailFast().Backwards(100, 99); err != ErrClockMoveBackwards {
+		t.Fatalf("FailFast: err = %v, want = %v", err, ErrClockMoveBackwards)
+	}
+	if ts, err := BorrowFuture(50*time.Millisecond).Backwards(100, 60); err != nil || ts != 100 {
+		t.Fatalf("BorrowFuture: ts = %d, err = %v, want = 100, nil", ts, err)
+	}
+	if _, err := BorrowFuture(50*time.Millisecond).Backwards(100, 40); err != ErrClockMoveBackwards {
+		t.Fatalf("BorrowFuture: err = %v, want = %v", err, ErrClockMoveBackwards)
+	}
+	if _, err := WaitUpTo(5*time.Millisecond).Backwards(nowMs()+50, nowMs()); err != ErrClockMoveBackwards {
+		t.Fatalf("WaitUpTo: err = %v, want = %v", err, ErrClockMoveBackwards)
+	}
+	min := nowMs() + 3
+	if ts, err := WaitUpTo(5*time.Millisecond).Backwards(min, nowMs()); err != nil || ts < min {
+		t.Fatalf("WaitUpTo: ts = %d, err = %v, want >= %d", ts, err, min)
+	}
+}
+
+func TestFactoryClockRollback(t *testing.T) {
+	// 模拟时钟回拨了20ms
+	f, _ := newFactory(factoryConfig{machineID: 100, wm: &watermark{ts: nowMs() + 20}, policy: FailFast()})
+	if _, err := f.Next(); err != ErrClockMoveBackwards {
+		t.Fatalf("err = %v, want = %v", err, ErrClockMoveBackwards)
+	}
+
+	f, _ = newFactory(factoryConfig{machineID: 100, wm: &watermark{ts: nowMs() + 20}, policy: BorrowFuture(time.Second)})
+	var last int64
+	// 超过一个毫秒的序列号, 需要借用之后的时间戳
+	for i := 0; i < 2*int(SeqMask); i++ {
+		id, err := f.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= last {
+			t.Fatalf("got id = %d, last = %d", id, last)
+		}
+		last = id
+	}
+}
+
+func TestFactoryShards(t *testing.T) {
+	if _, err := newFactory(factoryConfig{machineID: 1, shard: 4, shardBits: 2, wm: &watermark{}}); err != ErrInvalidShards {
+		t.Fatalf("err = %v, want = %v", err, ErrInvalidShards)
+	}
+	f, err := newFactory(factoryConfig{machineID: 1, shard: 3, shardBits: 2, wm: &watermark{}, policy: FailFast()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := f.NextN(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		// 序列号的最高两位是分片编号
+		if shard := (int32(id) & SeqMask) >> (SeqBits - 2); shard != 3 {
+			t.Fatalf("shard of id = %d, want = 3", shard)
+		}
+		if i > 0 && id <= ids[i-1] {
+			t.Fatalf("got id = %d, last = %d", id, ids[i-1])
+		}
+	}
+}
+
+func TestSonyflakeLayout(t *testing.T) {
+	f, err := newFactory(factoryConfig{layout: SonyflakeLayout, machineID: 40000, wm: &watermark{}, policy: FailFast()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newFactory(factoryConfig{layout: DefaultLayout, machineID: 40000, wm: &watermark{}}); err != ErrInvalidMachineID {
+		t.Fatalf("err = %v, want = %v", err, ErrInvalidMachineID)
+	}
+	begin := time.Now()
+	// 超过一个时间单位的序列号
+	ids, err := f.NextN(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if i > 0 && id <= ids[i-1] {
+			t.Fatalf("got id = %d, last = %d", id, ids[i-1])
+		}
+	}
+	info := SonyflakeLayout.Decode(ids[0], 0, 0)
+	if info.MachineID != 40000 {
+		t.Fatalf("machine id = %d, want = 40000", info.MachineID)
+	}
+	if d := info.Time.Sub(begin); d < -10*time.Millisecond || d > time.Second {
+		t.Fatalf("time = %v, begin = %v", info.Time, begin)
+	}
+}
+
+func TestLayoutDecode(t *testing.T) {
+	f, _ := newFactory(factoryConfig{layout: DefaultLayout, machineID: 100, tag: 2, tagBits: 2,
+		shard: 1, shardBits: 1, wm: &watermark{}, policy: FailFast()})
+	id, err := f.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := DefaultLayout.Decode(id, 2, 1)
+	if info.MachineID != 100 || info.Tag != 2 || info.Shard != 1 || info.Sequence >= 10 {
+		t.Fatalf("decode id = %d, info = %+v", id, info)
+	}
+}
+
+func TestFactoryNextNSmallShard(t *testing.T) {
+	// 每个分片16个序列号
+	f, err := newFactory(factoryConfig{machineID: 1, shard: 5, shardBits: MaxShardBits, wm: &watermark{}, policy: FailFast()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := f.NextN(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	perTs := make(map[int64]int)
+	for i, id := range ids {
+		if i > 0 && id <= ids[i-1] {
+			t.Fatalf("got id = %d, last = %d", id, ids[i-1])
+		}
+		ts, seq := id>>TimeShift, int32(id)&15
+		if perTs[ts] == 0 && seq != 0 {
+			t.Fatalf("first seq of ts %d = %d, want = 0", ts, seq)
+		}
+		perTs[ts]++
+	}
+	for ts, n := range perTs {
+		if n != 16 {
+			t.Fatalf("ids of ts %d = %d, want = 16", ts, n)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package snowflake
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/derry6/gleafd/pkg/log"
@@ -19,55 +20,101 @@ type Storage interface {
 	Update(ctx context.Context, md Metadata) (err error)
 }
 
+// 原子地查找或者分配machineID, 避免相同name/addr的进程并发创建时得到不同的ID,
+// 以及INCR之后进程崩溃导致的ID泄漏。
+// KEYS[1]: 节点key, KEYS[2]: machineID计数器, KEYS[3]: 节点索引
+// ARGV[1]: 允许的最大machineID
+const getOrNewScript = `
+local vals = redis.call('HMGET', KEYS[1], 'machineid', 'timestamp', 'layout')
+if vals[1] then
+	redis.call('SADD', KEYS[3], KEYS[1])
+	return {vals[1], vals[2] or '0', '0', vals[3] or ''}
+end
+local id = redis.call('INCR', KEYS[2])
+if id > tonumber(ARGV[1]) then
+	redis.call('DECR', KEYS[2])
+	return redis.error_reply('machine id exhausted')
+end
+redis.call('HMSET', KEYS[1], 'machineid', id, 'timestamp', 0)
+redis.call('SADD', KEYS[3], KEYS[1])
+return {tostring(id), '0', '1', ''}
+`
+
+var getOrNew = redis.NewScript(3, getOrNewScript)
+
+type RedisStorageOption func(storage *redisStorage)
+
+// WithHashTag 所有的key使用tag作为前缀, tag与redis cluster连接池的hash tag相同时保证位于同一个slot。
+// 为空时使用gleafd
+func WithHashTag(tag string) RedisStorageOption {
+	return func(storage *redisStorage) {
+		storage.hashTag = tag
+	}
+}
+
+// WithMachineIDMax 允许分配的最大machineID, 默认为DefaultLayout的最大值
+func WithMachineIDMax(max int) RedisStorageOption {
+	return func(storage *redisStorage) {
+		storage.machineIDMax = max
+	}
+}
+
 type redisStorage struct {
-	rds    *redis.Pool
-	logger log.Logger
+	rds          *redis.Pool
+	logger       log.Logger
+	hashTag      string
+	machineIDMax int
+}
+
+func (storage *redisStorage) namespace() string {
+	if storage.hashTag != "" {
+		return storage.hashTag
+	}
+	return "gleafd"
 }
 
 // gleafd/snowflakes/name/ip:port -> workerId  timestamp
 func (storage *redisStorage) prefix() string {
-	return "gleafd/snowflakes"
+	return storage.namespace() + "/snowflakes"
 }
 
 func (storage *redisStorage) key(name, addr string) string {
 	return fmt.Sprintf("%s/%s/%s", storage.prefix(), name, addr)
 }
 
+// 保存所有节点key的集合, 代替KEYS
+func (storage *redisStorage) indexKey() string {
+	return storage.namespace() + "_snowflakes_index"
+}
+
+func (storage *redisStorage) machineIDKey() string {
+	return storage.namespace() + "_machineid_gen"
+}
+
 func (storage *redisStorage) GetOrNew(ctx context.Context, name, addr string) (md Metadata, err error) {
 	k := storage.key(name, addr)
 	c := storage.rds.Get()
 	defer c.Close()
 
-	exists, err := redis.Bool(c.Do("EXISTS", k))
+	vals, err := redis.Strings(getOrNew.Do(c, k, storage.machineIDKey(), storage.indexKey(), storage.machineIDMax))
 	if err != nil {
 		return md, err
 	}
-	if !exists {
-		// 不存在
-		machineId, err := redis.Int(c.Do("INCR", "gleafd_machineid_gen"))
-		if err != nil {
-			return md, err
-		}
-		storage.logger.Warnw("Snowflake service creating", "name", name, "addr", addr, "machineId", machineId)
-		_, err = c.Do("HMSET", k, "machineid", machineId, "timestamp", 0)
-		if err != nil {
-			return md, err
-		}
-		md.Name = name
-		md.Addr = addr
-		md.MachineID = machineId
-		md.Timestamp = 0
-		return md, nil
-	}
-
-	vals, err := redis.Int64s(c.Do("HMGET", k, "machineid", "timestmap"))
-	if err != nil {
-		return md, err
+	if len(vals) != 4 {
+		return md, fmt.Errorf("unexpected reply of getOrNew script: %v", vals)
 	}
 	md.Name = name
 	md.Addr = addr
-	md.MachineID = int(vals[0])
-	md.Timestamp = vals[1]
+	if md.MachineID, err = strconv.Atoi(vals[0]); err != nil {
+		return md, fmt.Errorf("unexpected machine id %q: %v", vals[0], err)
+	}
+	if md.Timestamp, err = strconv.ParseInt(vals[1], 10, 64); err != nil {
+		return md, fmt.Errorf("unexpected timestamp %q: %v", vals[1], err)
+	}
+	md.Layout = vals[3]
+	if vals[2] == "1" {
+		storage.logger.Warnw("Snowflake service creating", "name", name, "addr", addr, "machineId", md.MachineID)
+	}
 	return md, nil
 }
 
@@ -75,7 +122,7 @@ func (storage *redisStorage) List(ctx context.Context) (mds []Metadata, err erro
 	c := storage.rds.Get()
 	defer c.Close()
 
-	keys, err := redis.Strings(c.Do("KEYS", storage.prefix()+"*"))
+	keys, err := redis.Strings(c.Do("SMEMBERS", storage.indexKey()))
 	if err != nil {
 		if err == redis.ErrNil {
 			return mds, nil
@@ -83,23 +130,27 @@ func (storage *redisStorage) List(ctx context.Context) (mds []Metadata, err erro
 		return nil, err
 	}
 	for _, k := range keys {
-		vals, err := redis.Int64Map(c.Do("HMGET", k, "machineid", "timestamp"))
+		vals, err := redis.Values(c.Do("HMGET", k, "machineid", "timestamp"))
 		if err != nil {
-			if err == redis.ErrNil {
-				continue
-			}
 			return nil, err
 		}
-		parts := strings.Split(k, "/")
-		if len(parts) != 4 {
+		if len(vals) != 2 || vals[0] == nil {
+			// 节点已经被删除
+			if _, err = c.Do("SREM", storage.indexKey(), k); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(k, storage.prefix()+"/"), "/", 2)
+		if len(parts) != 2 {
 			continue
 		}
-		mid, _ := vals["machineid"]
-		ts, _ := vals["timestamp"]
+		mid, _ := redis.Int(vals[0], nil)
+		ts, _ := redis.Int64(vals[1], nil)
 		mds = append(mds, Metadata{
-			Name:      parts[2],
-			Addr:      parts[3],
-			MachineID: int(mid),
+			Name:      parts[0],
+			Addr:      parts[1],
+			MachineID: mid,
 			Timestamp: ts})
 	}
 	return mds, nil
@@ -108,11 +159,17 @@ func (storage *redisStorage) List(ctx context.Context) (mds []Metadata, err erro
 func (storage *redisStorage) Update(ctx context.Context, md Metadata) (err error) {
 	c := storage.rds.Get()
 	defer c.Close()
-	_, err = c.Do("HMSET",
-		storage.key(md.Name, md.Addr), "machineid", md.MachineID, "timestamp", md.Timestamp)
+	k := storage.key(md.Name, md.Addr)
+	c.Send("HMSET", k, "machineid", md.MachineID, "timestamp", md.Timestamp, "layout", md.Layout)
+	c.Send("SADD", storage.indexKey(), k)
+	_, err = c.Do("")
 	return err
 }
 
-func NewRedisStorage(p *redis.Pool, logger log.Logger) Storage {
-	return &redisStorage{rds: p, logger: logger}
+func NewRedisStorage(p *redis.Pool, logger log.Logger, opts ...RedisStorageOption) Storage {
+	storage := &redisStorage{rds: p, logger: logger, machineIDMax: MachineIDMax}
+	for _, o := range opts {
+		o(storage)
+	}
+	return storage
 }
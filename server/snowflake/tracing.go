@@ -0,0 +1,53 @@
+package snowflake
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/derry6/gleafd/server/snowflake"
+
+type tracingStorage struct {
+	Storage
+}
+
+// NewTracingStorage 为stor的每次调用创建span
+func NewTracingStorage(stor Storage) Storage {
+	return &tracingStorage{Storage: stor}
+}
+
+func (s *tracingStorage) start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("db.system", "redis"))
+	return otel.Tracer(tracerName).Start(ctx, "snowflake.Storage/"+name,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *tracingStorage) GetOrNew(ctx context.Context, name, addr string) (md Metadata, err error) {
+	ctx, span := s.start(ctx, "GetOrNew", attribute.String("name", name), attribute.String("addr", addr))
+	defer func() { endSpan(span, err) }()
+	return s.Storage.GetOrNew(ctx, name, addr)
+}
+
+func (s *tracingStorage) List(ctx context.Context) (mds []Metadata, err error) {
+	ctx, span := s.start(ctx, "List")
+	defer func() { endSpan(span, err) }()
+	return s.Storage.List(ctx)
+}
+
+func (s *tracingStorage) Update(ctx context.Context, md Metadata) (err error) {
+	ctx, span := s.start(ctx, "Update", attribute.Int("machine_id", md.MachineID))
+	defer func() { endSpan(span, err) }()
+	return s.Storage.Update(ctx, md)
+}
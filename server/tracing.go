@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/derry6/gleafd/server/obfuscate"
+	"github.com/derry6/gleafd/server/segment"
+	"github.com/derry6/gleafd/server/snowflake"
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/derry6/gleafd/server"
+
+// 从请求头traceparent/tracestate读取W3C trace context
+var propagator = propagation.TraceContext{}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// 为每个请求创建server span, 后续的Service和存储调用都在这个span之下
+func traceHandle(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", r.URL.RequestURI()),
+			))
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r.WithContext(ctx), params)
+		span.SetAttributes(attribute.Int("http.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TracingMidware 为Service的每次调用创建span
+type TracingMidware struct {
+	Service
+}
+
+func (m *TracingMidware) start(ctx context.Context, name, biztag string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("biztag", biztag))
+	return tracer().Start(ctx, "Service/"+name, trace.WithAttributes(attrs...))
+}
+
+func (m *TracingMidware) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	ctx, span := m.start(ctx, "GetSegments", biztag, attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+	return m.Service.GetSegments(ctx, biztag, count)
+}
+
+func (m *TracingMidware) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
+	ctx, span := m.start(ctx, "GetSegmentRanges", biztag, attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+	return m.Service.GetSegmentRanges(ctx, biztag, count)
+}
+
+func (m *TracingMidware) GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	ctx, span := m.start(ctx, "GetSnowflakes", biztag, attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+	return m.Service.GetSnowflakes(ctx, biztag, count)
+}
+
+func (m *TracingMidware) DecodeSnowflake(ctx context.Context, biztag string, id int64) (info *snowflake.IDInfo, err error) {
+	ctx, span := m.start(ctx, "DecodeSnowflake", biztag)
+	defer func() { endSpan(span, err) }()
+	return m.Service.DecodeSnowflake(ctx, biztag, id)
+}
+
+func (m *TracingMidware) GetUUIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	ctx, span := m.start(ctx, "GetUUIDs", biztag, attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+	return m.Service.GetUUIDs(ctx, biztag, count)
+}
+
+func (m *TracingMidware) GetULIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	ctx, span := m.start(ctx, "GetULIDs", biztag, attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+	return m.Service.GetULIDs(ctx, biztag, count)
+}
+
+func (m *TracingMidware) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	ctx, span := m.start(ctx, "LeaseSegments", biztag, attribute.Int("size", size), attribute.String("client", client))
+	defer func() { endSpan(span, err) }()
+	return m.Service.LeaseSegments(ctx, biztag, size, client)
+}
+
+func (m *TracingMidware) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	ctx, span := m.start(ctx, "GetObfuscatedSegments", biztag, attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+	return m.Service.GetObfuscatedSegments(ctx, biztag, count)
+}
+
+func (m *TracingMidware) DecodeObfuscatedSegment(ctx context.Context, biztag string, id string) (decoded *obfuscate.Decoded, err error) {
+	ctx, span := m.start(ctx, "DecodeObfuscatedSegment", biztag)
+	defer func() { endSpan(span, err) }()
+	return m.Service.DecodeObfuscatedSegment(ctx, biztag, id)
+}
+
+func (m *TracingMidware) GetCodes(ctx context.Context, biztag string, count int) (codes []string, err error) {
+	ctx, span := m.start(ctx, "GetCodes", biztag, attribute.Int("count", count))
+	defer func() { endSpan(span, err) }()
+	return m.Service.GetCodes(ctx, biztag, count)
+}
+
+// Tracing 返回创建span的Midware, 使用otel的全局TracerProvider
+func Tracing() Midware {
+	return func(svc Service) Service {
+		return &TracingMidware{Service: svc}
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingHttpHandler(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	svc := Tracing()(&fakeSegmentService{})
+	httpServer := httptest.NewServer(NewHttpHandler(svc, log.DefaultLogger))
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("GET", httpServer.URL+"/api/v1/segments/orders?count=2", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	httpRsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpRsp.Body.Close()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("len(spans) = %d, want = 2", len(spans))
+	}
+	svcSpan, httpSpan := spans[0], spans[1]
+	if httpSpan.Name != "GET /api/v1/segments/:biztag" || httpSpan.SpanKind != trace.SpanKindServer {
+		t.Errorf("http span = %v, kind = %v", httpSpan.Name, httpSpan.SpanKind)
+	}
+	if httpSpan.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		httpSpan.Parent.SpanID().String() != "00f067aa0ba902b7" || !httpSpan.Parent.IsRemote() {
+		t.Errorf("http span parent = %v, want remote parent from traceparent", httpSpan.Parent)
+	}
+	if svcSpan.Name != "Service/GetSegments" || svcSpan.Parent.SpanID() != httpSpan.SpanContext.SpanID() {
+		t.Errorf("service span = %v, parent = %v", svcSpan.Name, svcSpan.Parent.SpanID())
+	}
+}
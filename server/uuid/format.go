@@ -0,0 +1,53 @@
+package uuid
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+)
+
+const (
+	uuidRandBits = 74 // 12位rand_a + 62位rand_b
+	ulidRandBits = 80
+)
+
+// RFC 9562 UUIDv7:
+// 48位unix_ts_ms | 4位version | 12位rand_a | 2位variant | 62位rand_b
+func formatUUIDv7(ms int64, hi uint16, lo uint64) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], uint64(ms)<<16)
+	randA := uint16(hi)<<2 | uint16(lo>>62)
+	binary.BigEndian.PutUint16(b[6:8], 0x7000|randA&0x0fff)
+	binary.BigEndian.PutUint64(b[8:16], 0x8000000000000000|lo&0x3fffffffffffffff)
+
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:36], b[10:16])
+	return string(s[:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID: 48位毫秒时间戳 + 80位随机数, Crockford Base32编码为26个字符
+func formatULID(ms int64, hi uint16, lo uint64) string {
+	var s [26]byte
+	// 时间戳, 10个字符
+	ts := uint64(ms)
+	for i := 9; i >= 0; i-- {
+		s[i] = crockford[ts&0x1f]
+		ts >>= 5
+	}
+	// 随机数, 16个字符
+	for i := 25; i >= 10; i-- {
+		s[i] = crockford[lo&0x1f]
+		lo = lo>>5 | uint64(hi&0x1f)<<59
+		hi >>= 5
+	}
+	return string(s[:])
+}
@@ -0,0 +1,113 @@
+package uuid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/derry6/gleafd/server/snowflake"
+)
+
+var (
+	ErrClosed = errors.New("service closed")
+)
+
+// generator 生成48位毫秒时间戳 + randBits位随机数的ID。
+// 同一毫秒内随机数部分递增, 保证同一节点生成的ID单调递增。
+type generator struct {
+	mu       sync.Mutex
+	randBits uint // 随机数的位数, 不超过80
+	lastMs   int64
+	hi       uint16 // 随机数的高randBits-64位
+	lo       uint64 // 随机数的低64位
+	policy   snowflake.ClockRollbackPolicy
+}
+
+func newGenerator(randBits uint, policy snowflake.ClockRollbackPolicy) *generator {
+	return &generator{randBits: randBits, policy: policy}
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / 1000000
+}
+
+func (g *generator) hiMask() uint16 {
+	return uint16(1<<(g.randBits-64) - 1)
+}
+
+func (g *generator) reseed() error {
+	var b [10]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	g.hi = binary.BigEndian.Uint16(b[:2]) & g.hiMask()
+	g.lo = binary.BigEndian.Uint64(b[2:])
+	return nil
+}
+
+// 随机数加1, 溢出时返回false
+func (g *generator) increment() bool {
+	g.lo++
+	if g.lo != 0 {
+		return true
+	}
+	if g.hi == g.hiMask() {
+		return false
+	}
+	g.hi++
+	return true
+}
+
+// 等待下一毫秒, 回拨期间由policy决定
+func (g *generator) waitNextMs() (int64, error) {
+	for {
+		now := nowMs()
+		if now > g.lastMs {
+			return now, nil
+		}
+		if now < g.lastMs {
+			return g.policy.Backwards(g.lastMs+1, now)
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// 返回时间戳和随机数
+func (g *generator) next() (ms int64, hi uint16, lo uint64, err error) {
+	ms = nowMs()
+	if ms < g.lastMs { // 时钟回拨
+		if ms, err = g.policy.Backwards(g.lastMs, ms); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if ms == g.lastMs {
+		if g.increment() {
+			return ms, g.hi, g.lo, nil
+		}
+		// 同一毫秒内随机数用完
+		if ms, err = g.waitNextMs(); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	if err = g.reseed(); err != nil {
+		return 0, 0, 0, err
+	}
+	g.lastMs = ms
+	return ms, g.hi, g.lo, nil
+}
+
+func (g *generator) nextN(n int, format func(ms int64, hi uint16, lo uint64) string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ms, hi, lo, err := g.next()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, format(ms, hi, lo))
+	}
+	return ids, nil
+}
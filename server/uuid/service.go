@@ -0,0 +1,63 @@
+package uuid
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/snowflake"
+)
+
+type Options struct {
+	policy snowflake.ClockRollbackPolicy
+}
+
+type Option func(opts *Options)
+
+// WithClockRollbackPolicy 与snowflake使用相同的时钟回拨处理策略
+func WithClockRollbackPolicy(policy snowflake.ClockRollbackPolicy) Option {
+	return func(opts *Options) {
+		opts.policy = policy
+	}
+}
+
+// Service 生成128位可排序的UUIDv7和ULID
+type Service struct {
+	uuids  *generator
+	ulids  *generator
+	logger log.Logger
+	closed int32
+}
+
+func (s *Service) GetUUIDs(ctx context.Context, biztag string, count int) ([]string, error) {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return nil, ErrClosed
+	}
+	return s.uuids.nextN(count, formatUUIDv7)
+}
+
+func (s *Service) GetULIDs(ctx context.Context, biztag string, count int) ([]string, error) {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return nil, ErrClosed
+	}
+	return s.ulids.nextN(count, formatULID)
+}
+
+func (s *Service) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return nil
+}
+
+func NewService(logger log.Logger, opts ...Option) *Service {
+	sopts := &Options{policy: snowflake.WaitUpTo(5 * time.Millisecond)}
+	for _, o := range opts {
+		o(sopts)
+	}
+	policy := snowflake.ObservePolicy(sopts.policy, logger)
+	return &Service{
+		uuids:  newGenerator(uuidRandBits, policy),
+		ulids:  newGenerator(ulidRandBits, policy),
+		logger: logger,
+	}
+}
@@ -0,0 +1,135 @@
+package uuid
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derry6/gleafd/pkg/log"
+	"github.com/derry6/gleafd/server/snowflake"
+)
+
+func TestGetUUIDs(t *testing.T) {
+	svc := NewService(log.DefaultLogger)
+	defer svc.Close()
+	before := time.Now().UnixNano() / 1000000
+	ids, err := svc.GetUUIDs(context.Background(), "test", 1000)
+	if err != nil {
+		t.Fatalf("get uuids: %v", err)
+	}
+	after := time.Now().UnixNano() / 1000000
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("uuids are not sorted")
+	}
+	for i, id := range ids {
+		if len(id) != 36 || id[8] != '-' || id[13] != '-' || id[18] != '-' || id[23] != '-' {
+			t.Fatalf("invalid uuid %q", id)
+		}
+		if id[14] != '7' {
+			t.Errorf("uuid %q version = %c, want = 7", id, id[14])
+		}
+		if !strings.ContainsRune("89ab", rune(id[19])) {
+			t.Errorf("uuid %q has invalid variant", id)
+		}
+		if i > 0 && id == ids[i-1] {
+			t.Errorf("duplicated uuid %q", id)
+		}
+	}
+	ms := parseHexMs(t, strings.Replace(ids[0][:13], "-", "", 1))
+	if ms < before || ms > after {
+		t.Errorf("uuid timestamp = %d, want in [%d, %d]", ms, before, after)
+	}
+}
+
+func TestGetULIDs(t *testing.T) {
+	svc := NewService(log.DefaultLogger)
+	defer svc.Close()
+	ids, err := svc.GetULIDs(context.Background(), "test", 1000)
+	if err != nil {
+		t.Fatalf("get ulids: %v", err)
+	}
+	for i, id := range ids {
+		if len(id) != 26 {
+			t.Fatalf("invalid ulid %q", id)
+		}
+		for _, c := range id {
+			if !strings.ContainsRune(crockford, c) {
+				t.Fatalf("ulid %q contains invalid char %c", id, c)
+			}
+		}
+		// 48位时间戳的最高位字符不超过7
+		if id[0] > '7' {
+			t.Errorf("ulid %q overflow", id)
+		}
+		if i > 0 && id <= ids[i-1] {
+			t.Errorf("ulid %q <= %q", id, ids[i-1])
+		}
+	}
+}
+
+func TestFormatULID(t *testing.T) {
+	// 最大值
+	if got := formatULID(1<<48-1, 0xffff, 1<<64-1); got != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Errorf("formatULID(max) = %s", got)
+	}
+	if got := formatULID(0, 0, 1); got != "00000000000000000000000001" {
+		t.Errorf("formatULID(1) = %s", got)
+	}
+	// hi=1 位于随机数的第65位
+	want := "0000000001" + "000" + "G" + strings.Repeat("0", 12)
+	if got := formatULID(1, 1, 0); got != want {
+		t.Errorf("formatULID = %s, want = %s", got, want)
+	}
+}
+
+func TestGeneratorOverflow(t *testing.T) {
+	g := newGenerator(uuidRandBits, snowflake.WaitUpTo(5*time.Millisecond))
+	ms, _, _, err := g.next()
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	// 当前毫秒的随机数已经用完, 必须等待下一毫秒
+	g.hi, g.lo = g.hiMask(), 1<<64-1
+	next, _, _, err := g.next()
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	if next <= ms {
+		t.Errorf("next ms = %d, want > %d", next, ms)
+	}
+}
+
+func TestGeneratorClockRollback(t *testing.T) {
+	g := newGenerator(ulidRandBits, snowflake.FailFast())
+	g.lastMs = nowMs() + 1000
+	if _, _, _, err := g.next(); err != snowflake.ErrClockMoveBackwards {
+		t.Errorf("err = %v, want = %v", err, snowflake.ErrClockMoveBackwards)
+	}
+	g = newGenerator(ulidRandBits, snowflake.WaitUpTo(20*time.Millisecond))
+	g.lastMs = nowMs() + 10
+	ms, hi, lo, err := g.next()
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	if ms < g.lastMs || hi != g.hi || lo != g.lo {
+		t.Errorf("ms = %d, want >= %d", ms, g.lastMs)
+	}
+}
+
+func parseHexMs(t *testing.T, s string) int64 {
+	var ms int64
+	for _, c := range s {
+		ms <<= 4
+		switch {
+		case c >= '0' && c <= '9':
+			ms |= int64(c - '0')
+		case c >= 'a' && c <= 'f':
+			ms |= int64(c-'a') + 10
+		default:
+			t.Fatalf("invalid hex %q", s)
+		}
+	}
+	return ms
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/derry6/gleafd/server/obfuscate"
+	"github.com/derry6/gleafd/server/segment"
+	"github.com/derry6/gleafd/server/snowflake"
+)
+
+const (
+	// 与数据库中biz_tag VARCHAR(128)一致
+	MaxBizTagLen = 128
+
+	DefaultMaxCount     = 10000
+	DefaultMaxLeaseSize = 10000000
+)
+
+// 接口名称, 用于Limits.Endpoints
+const (
+	EndpointSegments   = "segments"
+	EndpointRanges     = "ranges"
+	EndpointObfuscated = "obfuscated"
+	EndpointSnowflakes = "snowflakes"
+	EndpointUUIDs      = "uuids"
+	EndpointULIDs      = "ulids"
+	EndpointCodes      = "codes"
+)
+
+// ValidationError 请求参数错误, HTTP接口返回400
+type ValidationError struct {
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// Limits 每次请求最多获取的ID数量。
+// 优先使用biztag的配置, 其次是接口的配置, 都没有时使用MaxCount
+type Limits struct {
+	MaxCount int
+	// key为接口名称, ranges为租用号段的size
+	Endpoints map[string]int
+	BizTags   map[string]int
+}
+
+// DefaultLimits 默认每次最多获取DefaultMaxCount个ID, 租用号段最多DefaultMaxLeaseSize
+func DefaultLimits() Limits {
+	return Limits{
+		MaxCount:  DefaultMaxCount,
+		Endpoints: map[string]int{EndpointRanges: DefaultMaxLeaseSize},
+	}
+}
+
+func (l *Limits) maxCount(endpoint, biztag string) int {
+	if n, ok := l.BizTags[biztag]; ok && n > 0 {
+		return n
+	}
+	if n, ok := l.Endpoints[endpoint]; ok && n > 0 {
+		return n
+	}
+	if l.MaxCount > 0 {
+		return l.MaxCount
+	}
+	return DefaultMaxCount
+}
+
+// MaxLeaseSize biztag每次最多租用的ID数量
+func (l *Limits) MaxLeaseSize(biztag string) int {
+	return l.maxCount(EndpointRanges, biztag)
+}
+
+// ValidateBizTag biztag只能包含字母, 数字和"_-.:", 最长MaxBizTagLen个字符
+func ValidateBizTag(biztag string) error {
+	if biztag == "" {
+		return &ValidationError{Field: "biztag", Value: biztag, Reason: "must not be empty"}
+	}
+	if len(biztag) > MaxBizTagLen {
+		return &ValidationError{Field: "biztag", Value: biztag[:MaxBizTagLen] + "...",
+			Reason: fmt.Sprintf("longer than %d characters", MaxBizTagLen)}
+	}
+	for i := 0; i < len(biztag); i++ {
+		c := biztag[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '-', c == '.', c == ':':
+		default:
+			return &ValidationError{Field: "biztag", Value: biztag,
+				Reason: "may only contain letters, digits and _-.:"}
+		}
+	}
+	return nil
+}
+
+// ValidationMidware 在调用服务之前检查biztag和count
+type ValidationMidware struct {
+	Service
+	limits Limits
+}
+
+func (m *ValidationMidware) validate(endpoint, biztag, field string, count int) error {
+	if err := ValidateBizTag(biztag); err != nil {
+		return err
+	}
+	if count <= 0 {
+		return &ValidationError{Field: field, Value: strconv.Itoa(count), Reason: "must be positive"}
+	}
+	if max := m.limits.maxCount(endpoint, biztag); count > max {
+		return &ValidationError{Field: field, Value: strconv.Itoa(count),
+			Reason: fmt.Sprintf("must not exceed %d", max)}
+	}
+	return nil
+}
+
+func (m *ValidationMidware) NotifyBizTag(ctx context.Context, biztag, event string) error {
+	if err := ValidateBizTag(biztag); err != nil {
+		return err
+	}
+	switch event {
+	case segment.BizTagCreated, segment.BizTagUpdated, segment.BizTagDeleted:
+	default:
+		return &ValidationError{Field: "event", Value: event, Reason: "must be created, updated or deleted"}
+	}
+	return m.Service.NotifyBizTag(ctx, biztag, event)
+}
+
+func (m *ValidationMidware) GetSegments(ctx context.Context, biztag string, count int) (ids []int64, period string, err error) {
+	if err = m.validate(EndpointSegments, biztag, "count", count); err != nil {
+		return nil, "", err
+	}
+	return m.Service.GetSegments(ctx, biztag, count)
+}
+
+func (m *ValidationMidware) GetSegmentRanges(ctx context.Context, biztag string, count int) (ranges []segment.Range, err error) {
+	if err = m.validate(EndpointSegments, biztag, "count", count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetSegmentRanges(ctx, biztag, count)
+}
+
+func (m *ValidationMidware) GetSnowflakes(ctx context.Context, biztag string, count int) (ids []int64, err error) {
+	if err = m.validate(EndpointSnowflakes, biztag, "count", count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetSnowflakes(ctx, biztag, count)
+}
+
+func (m *ValidationMidware) DecodeSnowflake(ctx context.Context, biztag string, id int64) (info *snowflake.IDInfo, err error) {
+	if err = ValidateBizTag(biztag); err != nil {
+		return nil, err
+	}
+	return m.Service.DecodeSnowflake(ctx, biztag, id)
+}
+
+func (m *ValidationMidware) GetUUIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if err = m.validate(EndpointUUIDs, biztag, "count", count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetUUIDs(ctx, biztag, count)
+}
+
+func (m *ValidationMidware) GetULIDs(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if err = m.validate(EndpointULIDs, biztag, "count", count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetULIDs(ctx, biztag, count)
+}
+
+func (m *ValidationMidware) LeaseSegments(ctx context.Context, biztag string, size int, client string) (r *segment.Range, err error) {
+	if err = m.validate(EndpointRanges, biztag, "size", size); err != nil {
+		return nil, err
+	}
+	return m.Service.LeaseSegments(ctx, biztag, size, client)
+}
+
+func (m *ValidationMidware) GetObfuscatedSegments(ctx context.Context, biztag string, count int) (ids []string, err error) {
+	if err = m.validate(EndpointObfuscated, biztag, "count", count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetObfuscatedSegments(ctx, biztag, count)
+}
+
+func (m *ValidationMidware) DecodeObfuscatedSegment(ctx context.Context, biztag string, id string) (decoded *obfuscate.Decoded, err error) {
+	if err = ValidateBizTag(biztag); err != nil {
+		return nil, err
+	}
+	return m.Service.DecodeObfuscatedSegment(ctx, biztag, id)
+}
+
+func (m *ValidationMidware) GetCodes(ctx context.Context, biztag string, count int) (codes []string, err error) {
+	if err = m.validate(EndpointCodes, biztag, "count", count); err != nil {
+		return nil, err
+	}
+	return m.Service.GetCodes(ctx, biztag, count)
+}
+
+// Validation 返回参数检查的Midware, 应该在其它Midware之前执行
+func Validation(limits Limits) Midware {
+	return func(svc Service) Service {
+		return &ValidationMidware{Service: svc, limits: limits}
+	}
+}